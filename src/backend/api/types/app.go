@@ -1,6 +1,15 @@
 package types
 
+import "time"
+
 type NetfilterDHookReq struct {
 	Type  string `json:"type" example:"iptables"`
 	Table string `json:"table" example:"nat"`
 }
+
+type ReconcilerRes struct {
+	Runs       uint64     `json:"runs" example:"42"`
+	Repairs    uint64     `json:"repairs" example:"1"`
+	LastRun    *time.Time `json:"lastRun,omitempty"`
+	LastRepair *time.Time `json:"lastRepair,omitempty"`
+}
@@ -0,0 +1,16 @@
+package types
+
+type ConflictsRes struct {
+	Domains   []DomainConflictRes  `json:"domains"`
+	Addresses []AddressConflictRes `json:"addresses"`
+}
+
+type DomainConflictRes struct {
+	Domain string `json:"domain" example:"example.com"`
+	Groups []ID   `json:"groups" swaggertype:"array,string"`
+}
+
+type AddressConflictRes struct {
+	Address string `json:"address" example:"93.184.216.34"`
+	Groups  []ID   `json:"groups" swaggertype:"array,string"`
+}
@@ -0,0 +1,50 @@
+package types
+
+import "time"
+
+type ExplainRes struct {
+	Name *NameExplainRes `json:"name,omitempty"`
+	IP   *IPExplainRes   `json:"ip,omitempty"`
+}
+
+type NameExplainRes struct {
+	Name      string            `json:"name" example:"www.example.com"`
+	Canonical string            `json:"canonical" example:"edge.cdn.net"`
+	Aliases   []string          `json:"aliases" example:"edge.cdn.net,www.example.com"`
+	Matches   []RuleMatchRes    `json:"matches"`
+	Groups    []ID              `json:"groups" swaggertype:"array,string"`
+	Addresses []AddressStateRes `json:"addresses"`
+}
+
+type RuleMatchRes struct {
+	Group   ID     `json:"group" example:"0a1b2c3d" swaggertype:"string"`
+	Rule    ID     `json:"rule" example:"0a1b2c3d" swaggertype:"string"`
+	Name    string `json:"name" example:"www.example.com"`
+	Exclude bool   `json:"exclude" example:"false"`
+}
+
+type AddressStateRes struct {
+	Address  string    `json:"address" example:"93.184.216.34"`
+	Deadline time.Time `json:"deadline"`
+	Groups   []ID      `json:"groups" swaggertype:"array,string"`
+}
+
+type IPExplainRes struct {
+	Address string          `json:"address" example:"93.184.216.34"`
+	Domains []string        `json:"domains" example:"www.example.com"`
+	Groups  []GroupRouteRes `json:"groups"`
+	Default RouteLookupRes  `json:"default"`
+}
+
+type GroupRouteRes struct {
+	Group ID `json:"group" example:"0a1b2c3d" swaggertype:"string"`
+	RouteLookupRes
+}
+
+type RouteLookupRes struct {
+	Mark      uint32 `json:"mark" example:"65536"`
+	Table     int    `json:"table,omitempty" example:"1000"`
+	Interface string `json:"interface,omitempty" example:"nwg0"`
+	Gateway   string `json:"gateway,omitempty" example:"10.8.0.1"`
+	Error     string `json:"error,omitempty" example:"network is unreachable"`
+}
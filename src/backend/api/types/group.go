@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type GroupsReq struct {
 	Groups *[]GroupReq `json:"groups"`
 }
@@ -9,19 +11,137 @@ type GroupsRes struct {
 }
 
 type GroupReq struct {
-	ID        *ID    `json:"id" example:"0a1b2c3d" swaggertype:"string"`
-	Name      string `json:"name" example:"Routing"`
-	Color     string `json:"color" example:"#ffffff"`
-	Interface string `json:"interface" example:"nwg0"`
-	Enable    *bool  `json:"enable" example:"true" TODO:"Make required after 1.0.0"`
+	ID         *ID           `json:"id" example:"0a1b2c3d" swaggertype:"string"`
+	Name       string        `json:"name" example:"Routing"`
+	Color      string        `json:"color" example:"#ffffff"`
+	Interface  string        `json:"interface" example:"nwg0"`
+	Kind       *string       `json:"kind" example:"bypass" enums:",bypass,source"`
+	Gateway    *string       `json:"gateway" example:"192.168.1.2"`
+	Failover   *[]string     `json:"failover" example:"nwg1"`
+	Probe      *ProbeReq     `json:"probe"`
+	Multipath  *[]NexthopReq `json:"multipath"`
+	KillSwitch *bool         `json:"killSwitch" example:"false"`
+	RouteLocal *bool         `json:"routeLocal" example:"false"`
+	Clients    *[]string     `json:"clients" example:"192.168.1.20,aa:bb:cc:dd:ee:ff,@kids"`
+	Ports      *[]string     `json:"ports" example:"tcp/443,udp/443"`
+	Enable     *bool         `json:"enable" example:"true" TODO:"Make required after 1.0.0"`
+	Priority   *int          `json:"priority" example:"0"`
 	RulesReq
 }
 
 type GroupRes struct {
-	ID        ID     `json:"id" example:"0a1b2c3d" swaggertype:"string"`
-	Name      string `json:"name" example:"Routing"`
-	Color     string `json:"color" example:"#ffffff"`
-	Interface string `json:"interface" example:"nwg0"`
-	Enable    bool   `json:"enable" example:"true"`
+	ID         ID           `json:"id" example:"0a1b2c3d" swaggertype:"string"`
+	Name       string       `json:"name" example:"Routing"`
+	Color      string       `json:"color" example:"#ffffff"`
+	Kind       string       `json:"kind,omitempty" example:"bypass"`
+	Interface  string       `json:"interface" example:"nwg0"`
+	Gateway    string       `json:"gateway,omitempty" example:"192.168.1.2"`
+	Failover   []string     `json:"failover,omitempty" example:"nwg1"`
+	Probe      *ProbeRes    `json:"probe,omitempty"`
+	Multipath  []NexthopRes `json:"multipath,omitempty"`
+	KillSwitch bool         `json:"killSwitch" example:"false"`
+	RouteLocal bool         `json:"routeLocal" example:"false"`
+	Clients    []string     `json:"clients,omitempty" example:"192.168.1.20,aa:bb:cc:dd:ee:ff,@kids"`
+	Ports      []string     `json:"ports,omitempty" example:"tcp/443,udp/443"`
+	Enable     bool         `json:"enable" example:"true"`
+	Priority   int          `json:"priority" example:"0"`
 	RulesRes
 }
+
+type NexthopReq struct {
+	Interface string `json:"interface" example:"nwg1"`
+	Weight    int    `json:"weight" example:"1"`
+}
+
+type NexthopRes struct {
+	Interface string `json:"interface" example:"nwg1"`
+	Weight    int    `json:"weight" example:"1"`
+}
+
+type ProbeReq struct {
+	Type     string `json:"type" example:"ping" enums:"link,ping,tcp,dns"`
+	Target   string `json:"target" example:"1.1.1.1"`
+	Interval uint32 `json:"interval" example:"10"`
+	Timeout  uint32 `json:"timeout" example:"2"`
+	Fails    uint32 `json:"fails" example:"3"`
+}
+
+type ProbeRes struct {
+	Type     string `json:"type" example:"ping"`
+	Target   string `json:"target" example:"1.1.1.1"`
+	Interval uint32 `json:"interval" example:"10"`
+	Timeout  uint32 `json:"timeout" example:"2"`
+	Fails    uint32 `json:"fails" example:"3"`
+}
+
+type FailoverRes struct {
+	ActiveInterface string               `json:"activeInterface" example:"nwg0"`
+	Interfaces      []InterfaceHealthRes `json:"interfaces"`
+	Switches        []FailoverSwitchRes  `json:"switches"`
+}
+
+type InterfaceHealthRes struct {
+	Name      string     `json:"name" example:"nwg0"`
+	Healthy   bool       `json:"healthy" example:"true"`
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	Latency   float64    `json:"latency" example:"0.042"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type FailoverSwitchRes struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from" example:"nwg0"`
+	To     string    `json:"to" example:"nwg1"`
+	Reason string    `json:"reason" example:"nwg0 is unhealthy"`
+}
+
+type LinksRes struct {
+	Links []LinkStateRes `json:"links"`
+}
+
+type LinkStateRes struct {
+	Name    string `json:"name" example:"nwg0"`
+	Index   int    `json:"index,omitempty" example:"12"`
+	Present bool   `json:"present" example:"true"`
+	Up      bool   `json:"up" example:"true"`
+	Routed  bool   `json:"routed" example:"true"`
+}
+
+type GroupStatsRes struct {
+	TxPackets       uint64                `json:"txPackets" example:"1200"`
+	TxBytes         uint64                `json:"txBytes" example:"180000"`
+	RxPackets       uint64                `json:"rxPackets" example:"2400"`
+	RxBytes         uint64                `json:"rxBytes" example:"3400000"`
+	TxRate          float64               `json:"txRate" example:"1024"`
+	RxRate          float64               `json:"rxRate" example:"65536"`
+	Samples         []TrafficSampleRes    `json:"samples"`
+	TopDestinations []DestinationStatsRes `json:"topDestinations"`
+}
+
+type TrafficSampleRes struct {
+	Time   time.Time `json:"time"`
+	TxRate float64   `json:"txRate" example:"1024"`
+	RxRate float64   `json:"rxRate" example:"65536"`
+}
+
+type DestinationStatsRes struct {
+	Address     string `json:"address" example:"142.250.74.46"`
+	Connections int    `json:"connections" example:"4"`
+	Bytes       uint64 `json:"bytes" example:"1048576"`
+}
+
+type IPReq struct {
+	Address string  `json:"address" example:"142.250.74.46"`
+	TTL     *uint32 `json:"ttl" example:"3600"`
+}
+
+type IPsRes struct {
+	IPs []IPRes `json:"ips"`
+}
+
+type IPRes struct {
+	Address string   `json:"address" example:"142.250.74.46"`
+	Timeout *uint32  `json:"timeout,omitempty" example:"287"`
+	Manual  bool     `json:"manual,omitempty" example:"false"`
+	Domains []string `json:"domains,omitempty" example:"youtube.com,www.youtube.com"`
+}
@@ -0,0 +1,22 @@
+package types
+
+type RecordsRes struct {
+	Total   int         `json:"total" example:"1250"`
+	Offset  int         `json:"offset" example:"0"`
+	Limit   int         `json:"limit" example:"100"`
+	Records []RecordRes `json:"records"`
+}
+
+type RecordRes struct {
+	Name      string             `json:"name" example:"www.example.com"`
+	Type      string             `json:"type" example:"A" enums:"A,CNAME,PTR"`
+	Addresses []RecordAddressRes `json:"addresses,omitempty"`
+	Alias     string             `json:"alias,omitempty" example:"edge.cdn.net"`
+	Hostname  string             `json:"hostname,omitempty" example:"router.lan"`
+	TTL       uint32             `json:"ttl,omitempty" example:"287"`
+}
+
+type RecordAddressRes struct {
+	Address string `json:"address" example:"93.184.216.34"`
+	TTL     uint32 `json:"ttl" example:"287"`
+}
@@ -9,17 +9,19 @@ type RulesRes struct {
 }
 
 type RuleReq struct {
-	ID     *ID    `json:"id" example:"0a1b2c3d" swaggertype:"string"`
-	Name   string `json:"name" example:"Example Domain"`
-	Type   string `json:"type" example:"domain"`
-	Rule   string `json:"rule" example:"example.com"`
-	Enable bool   `json:"enable" example:"true"`
+	ID      *ID    `json:"id" example:"0a1b2c3d" swaggertype:"string"`
+	Name    string `json:"name" example:"Example Domain"`
+	Type    string `json:"type" example:"domain"`
+	Rule    string `json:"rule" example:"example.com"`
+	Enable  bool   `json:"enable" example:"true"`
+	Exclude *bool  `json:"exclude" example:"false"`
 }
 
 type RuleRes struct {
-	ID     ID     `json:"id" example:"0a1b2c3d" swaggertype:"string"`
-	Name   string `json:"name" example:"Example Domain"`
-	Type   string `json:"type" example:"domain"`
-	Rule   string `json:"rule" example:"example.com"`
-	Enable bool   `json:"enable" example:"true"`
+	ID      ID     `json:"id" example:"0a1b2c3d" swaggertype:"string"`
+	Name    string `json:"name" example:"Example Domain"`
+	Type    string `json:"type" example:"domain"`
+	Rule    string `json:"rule" example:"example.com"`
+	Enable  bool   `json:"enable" example:"true"`
+	Exclude bool   `json:"exclude" example:"false"`
 }
@@ -0,0 +1,185 @@
+package geodata
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultGeoSiteFile = "geosite.dat"
+	DefaultGeoIPFile   = "geoip.dat"
+)
+
+var (
+	ErrCategoryNotFound = errors.New("category not found")
+	ErrInvalidReference = errors.New("invalid reference")
+)
+
+// referenceRegExp is the grammar of rule values, the frontend validator uses the same one
+var referenceRegExp = regexp.MustCompile(`^(?:([a-zA-Z0-9_\-]+(?:\.[a-zA-Z0-9_\-]+)*\.dat):)?([a-zA-Z0-9_\-!]+)(?:@([a-zA-Z0-9_\-!]+))?$`)
+
+type siteEntry struct {
+	modTime time.Time
+	matcher *DomainMatcher
+	err     error
+}
+
+type ipEntry struct {
+	modTime time.Time
+	nets    []net.IPNet
+	err     error
+}
+
+// Store lazily loads categories from dat files and keeps them until the file changes
+type Store struct {
+	locker sync.Mutex
+	dir    string
+	sites  map[string]*siteEntry
+	ips    map[string]*ipEntry
+}
+
+// Reference is a parsed rule value of the form "[file.dat:]category[@attribute]"
+type Reference struct {
+	File      string
+	Category  string
+	Attribute string
+}
+
+func (r Reference) String() string {
+	ref := r.File + ":" + r.Category
+	if r.Attribute != "" {
+		ref += "@" + r.Attribute
+	}
+	return ref
+}
+
+// ParseReference parses a rule value, substituting defaultFile when no file is given
+func ParseReference(value, defaultFile string) (Reference, error) {
+	match := referenceRegExp.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return Reference{}, ErrInvalidReference
+	}
+	ref := Reference{File: match[1], Category: match[2], Attribute: match[3]}
+	if ref.File == "" {
+		ref.File = defaultFile
+	}
+	return ref, nil
+}
+
+// Domains returns the compiled domain list of a geosite category
+func (s *Store) Domains(value string) (*DomainMatcher, error) {
+	ref, err := ParseReference(value, DefaultGeoSiteFile)
+	if err != nil {
+		return nil, err
+	}
+	key := ref.String()
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if entry, ok := s.sites[key]; ok {
+		return entry.matcher, entry.err
+	}
+
+	entry := &siteEntry{}
+	var data []byte
+	data, entry.modTime, entry.err = s.readFile(ref.File)
+	if entry.err == nil {
+		entry.matcher, entry.err = parseGeoSite(data, ref.Category, ref.Attribute)
+	}
+	s.sites[key] = entry
+	return entry.matcher, entry.err
+}
+
+// CIDRs returns the network list of a geoip category
+func (s *Store) CIDRs(value string) ([]net.IPNet, error) {
+	ref, err := ParseReference(value, DefaultGeoIPFile)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Attribute != "" {
+		return nil, ErrInvalidReference
+	}
+	key := ref.String()
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if entry, ok := s.ips[key]; ok {
+		return entry.nets, entry.err
+	}
+
+	entry := &ipEntry{}
+	var data []byte
+	data, entry.modTime, entry.err = s.readFile(ref.File)
+	if entry.err == nil {
+		entry.nets, entry.err = parseGeoIP(data, ref.Category)
+	}
+	s.ips[key] = entry
+	return entry.nets, entry.err
+}
+
+// Refresh drops cached categories whose files were changed, created or removed.
+// Returns true if anything was dropped.
+func (s *Store) Refresh() bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	modTimes := make(map[string]time.Time)
+	modTime := func(file string) time.Time {
+		if t, ok := modTimes[file]; ok {
+			return t
+		}
+		var t time.Time
+		if stat, err := os.Stat(filepath.Join(s.dir, file)); err == nil {
+			t = stat.ModTime()
+		}
+		modTimes[file] = t
+		return t
+	}
+
+	changed := false
+	for key, entry := range s.sites {
+		ref, _ := ParseReference(key, DefaultGeoSiteFile)
+		if !modTime(ref.File).Equal(entry.modTime) {
+			delete(s.sites, key)
+			changed = true
+		}
+	}
+	for key, entry := range s.ips {
+		ref, _ := ParseReference(key, DefaultGeoIPFile)
+		if !modTime(ref.File).Equal(entry.modTime) {
+			delete(s.ips, key)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (s *Store) readFile(file string) ([]byte, time.Time, error) {
+	path := filepath.Join(s.dir, file)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to stat %s: %w", file, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, stat.ModTime(), fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return data, stat.ModTime(), nil
+}
+
+func New(dir string) *Store {
+	return &Store{
+		dir:   dir,
+		sites: make(map[string]*siteEntry),
+		ips:   make(map[string]*ipEntry),
+	}
+}
@@ -0,0 +1,177 @@
+package geodata
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func appendBytes(buf []byte, num uint64, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, num<<3|wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendVarint(buf []byte, num, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, num<<3|wireVarint)
+	return binary.AppendUvarint(buf, value)
+}
+
+func geoSiteDomain(domainType uint64, value string, attrs ...string) []byte {
+	buf := appendVarint(nil, 1, domainType)
+	buf = appendBytes(buf, 2, []byte(value))
+	for _, attr := range attrs {
+		attrBuf := appendBytes(nil, 1, []byte(attr))
+		attrBuf = appendVarint(attrBuf, 2, 1)
+		buf = appendBytes(buf, 3, attrBuf)
+	}
+	return buf
+}
+
+func geoSiteEntry(code string, domains ...[]byte) []byte {
+	buf := appendBytes(nil, 1, []byte(code))
+	for _, domain := range domains {
+		buf = appendBytes(buf, 2, domain)
+	}
+	return buf
+}
+
+func geoIPEntry(code string, cidrs map[string]uint64) []byte {
+	buf := appendBytes(nil, 1, []byte(code))
+	for ip, prefix := range cidrs {
+		cidr := appendBytes(nil, 1, []byte(ip))
+		cidr = appendVarint(cidr, 2, prefix)
+		buf = appendBytes(buf, 2, cidr)
+	}
+	return buf
+}
+
+func writeDat(t *testing.T, dir, name string, entries ...[]byte) {
+	t.Helper()
+	var buf []byte
+	for _, entry := range entries {
+		buf = appendBytes(buf, 1, entry)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	ref, err := ParseReference("youtube", DefaultGeoSiteFile)
+	if err != nil || ref.File != DefaultGeoSiteFile || ref.Category != "youtube" || ref.Attribute != "" {
+		t.Fatalf("unexpected reference: %+v, %v", ref, err)
+	}
+	ref, err = ParseReference("custom.dat:google@ads", DefaultGeoSiteFile)
+	if err != nil || ref.File != "custom.dat" || ref.Category != "google" || ref.Attribute != "ads" {
+		t.Fatalf("unexpected reference: %+v, %v", ref, err)
+	}
+	if _, err = ParseReference("../secret:google", DefaultGeoSiteFile); !errors.Is(err, ErrInvalidReference) {
+		t.Fatalf("path traversal accepted: %v", err)
+	}
+	if _, err = ParseReference("custom:google", DefaultGeoSiteFile); !errors.Is(err, ErrInvalidReference) {
+		t.Fatalf("file without the .dat extension accepted: %v", err)
+	}
+}
+
+func TestGeoSite(t *testing.T) {
+	dir := t.TempDir()
+	writeDat(t, dir, DefaultGeoSiteFile,
+		geoSiteEntry("OTHER", geoSiteDomain(domainFull, "youtube.com")),
+		geoSiteEntry("YOUTUBE",
+			geoSiteDomain(domainRoot, "youtube.com"),
+			geoSiteDomain(domainFull, "youtu.be"),
+			geoSiteDomain(domainPlain, "googlevideo"),
+			geoSiteDomain(domainRegex, `^yt[0-9]\.ggpht\.com$`),
+			geoSiteDomain(domainFull, "ads.youtube.net", "ads"),
+		),
+	)
+	s := New(dir)
+
+	matcher, err := s.Domains("youtube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"youtube.com", "www.YouTube.com", "youtu.be", "r1.googlevideo.com", "yt3.ggpht.com", "ads.youtube.net"} {
+		if !matcher.Match(name) {
+			t.Errorf("%s should match", name)
+		}
+	}
+	for _, name := range []string{"notyoutube.com", "www.youtu.be", "yt.ggpht.com"} {
+		if matcher.Match(name) {
+			t.Errorf("%s should not match", name)
+		}
+	}
+
+	matcher, err = s.Domains("youtube@ads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matcher.Len() != 1 || !matcher.Match("ads.youtube.net") || matcher.Match("youtube.com") {
+		t.Fatal("attribute filter is not applied")
+	}
+
+	if _, err = s.Domains("missing"); !errors.Is(err, ErrCategoryNotFound) {
+		t.Fatalf("expected ErrCategoryNotFound, got %v", err)
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	dir := t.TempDir()
+	writeDat(t, dir, DefaultGeoIPFile,
+		geoIPEntry("TELEGRAM", map[string]uint64{
+			string([]byte{91, 108, 4, 7}):                             22,
+			string([]byte{0x20, 0x01, 0x06, 0x7c, 0x04, 0xe8, 15: 0}): 32,
+		}),
+	)
+	s := New(dir)
+
+	nets, err := s.CIDRs("telegram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, ipNet := range nets {
+		found[ipNet.String()] = true
+	}
+	if len(nets) != 2 || !found["91.108.4.0/22"] || !found["2001:67c::/32"] {
+		t.Fatalf("unexpected networks: %v", nets)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir)
+
+	if _, err := s.Domains("example"); err == nil {
+		t.Fatal("missing file should fail")
+	}
+	if s.Refresh() {
+		t.Fatal("nothing changed yet")
+	}
+
+	writeDat(t, dir, DefaultGeoSiteFile, geoSiteEntry("EXAMPLE", geoSiteDomain(domainRoot, "example.com")))
+	if !s.Refresh() {
+		t.Fatal("created file is not detected")
+	}
+	matcher, err := s.Domains("example")
+	if err != nil || !matcher.Match("www.example.com") {
+		t.Fatalf("category is not loaded: %v", err)
+	}
+
+	writeDat(t, dir, DefaultGeoSiteFile, geoSiteEntry("EXAMPLE", geoSiteDomain(domainRoot, "example.org")))
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(filepath.Join(dir, DefaultGeoSiteFile), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Refresh() {
+		t.Fatal("changed file is not detected")
+	}
+	matcher, err = s.Domains("example")
+	if err != nil || !matcher.Match("example.org") || matcher.Match("example.com") {
+		t.Fatalf("category is not reloaded: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package geodata
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseGeoIP extracts the CIDR list of a single category from the geoip.dat contents
+func parseGeoIP(data []byte, category string) ([]net.IPNet, error) {
+	var nets []net.IPNet
+	found := false
+	err := walk(data, func(entry field) error {
+		if entry.num != 1 || entry.typ != wireBytes || found {
+			return nil
+		}
+		code, err := firstString(entry.bytes, 1)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(code, category) {
+			return nil
+		}
+
+		found = true
+		return walk(entry.bytes, func(f field) error {
+			switch {
+			case f.num == 2 && f.typ == wireBytes:
+				ipNet, err := parseCIDR(f.bytes)
+				if err != nil {
+					return err
+				}
+				if ipNet != nil {
+					nets = append(nets, *ipNet)
+				}
+			case f.num == 3 && f.typ == wireVarint && f.varint != 0:
+				return fmt.Errorf("reverse match is not supported: %s", category)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse geoip: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrCategoryNotFound, category)
+	}
+	return nets, nil
+}
+
+func parseCIDR(buf []byte) (*net.IPNet, error) {
+	var ip net.IP
+	var prefix uint64
+	err := walk(buf, func(f field) error {
+		switch {
+		case f.num == 1 && f.typ == wireBytes:
+			ip = append(net.IP(nil), f.bytes...)
+		case f.num == 2 && f.typ == wireVarint:
+			prefix = f.varint
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return nil, nil
+	}
+	bits := len(ip) * 8
+	if prefix > uint64(bits) {
+		return nil, nil
+	}
+	mask := net.CIDRMask(int(prefix), bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
@@ -0,0 +1,141 @@
+package geodata
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Domain types used in geosite.dat
+const (
+	domainPlain = 0 // substring
+	domainRegex = 1 // regular expression
+	domainRoot  = 2 // domain and all of its subdomains
+	domainFull  = 3 // exact match
+)
+
+// DomainMatcher is a compiled domain list of a single geosite category
+type DomainMatcher struct {
+	full     map[string]struct{}
+	root     map[string]struct{}
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+// Len returns the number of entries in the category
+func (m *DomainMatcher) Len() int {
+	return len(m.full) + len(m.root) + len(m.keywords) + len(m.regexps)
+}
+
+// Match reports whether the domain belongs to the category
+func (m *DomainMatcher) Match(domainName string) bool {
+	domainName = strings.ToLower(domainName)
+	if _, ok := m.full[domainName]; ok {
+		return true
+	}
+	for name := domainName; name != ""; {
+		if _, ok := m.root[name]; ok {
+			return true
+		}
+		idx := strings.IndexByte(name, '.')
+		if idx == -1 {
+			break
+		}
+		name = name[idx+1:]
+	}
+	for _, keyword := range m.keywords {
+		if strings.Contains(domainName, keyword) {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(domainName) {
+			return true
+		}
+	}
+	return false
+}
+
+func newDomainMatcher() *DomainMatcher {
+	return &DomainMatcher{
+		full: make(map[string]struct{}),
+		root: make(map[string]struct{}),
+	}
+}
+
+// parseGeoSite extracts a single category from the geosite.dat contents.
+// If attr is set, only domains carrying that attribute are selected.
+func parseGeoSite(data []byte, category, attr string) (*DomainMatcher, error) {
+	var matcher *DomainMatcher
+	err := walk(data, func(entry field) error {
+		if entry.num != 1 || entry.typ != wireBytes || matcher != nil {
+			return nil
+		}
+		code, err := firstString(entry.bytes, 1)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(code, category) {
+			return nil
+		}
+
+		matcher = newDomainMatcher()
+		return walk(entry.bytes, func(f field) error {
+			if f.num != 2 || f.typ != wireBytes {
+				return nil
+			}
+			return matcher.addDomain(f.bytes, attr)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse geosite: %w", err)
+	}
+	if matcher == nil {
+		return nil, fmt.Errorf("%w: %s", ErrCategoryNotFound, category)
+	}
+	return matcher, nil
+}
+
+func (m *DomainMatcher) addDomain(buf []byte, attr string) error {
+	var domainType uint64
+	var value string
+	hasAttr := attr == ""
+	err := walk(buf, func(f field) error {
+		switch {
+		case f.num == 1 && f.typ == wireVarint:
+			domainType = f.varint
+		case f.num == 2 && f.typ == wireBytes:
+			value = strings.ToLower(string(f.bytes))
+		case f.num == 3 && f.typ == wireBytes && !hasAttr:
+			key, err := firstString(f.bytes, 1)
+			if err != nil {
+				return err
+			}
+			hasAttr = strings.EqualFold(key, attr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !hasAttr || value == "" {
+		return nil
+	}
+
+	switch domainType {
+	case domainPlain:
+		m.keywords = append(m.keywords, value)
+	case domainRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			// Skip broken expressions the same way v2ray does
+			return nil
+		}
+		m.regexps = append(m.regexps, re)
+	case domainRoot:
+		m.root[value] = struct{}{}
+	case domainFull:
+		m.full[value] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package geodata
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Minimal protobuf wire reader, just enough to walk geosite.dat and geoip.dat
+// without pulling the whole protobuf runtime into the router binary.
+
+var (
+	errTruncated   = errors.New("truncated message")
+	errBadWireType = errors.New("unsupported wire type")
+)
+
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireBytes  = 2
+	wireI32    = 5
+)
+
+type field struct {
+	num    uint64
+	typ    uint8
+	varint uint64
+	bytes  []byte
+}
+
+// walk calls fn for every top-level field of the message in buf
+func walk(buf []byte, fn func(f field) error) error {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errTruncated
+		}
+		buf = buf[n:]
+
+		f := field{num: key >> 3, typ: uint8(key & 7)}
+		switch f.typ {
+		case wireVarint:
+			f.varint, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return errTruncated
+			}
+			buf = buf[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < size {
+				return errTruncated
+			}
+			f.bytes = buf[n : n+int(size)]
+			buf = buf[n+int(size):]
+		case wireI64:
+			if len(buf) < 8 {
+				return errTruncated
+			}
+			buf = buf[8:]
+		case wireI32:
+			if len(buf) < 4 {
+				return errTruncated
+			}
+			buf = buf[4:]
+		default:
+			return errBadWireType
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstString returns the first length-delimited field with the given number
+func firstString(buf []byte, num uint64) (string, error) {
+	var value string
+	errFound := errors.New("found")
+	err := walk(buf, func(f field) error {
+		if f.num == num && f.typ == wireBytes {
+			value = string(f.bytes)
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return "", err
+	}
+	return value, nil
+}
@@ -3,29 +3,108 @@ package v1
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"magitrickle/api/types"
+	"magitrickle/internal/app"
 	"magitrickle/models"
+	"magitrickle/records"
 
 	"github.com/dlclark/regexp2"
 )
 
 var colorRegExp = regexp2.MustCompile(`^#[0-9a-f]{6}$`, regexp2.IgnoreCase)
 
+// ValidateGroupReq проверяет запрос на создание или изменение группы, не трогая
+// существующую модель. Вызывается до отключения группы, чтобы ошибочный запрос
+// не оставлял её выключенной или изменённой наполовину.
+func ValidateGroupReq(req types.GroupReq, existing *models.Group) error {
+	if req.ID != nil && existing != nil && existing.ID != *req.ID {
+		return fmt.Errorf("group ID mismatch")
+	}
+	var kind string
+	var clients []string
+	if existing != nil {
+		kind, clients = existing.Kind, existing.Clients
+	}
+	if req.Kind != nil {
+		if err := app.ValidateGroupKind(*req.Kind); err != nil {
+			return err
+		}
+		kind = *req.Kind
+	}
+	if req.Clients != nil {
+		if err := app.ValidateClients(*req.Clients); err != nil {
+			return err
+		}
+		clients = *req.Clients
+	}
+	if req.Ports != nil {
+		if err := app.ValidatePorts(*req.Ports); err != nil {
+			return err
+		}
+	}
+	if req.Gateway != nil {
+		if err := app.ValidateGateway(*req.Gateway); err != nil {
+			return err
+		}
+	}
+	if req.Multipath != nil {
+		if err := app.ValidateMultipath(fromNexthopsReq(*req.Multipath)); err != nil {
+			return err
+		}
+	}
+	if req.Probe != nil {
+		if err := app.ValidateProbe(fromProbeReq(*req.Probe)); err != nil {
+			return err
+		}
+	}
+	if req.Rules != nil {
+		var existingRules []*models.Rule
+		if existing != nil {
+			existingRules = existing.Rules
+		}
+		if err := ValidateRulesReq(*req.Rules, existingRules); err != nil {
+			return err
+		}
+	}
+	return app.ValidateSourceGroup(kind, clients)
+}
+
+// ValidateRulesReq проверяет правила запроса, учитывая флаг исключения,
+// который правило без поля exclude наследует от существующего правила с тем же ID.
+func ValidateRulesReq(reqs []types.RuleReq, existingRules []*models.Rule) error {
+	rules := make([]*models.Rule, len(reqs))
+	for i, ruleReq := range reqs {
+		rule := &models.Rule{Type: ruleReq.Type}
+		if ruleReq.ID != nil {
+			for _, r := range existingRules {
+				if r.ID == *ruleReq.ID {
+					rule.Exclude = r.Exclude
+					break
+				}
+			}
+		}
+		if ruleReq.Exclude != nil {
+			rule.Exclude = *ruleReq.Exclude
+		}
+		rules[i] = rule
+	}
+	return app.ValidateRules(rules)
+}
+
 func FromGroupReq(req types.GroupReq, existing *models.Group) (*models.Group, error) {
+	if err := ValidateGroupReq(req, existing); err != nil {
+		return nil, err
+	}
 	var group *models.Group
 	if existing == nil {
 		group = &models.Group{ID: types.RandomID()}
 	} else {
 		group = existing
 	}
-	if req.ID != nil {
-		if existing != nil && group.ID != *req.ID {
-			return nil, fmt.Errorf("group ID mismatch")
-		}
-		if existing == nil {
-			group.ID = *req.ID
-		}
+	if req.ID != nil && existing == nil {
+		group.ID = *req.ID
 	}
 	group.Name = req.Name
 	if match, _ := colorRegExp.MatchString(req.Color); !match {
@@ -40,6 +119,36 @@ func FromGroupReq(req types.GroupReq, existing *models.Group) (*models.Group, er
 	if req.Enable != nil {
 		group.Enable = *req.Enable
 	}
+	if req.Priority != nil {
+		group.Priority = *req.Priority
+	}
+	if req.Failover != nil {
+		group.Failover = *req.Failover
+	}
+	if req.Kind != nil {
+		group.Kind = *req.Kind
+	}
+	if req.KillSwitch != nil {
+		group.KillSwitch = *req.KillSwitch
+	}
+	if req.RouteLocal != nil {
+		group.RouteLocal = *req.RouteLocal
+	}
+	if req.Clients != nil {
+		group.Clients = *req.Clients
+	}
+	if req.Ports != nil {
+		group.Ports = *req.Ports
+	}
+	if req.Gateway != nil {
+		group.Gateway = *req.Gateway
+	}
+	if req.Multipath != nil {
+		group.Multipath = fromNexthopsReq(*req.Multipath)
+	}
+	if req.Probe != nil {
+		group.Probe = fromProbeReq(*req.Probe)
+	}
 
 	if req.Rules != nil {
 		newRules := make([]*models.Rule, len(*req.Rules))
@@ -55,8 +164,29 @@ func FromGroupReq(req types.GroupReq, existing *models.Group) (*models.Group, er
 	return group, nil
 }
 
+func fromNexthopsReq(req []types.NexthopReq) []models.Nexthop {
+	multipath := make([]models.Nexthop, len(req))
+	for i, nexthop := range req {
+		multipath[i] = models.Nexthop{Interface: nexthop.Interface, Weight: nexthop.Weight}
+	}
+	return multipath
+}
+
+func fromProbeReq(req types.ProbeReq) models.Probe {
+	return models.Probe{
+		Type:     req.Type,
+		Target:   req.Target,
+		Interval: req.Interval,
+		Timeout:  req.Timeout,
+		Fails:    req.Fails,
+	}
+}
+
 // fromRuleReq конвертирует RuleReq в Rule.
 func FromRuleReq(ruleReq types.RuleReq, existingRules []*models.Rule) (*models.Rule, error) {
+	if err := ValidateRulesReq([]types.RuleReq{ruleReq}, existingRules); err != nil {
+		return nil, err
+	}
 	var rule *models.Rule
 	if ruleReq.ID != nil {
 		for _, r := range existingRules {
@@ -75,6 +205,9 @@ func FromRuleReq(ruleReq types.RuleReq, existingRules []*models.Rule) (*models.R
 	rule.Type = ruleReq.Type
 	rule.Rule = ruleReq.Rule
 	rule.Enable = ruleReq.Enable
+	if ruleReq.Exclude != nil {
+		rule.Exclude = *ruleReq.Exclude
+	}
 	return rule, nil
 }
 
@@ -88,11 +221,31 @@ func ToGroupsRes(groups []*models.Group, withRules bool) types.GroupsRes {
 
 func ToGroupRes(group *models.Group, withRules bool) types.GroupRes {
 	groupRes := types.GroupRes{
-		ID:        group.ID,
-		Name:      group.Name,
-		Color:     group.Color,
-		Interface: group.Interface,
-		Enable:    group.Enable,
+		ID:         group.ID,
+		Name:       group.Name,
+		Color:      group.Color,
+		Kind:       group.Kind,
+		Interface:  group.Interface,
+		Gateway:    group.Gateway,
+		Failover:   group.Failover,
+		KillSwitch: group.KillSwitch,
+		RouteLocal: group.RouteLocal,
+		Clients:    group.Clients,
+		Ports:      group.Ports,
+		Enable:     group.Enable,
+		Priority:   group.Priority,
+	}
+	for _, nexthop := range group.Multipath {
+		groupRes.Multipath = append(groupRes.Multipath, types.NexthopRes{Interface: nexthop.Interface, Weight: nexthop.Weight})
+	}
+	if group.Probe != (models.Probe{}) {
+		groupRes.Probe = &types.ProbeRes{
+			Type:     group.Probe.Type,
+			Target:   group.Probe.Target,
+			Interval: group.Probe.Interval,
+			Timeout:  group.Probe.Timeout,
+			Fails:    group.Probe.Fails,
+		}
 	}
 	if withRules {
 		groupRes.RulesRes = ToRulesRes(group.Rules)
@@ -100,6 +253,191 @@ func ToGroupRes(group *models.Group, withRules bool) types.GroupRes {
 	return groupRes
 }
 
+func ToConflictsRes(domainConflicts []app.DomainConflict, addressConflicts []app.AddressConflict) types.ConflictsRes {
+	res := types.ConflictsRes{
+		Domains:   make([]types.DomainConflictRes, len(domainConflicts)),
+		Addresses: make([]types.AddressConflictRes, len(addressConflicts)),
+	}
+	for i, conflict := range domainConflicts {
+		res.Domains[i] = types.DomainConflictRes{Domain: conflict.Domain, Groups: conflict.Groups}
+	}
+	for i, conflict := range addressConflicts {
+		res.Addresses[i] = types.AddressConflictRes{Address: conflict.Address.String(), Groups: conflict.Groups}
+	}
+	return res
+}
+
+func ToFailoverRes(status app.FailoverStatus) types.FailoverRes {
+	res := types.FailoverRes{
+		ActiveInterface: status.Active,
+		Interfaces:      make([]types.InterfaceHealthRes, len(status.Interfaces)),
+		Switches:        make([]types.FailoverSwitchRes, len(status.Switches)),
+	}
+	for i, health := range status.Interfaces {
+		res.Interfaces[i] = types.InterfaceHealthRes{
+			Name:    health.Name,
+			Healthy: health.Healthy,
+			Latency: health.Latency.Seconds(),
+			Error:   health.Error,
+		}
+		if !health.LastCheck.IsZero() {
+			lastCheck := health.LastCheck
+			res.Interfaces[i].LastCheck = &lastCheck
+		}
+	}
+	for i, sw := range status.Switches {
+		res.Switches[i] = types.FailoverSwitchRes{Time: sw.Time, From: sw.From, To: sw.To, Reason: sw.Reason}
+	}
+	return res
+}
+
+func ToLinksRes(states []app.LinkState) types.LinksRes {
+	res := types.LinksRes{Links: make([]types.LinkStateRes, len(states))}
+	for i, state := range states {
+		res.Links[i] = types.LinkStateRes{
+			Name:    state.Name,
+			Index:   state.Index,
+			Present: state.Present,
+			Up:      state.Up,
+			Routed:  state.Routed,
+		}
+	}
+	return res
+}
+
+func ToGroupStatsRes(stats app.GroupStats) types.GroupStatsRes {
+	res := types.GroupStatsRes{
+		TxPackets:       stats.TxPackets,
+		TxBytes:         stats.TxBytes,
+		RxPackets:       stats.RxPackets,
+		RxBytes:         stats.RxBytes,
+		TxRate:          stats.TxRate,
+		RxRate:          stats.RxRate,
+		Samples:         make([]types.TrafficSampleRes, len(stats.Samples)),
+		TopDestinations: make([]types.DestinationStatsRes, len(stats.TopDestinations)),
+	}
+	for i, sample := range stats.Samples {
+		res.Samples[i] = types.TrafficSampleRes{Time: sample.Time, TxRate: sample.TxRate, RxRate: sample.RxRate}
+	}
+	for i, destination := range stats.TopDestinations {
+		res.TopDestinations[i] = types.DestinationStatsRes{
+			Address:     destination.Address.String(),
+			Connections: destination.Connections,
+			Bytes:       destination.Bytes,
+		}
+	}
+	return res
+}
+
+func ToIPsRes(ips []app.GroupIP) types.IPsRes {
+	res := types.IPsRes{IPs: make([]types.IPRes, len(ips))}
+	for i, ip := range ips {
+		address := ip.Net.String()
+		if ones, bits := ip.Net.Mask.Size(); ones == bits {
+			address = ip.Net.IP.String()
+		}
+		res.IPs[i] = types.IPRes{
+			Address: address,
+			Timeout: ip.Timeout,
+			Manual:  ip.Manual,
+			Domains: ip.Domains,
+		}
+	}
+	return res
+}
+
+func ToNameExplainRes(explanation app.NameExplanation) *types.NameExplainRes {
+	res := &types.NameExplainRes{
+		Name:      explanation.Name,
+		Canonical: explanation.Canonical,
+		Aliases:   explanation.Aliases,
+		Matches:   make([]types.RuleMatchRes, len(explanation.Matches)),
+		Groups:    explanation.Groups,
+		Addresses: make([]types.AddressStateRes, len(explanation.Addresses)),
+	}
+	for i, match := range explanation.Matches {
+		res.Matches[i] = types.RuleMatchRes{Group: match.Group, Rule: match.Rule, Name: match.Name, Exclude: match.Exclude}
+	}
+	for i, address := range explanation.Addresses {
+		res.Addresses[i] = types.AddressStateRes{Address: address.Address.String(), Deadline: address.Deadline, Groups: address.Groups}
+	}
+	return res
+}
+
+func ToIPExplainRes(explanation app.IPExplanation) *types.IPExplainRes {
+	res := &types.IPExplainRes{
+		Address: explanation.Address.String(),
+		Domains: explanation.Domains,
+		Groups:  make([]types.GroupRouteRes, len(explanation.Groups)),
+		Default: toRouteLookupRes(explanation.Default),
+	}
+	for i, group := range explanation.Groups {
+		res.Groups[i] = types.GroupRouteRes{Group: group.Group, RouteLookupRes: toRouteLookupRes(group.RouteLookup)}
+	}
+	return res
+}
+
+func toRouteLookupRes(lookup app.RouteLookup) types.RouteLookupRes {
+	res := types.RouteLookupRes{
+		Mark:      lookup.Mark,
+		Table:     lookup.Table,
+		Interface: lookup.Interface,
+		Error:     lookup.Error,
+	}
+	if lookup.Gateway != nil {
+		res.Gateway = lookup.Gateway.String()
+	}
+	return res
+}
+
+func ToRecordsRes(entries []records.Entry, total, offset, limit int) types.RecordsRes {
+	now := time.Now()
+	ttl := func(deadline time.Time) uint32 {
+		if !deadline.After(now) {
+			return 0
+		}
+		return uint32(deadline.Sub(now).Seconds())
+	}
+	res := types.RecordsRes{
+		Total:   total,
+		Offset:  offset,
+		Limit:   limit,
+		Records: make([]types.RecordRes, len(entries)),
+	}
+	for i, entry := range entries {
+		record := types.RecordRes{Name: entry.Name, Type: entry.Type}
+		switch {
+		case entry.CName != nil:
+			record.Alias = entry.CName.Alias
+			record.TTL = ttl(entry.CName.Deadline)
+		case entry.PTR != nil:
+			record.Hostname = entry.PTR.Hostname
+			record.TTL = ttl(entry.PTR.Deadline)
+		}
+		for _, aRecord := range entry.ARecords {
+			record.Addresses = append(record.Addresses, types.RecordAddressRes{
+				Address: aRecord.Address.String(),
+				TTL:     ttl(aRecord.Deadline),
+			})
+		}
+		res.Records[i] = record
+	}
+	return res
+}
+
+func ToReconcilerRes(stats app.ReconcilerStats) types.ReconcilerRes {
+	res := types.ReconcilerRes{Runs: stats.Runs, Repairs: stats.Repairs}
+	if !stats.LastRun.IsZero() {
+		lastRun := stats.LastRun
+		res.LastRun = &lastRun
+	}
+	if !stats.LastRepair.IsZero() {
+		lastRepair := stats.LastRepair
+		res.LastRepair = &lastRepair
+	}
+	return res
+}
+
 func ToRulesRes(rules []*models.Rule) types.RulesRes {
 	ruleResList := make([]types.RuleRes, len(rules))
 	for i, rule := range rules {
@@ -110,10 +448,11 @@ func ToRulesRes(rules []*models.Rule) types.RulesRes {
 
 func ToRuleRes(rule *models.Rule) types.RuleRes {
 	return types.RuleRes{
-		ID:     rule.ID,
-		Name:   rule.Name,
-		Type:   rule.Type,
-		Rule:   rule.Rule,
-		Enable: rule.Enable,
+		ID:      rule.ID,
+		Name:    rule.Name,
+		Type:    rule.Type,
+		Rule:    rule.Rule,
+		Enable:  rule.Enable,
+		Exclude: rule.Exclude,
 	}
 }
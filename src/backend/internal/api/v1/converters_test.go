@@ -0,0 +1,47 @@
+package v1
+
+import (
+	"testing"
+
+	"magitrickle/api/types"
+	"magitrickle/models"
+)
+
+func TestFromGroupReq_InvalidRequestKeepsGroup(t *testing.T) {
+	existing := &models.Group{ID: types.RandomID(), Name: "old", Interface: "nwg0", Ports: []string{"tcp/443"}}
+	ports := []string{"sctp/1"}
+	req := types.GroupReq{Name: "new", Interface: "nwg1", Ports: &ports}
+
+	if err := ValidateGroupReq(req, existing); err == nil {
+		t.Fatal("invalid ports accepted")
+	}
+	if _, err := FromGroupReq(req, existing); err == nil {
+		t.Fatal("invalid ports accepted")
+	}
+	if existing.Name != "old" || existing.Interface != "nwg0" || len(existing.Ports) != 1 {
+		t.Fatalf("group changed by a rejected request: %+v", existing)
+	}
+}
+
+func TestValidateGroupReq_ExcludedGeoIPRule(t *testing.T) {
+	ruleID := types.RandomID()
+	existing := &models.Group{
+		ID:    types.RandomID(),
+		Rules: []*models.Rule{{ID: ruleID, Type: "domain", Rule: "example.com", Exclude: true}},
+	}
+
+	exclude := true
+	rules := []types.RuleReq{{Type: "geoip", Rule: "ru", Exclude: &exclude}}
+	if err := ValidateGroupReq(types.GroupReq{RulesReq: types.RulesReq{Rules: &rules}}, nil); err == nil {
+		t.Fatal("excluded geoip rule accepted")
+	}
+
+	// the rule keeps its exclusion when the request omits the field
+	rules = []types.RuleReq{{ID: &ruleID, Type: "geoip", Rule: "ru"}}
+	if err := ValidateGroupReq(types.GroupReq{RulesReq: types.RulesReq{Rules: &rules}}, existing); err == nil {
+		t.Fatal("inherited exclusion on geoip rule accepted")
+	}
+	if existing.Rules[0].Type != "domain" {
+		t.Fatalf("rule changed by a rejected request: %+v", existing.Rules[0])
+	}
+}
@@ -2,15 +2,20 @@ package v1
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"magitrickle/api/types"
 	"magitrickle/internal/app"
 	"magitrickle/models"
+	"magitrickle/records"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog/log"
 )
 
@@ -160,16 +165,141 @@ func (h *Handler) NetfilterDHook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Debug().Str("type", req.Type).Str("table", req.Table).Msg("netfilter.d event")
-	if h.app.DnsOverrider() != nil {
-		if err := h.app.DnsOverrider().NetfilterDHook(req.Type, req.Table); err != nil {
-			log.Error().Err(err).Msg("error fixing iptables after netfilter.d")
+	if err := h.app.NetfilterDHook(req.Type, req.Table); err != nil {
+		log.Error().Err(err).Msg("error fixing iptables after netfilter.d")
+	}
+}
+
+// GetReconciler
+//
+//	@Summary		Получить состояние проверки правил
+//	@Description	Возвращает число проверок правил netfilter и маршрутов групп и число исправлений, сделанных после их изменения извне
+//	@Tags			hooks
+//	@Produce		json
+//	@Success		200		{object}	types.ReconcilerRes
+//	@Router			/api/v1/system/reconciler [get]
+func (h *Handler) GetReconciler(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, http.StatusOK, ToReconcilerRes(h.app.ReconcilerStats()))
+}
+
+// Explain
+//
+//	@Summary		Объяснить маршрутизацию
+//	@Description	Для домена возвращает цепочку CNAME, совпавшие правила групп, группы, которым достаются адреса, и адреса из кеша DNS с отметкой, в ipset каких групп они лежат. Для адреса возвращает группы, в ipset которых он лежит, и маршрут, который ядро выбирает по метке каждой группы и без метки.
+//	@Tags			diagnostics
+//	@Produce		json
+//	@Param			name	query		string	false	"Домен"
+//	@Param			ip		query		string	false	"Адрес"
+//	@Success		200		{object}	types.ExplainRes
+//	@Failure		400		{object}	types.ErrorRes
+//	@Router			/api/v1/diagnostics/explain [get]
+func (h *Handler) Explain(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !query.Has("name") && !query.Has("ip") {
+		WriteError(w, http.StatusBadRequest, "name or ip is required")
+		return
+	}
+	var res types.ExplainRes
+	if query.Has("name") {
+		explanation, err := h.app.ExplainName(query.Get("name"))
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		res.Name = ToNameExplainRes(explanation)
+	}
+	if query.Has("ip") {
+		explanation, err := h.app.ExplainIP(query.Get("ip"))
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		res.IP = ToIPExplainRes(explanation)
+	}
+	WriteJson(w, http.StatusOK, res)
+}
+
+const (
+	defaultRecordsLimit = 100
+	maxRecordsLimit     = 1000
+)
+
+// GetRecords
+//
+//	@Summary		Получить кеш DNS
+//	@Description	Возвращает страницу кеша DNS: A-записи с адресами, CNAME и PTR с оставшимся временем жизни в секундах. Записи отсортированы по имени.
+//	@Tags			records
+//	@Produce		json
+//	@Param			search	query		string	false	"Часть имени"
+//	@Param			type	query		string	false	"Тип записи"	Enums(A, CNAME, PTR)
+//	@Param			offset	query		int		false	"Смещение"
+//	@Param			limit	query		int		false	"Размер страницы (до 1000)"
+//	@Success		200		{object}	types.RecordsRes
+//	@Failure		400		{object}	types.ErrorRes
+//	@Router			/api/v1/records [get]
+func (h *Handler) GetRecords(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	entryType := strings.ToUpper(query.Get("type"))
+	switch entryType {
+	case "", records.EntryTypeA, records.EntryTypeCName, records.EntryTypePTR:
+	default:
+		WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid record type: %s", query.Get("type")))
+		return
+	}
+	offset := 0
+	if query.Has("offset") {
+		var err error
+		offset, err = strconv.Atoi(query.Get("offset"))
+		if err != nil || offset < 0 {
+			WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid offset: %s", query.Get("offset")))
+			return
 		}
 	}
-	for _, group := range h.app.Groups() {
-		if err := group.NetfilterDHook(req.Type, req.Table); err != nil {
-			log.Error().Err(err).Msg("error while fixing iptables in group")
+	limit := defaultRecordsLimit
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > maxRecordsLimit {
+			WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit: %s", query.Get("limit")))
+			return
 		}
 	}
+	entries, total := h.app.Records(query.Get("search"), entryType, offset, limit)
+	WriteJson(w, http.StatusOK, ToRecordsRes(entries, total, offset, limit))
+}
+
+// DeleteRecord
+//
+//	@Summary		Удалить имя из кеша DNS
+//	@Description	Удаляет все записи имени из кеша DNS и синхронизирует группы
+//	@Tags			records
+//	@Param			name	path	string	true	"Имя"
+//	@Success		200
+//	@Failure		404		{object}	types.ErrorRes
+//	@Failure		500		{object}	types.ErrorRes
+//	@Router			/api/v1/records/{name} [delete]
+func (h *Handler) DeleteRecord(w http.ResponseWriter, r *http.Request) {
+	if err := h.app.DeleteRecord(chi.URLParam(r, "name")); err != nil {
+		if errors.Is(err, app.ErrRecordNotFound) {
+			WriteError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync groups: %v", err))
+	}
+}
+
+// FlushRecords
+//
+//	@Summary		Очистить кеш DNS
+//	@Description	Удаляет все записи кеша DNS и синхронизирует группы: в ipset остаются адреса из правил и добавленные вручную
+//	@Tags			records
+//	@Success		200
+//	@Failure		500		{object}	types.ErrorRes
+//	@Router			/api/v1/records [delete]
+func (h *Handler) FlushRecords(w http.ResponseWriter, r *http.Request) {
+	if err := h.app.FlushRecords(); err != nil {
+		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync groups: %v", err))
+	}
 }
 
 // ListInterfaces
@@ -252,20 +382,35 @@ func (h *Handler) PutGroups(w http.ResponseWriter, r *http.Request) {
 		WriteError(w, http.StatusBadRequest, "no groups in request")
 		return
 	}
-	for _, g := range h.app.Groups() {
-		_ = g.Disable()
-	}
-	newGroups := make([]*models.Group, len(*req.Groups))
+	existing := make([]*models.Group, len(*req.Groups))
 	for i, gReq := range *req.Groups {
-		var existing *models.Group
 		for _, g := range h.app.Groups() {
 			if gReq.ID != nil && g.Group.ID == *gReq.ID {
-				existing = g.Group
+				existing[i] = g.Group
 				break
 			}
 		}
-		newGroups[i], err = FromGroupReq(gReq, existing)
+		if err := ValidateGroupReq(gReq, existing[i]); err != nil {
+			WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	var disabled []*app.Group
+	for _, g := range h.app.Groups() {
+		if g.Enabled() {
+			_ = g.Disable()
+			disabled = append(disabled, g)
+		}
+	}
+	newGroups := make([]*models.Group, len(*req.Groups))
+	for i, gReq := range *req.Groups {
+		newGroups[i], err = FromGroupReq(gReq, existing[i])
 		if err != nil {
+			for _, g := range disabled {
+				if err := g.Enable(); err != nil {
+					log.Error().Str("group", g.ID.String()).Err(err).Msg("failed to re-enable group")
+				}
+			}
 			WriteError(w, http.StatusBadRequest, err.Error())
 			return
 		}
@@ -321,6 +466,20 @@ func (h *Handler) CreateGroup(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetConflicts
+//
+//	@Summary		Получить конфликты групп
+//	@Description	Возвращает домены, подходящие под правила нескольких групп, и адреса, находящиеся в ipset нескольких групп. Группы перечислены в порядке приоритета, домен достаётся первой из них
+//	@Tags			groups
+//	@Produce		json
+//	@Success		200			{object}	types.ConflictsRes
+//	@Failure		500			{object}	types.ErrorRes
+//	@Router			/api/v1/groups/conflicts [get]
+func (h *Handler) GetConflicts(w http.ResponseWriter, r *http.Request) {
+	domainConflicts, addressConflicts := h.app.Conflicts()
+	WriteJson(w, http.StatusOK, ToConflictsRes(domainConflicts, addressConflicts))
+}
+
 // GetGroup
 //
 //	@Summary		Получить группу
@@ -340,6 +499,184 @@ func (h *Handler) GetGroup(w http.ResponseWriter, r *http.Request) {
 	WriteJson(w, http.StatusOK, ToGroupRes(group, withRules))
 }
 
+// GetFailover
+//
+//	@Summary		Получить состояние резервирования группы
+//	@Description	Возвращает активный интерфейс группы, результаты проверок доступности интерфейсов и историю переключений
+//	@Tags			groups
+//	@Produce		json
+//	@Param			groupID	path		string	true	"ID группы"
+//	@Success		200		{object}	types.FailoverRes
+//	@Failure		404		{object}	types.ErrorRes
+//	@Router			/api/v1/groups/{groupID}/failover [get]
+func (h *Handler) GetFailover(w http.ResponseWriter, r *http.Request) {
+	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
+	WriteJson(w, http.StatusOK, ToFailoverRes(h.app.Groups()[groupIdx].FailoverStatus()))
+}
+
+// GetLinks
+//
+//	@Summary		Получить состояние интерфейсов группы
+//	@Description	Возвращает интерфейсы группы (основной, резервные и пути балансировки): есть ли интерфейс в системе, включён ли он и проложен ли через него маршрут группы
+//	@Tags			groups
+//	@Produce		json
+//	@Param			groupID	path		string	true	"ID группы"
+//	@Success		200		{object}	types.LinksRes
+//	@Failure		404		{object}	types.ErrorRes
+//	@Router			/api/v1/groups/{groupID}/links [get]
+func (h *Handler) GetLinks(w http.ResponseWriter, r *http.Request) {
+	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
+	WriteJson(w, http.StatusOK, ToLinksRes(h.app.Groups()[groupIdx].LinkStates()))
+}
+
+// GetStats
+//
+//	@Summary		Получить статистику трафика группы
+//	@Description	Возвращает объём трафика группы с момента запуска, скорость за последние 10 минут (замеры раз в 15 секунд) и адреса с наибольшим трафиком. Объём трафика по адресам доступен только при включённом net.netfilter.nf_conntrack_acct.
+//	@Tags			groups
+//	@Produce		json
+//	@Param			groupID	path		string	true	"ID группы"
+//	@Success		200		{object}	types.GroupStatsRes
+//	@Failure		404		{object}	types.ErrorRes
+//	@Router			/api/v1/groups/{groupID}/stats [get]
+func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
+	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
+	WriteJson(w, http.StatusOK, ToGroupStatsRes(h.app.Groups()[groupIdx].Stats()))
+}
+
+// GetIPs
+//
+//	@Summary		Получить адреса группы
+//	@Description	Возвращает содержимое ipset группы: адреса с оставшимся временем жизни и доменами, DNS-ответы на которые их добавили, а также подсети из правил
+//	@Tags			groups
+//	@Produce		json
+//	@Param			groupID	path		string	true	"ID группы"
+//	@Success		200		{object}	types.IPsRes
+//	@Failure		404		{object}	types.ErrorRes
+//	@Failure		409		{object}	types.ErrorRes
+//	@Failure		500		{object}	types.ErrorRes
+//	@Router			/api/v1/groups/{groupID}/ips [get]
+func (h *Handler) GetIPs(w http.ResponseWriter, r *http.Request) {
+	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
+	ips, err := h.app.Groups()[groupIdx].IPs()
+	if err != nil {
+		writeGroupIPsError(w, err)
+		return
+	}
+	WriteJson(w, http.StatusOK, ToIPsRes(ips))
+}
+
+// AddIP
+//
+//	@Summary		Добавить адрес в группу
+//	@Description	Добавляет адрес в ipset группы вручную. Без ttl адрес остаётся до перезапуска или очистки адресов группы.
+//	@Tags			groups
+//	@Accept			json
+//	@Produce		json
+//	@Param			groupID	path		string		true	"ID группы"
+//	@Param			json	body		types.IPReq	true	"Тело запроса"
+//	@Success		200		{object}	types.IPsRes
+//	@Failure		400		{object}	types.ErrorRes
+//	@Failure		404		{object}	types.ErrorRes
+//	@Failure		409		{object}	types.ErrorRes
+//	@Failure		500		{object}	types.ErrorRes
+//	@Router			/api/v1/groups/{groupID}/ips [post]
+func (h *Handler) AddIP(w http.ResponseWriter, r *http.Request) {
+	req, err := ReadJson[types.IPReq](r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	address := net.ParseIP(req.Address)
+	if address == nil {
+		WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid address: %s", req.Address))
+		return
+	}
+	var ttl uint32
+	if req.TTL != nil {
+		ttl = *req.TTL
+	}
+	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
+	group := h.app.Groups()[groupIdx]
+	if err := group.AddManualIP(address, ttl); err != nil {
+		writeGroupIPsError(w, err)
+		return
+	}
+	ips, err := group.IPs()
+	if err != nil {
+		writeGroupIPsError(w, err)
+		return
+	}
+	WriteJson(w, http.StatusOK, ToIPsRes(ips))
+}
+
+// DeleteIPs
+//
+//	@Summary		Удалить адреса группы
+//	@Description	Удаляет адрес из ipset группы, а без параметра address очищает все адреса из DNS и добавленные вручную. Подсети и адреса из правил geoip остаются. Соединения с удалёнными адресами сбрасываются.
+//	@Tags			groups
+//	@Param			groupID	path	string	true	"ID группы"
+//	@Param			address	query	string	false	"Адрес"
+//	@Success		200
+//	@Failure		400		{object}	types.ErrorRes
+//	@Failure		404		{object}	types.ErrorRes
+//	@Failure		409		{object}	types.ErrorRes
+//	@Failure		500		{object}	types.ErrorRes
+//	@Router			/api/v1/groups/{groupID}/ips [delete]
+func (h *Handler) DeleteIPs(w http.ResponseWriter, r *http.Request) {
+	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
+	group := h.app.Groups()[groupIdx]
+	if r.URL.Query().Has("address") {
+		address := net.ParseIP(r.URL.Query().Get("address"))
+		if address == nil {
+			WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid address: %s", r.URL.Query().Get("address")))
+			return
+		}
+		if err := group.RemoveIP(address); err != nil {
+			writeGroupIPsError(w, err)
+		}
+		return
+	}
+	if err := group.FlushIPs(); err != nil {
+		writeGroupIPsError(w, err)
+	}
+}
+
+// SyncIPs
+//
+//	@Summary		Синхронизировать адреса группы
+//	@Description	Заново заполняет ipset группы из кеша DNS и правил
+//	@Tags			groups
+//	@Produce		json
+//	@Param			groupID	path		string	true	"ID группы"
+//	@Success		200		{object}	types.IPsRes
+//	@Failure		404		{object}	types.ErrorRes
+//	@Failure		409		{object}	types.ErrorRes
+//	@Failure		500		{object}	types.ErrorRes
+//	@Router			/api/v1/groups/{groupID}/ips/sync [post]
+func (h *Handler) SyncIPs(w http.ResponseWriter, r *http.Request) {
+	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
+	group := h.app.Groups()[groupIdx]
+	if err := group.Sync(); err != nil {
+		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync group: %v", err))
+		return
+	}
+	ips, err := group.IPs()
+	if err != nil {
+		writeGroupIPsError(w, err)
+		return
+	}
+	WriteJson(w, http.StatusOK, ToIPsRes(ips))
+}
+
+func writeGroupIPsError(w http.ResponseWriter, err error) {
+	if errors.Is(err, app.ErrGroupDisabled) || errors.Is(err, app.ErrAddressOwned) {
+		WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	WriteError(w, http.StatusInternalServerError, err.Error())
+}
+
 // PutGroup
 //
 //	@Summary		Обновить группу
@@ -364,6 +701,11 @@ func (h *Handler) PutGroup(w http.ResponseWriter, r *http.Request) {
 	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
 	groupWrapper := h.app.Groups()[groupIdx]
 
+	if err := ValidateGroupReq(req, groupWrapper.Group); err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	enabled := groupWrapper.Enabled()
 	if enabled {
 		if err := groupWrapper.Disable(); err != nil {
@@ -374,6 +716,11 @@ func (h *Handler) PutGroup(w http.ResponseWriter, r *http.Request) {
 
 	updatedGroup, err := FromGroupReq(req, groupWrapper.Group)
 	if err != nil {
+		if enabled {
+			if err := groupWrapper.Enable(); err != nil {
+				log.Error().Str("group", groupWrapper.ID.String()).Err(err).Msg("failed to re-enable group")
+			}
+		}
 		WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
@@ -383,8 +730,8 @@ func (h *Handler) PutGroup(w http.ResponseWriter, r *http.Request) {
 			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to enable group: %v", err))
 			return
 		}
-		if err := groupWrapper.Sync(); err != nil {
-			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync group: %v", err))
+		if err := h.app.SyncGroups(); err != nil {
+			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync groups: %v", err))
 			return
 		}
 	}
@@ -470,15 +817,21 @@ func (h *Handler) PutRules(w http.ResponseWriter, r *http.Request) {
 	groupIdx, _ := strconv.Atoi(r.Header.Get("groupIdx"))
 	groupWrapper := h.app.Groups()[groupIdx]
 	enabled := groupWrapper.Enabled()
+	if err := ValidateRulesReq(*req.Rules, groupWrapper.Group.Rules); err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	newRules := make([]*models.Rule, len(*req.Rules))
 	for i, rr := range *req.Rules {
 		id := types.RandomID()
+		exclude := false
 		if rr.ID != nil {
 			found := false
 			for _, oldRule := range groupWrapper.Group.Rules {
 				if oldRule.ID == *rr.ID {
 					id = *rr.ID
+					exclude = oldRule.Exclude
 					found = true
 					break
 				}
@@ -488,18 +841,22 @@ func (h *Handler) PutRules(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
+		if rr.Exclude != nil {
+			exclude = *rr.Exclude
+		}
 		newRules[i] = &models.Rule{
-			ID:     id,
-			Name:   rr.Name,
-			Type:   rr.Type,
-			Rule:   rr.Rule,
-			Enable: rr.Enable,
+			ID:      id,
+			Name:    rr.Name,
+			Type:    rr.Type,
+			Rule:    rr.Rule,
+			Enable:  rr.Enable,
+			Exclude: exclude,
 		}
 	}
 	groupWrapper.Group.Rules = newRules
 	if enabled {
-		if err := groupWrapper.Sync(); err != nil {
-			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync group: %v", err))
+		if err := h.app.SyncGroups(); err != nil {
+			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync groups: %v", err))
 			return
 		}
 	}
@@ -543,8 +900,8 @@ func (h *Handler) CreateRule(w http.ResponseWriter, r *http.Request) {
 	}
 	groupWrapper.Group.Rules = append(groupWrapper.Group.Rules, rule)
 	if enabled {
-		if err := groupWrapper.Sync(); err != nil {
-			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync group: %v", err))
+		if err := h.app.SyncGroups(); err != nil {
+			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync groups: %v", err))
 			return
 		}
 	}
@@ -603,14 +960,23 @@ func (h *Handler) PutRule(w http.ResponseWriter, r *http.Request) {
 
 	ruleIdx, _ := strconv.Atoi(r.Header.Get("ruleIdx"))
 	rule := groupWrapper.Group.Rules[ruleIdx]
+	exclude := rule.Exclude
+	if req.Exclude != nil {
+		exclude = *req.Exclude
+	}
+	if err := app.ValidateRules([]*models.Rule{{Type: req.Type, Exclude: exclude}}); err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	rule.Name = req.Name
 	rule.Type = req.Type
 	rule.Rule = req.Rule
 	rule.Enable = req.Enable
+	rule.Exclude = exclude
 
 	if enabled {
-		if err := groupWrapper.Sync(); err != nil {
-			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync group: %v", err))
+		if err := h.app.SyncGroups(); err != nil {
+			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync groups: %v", err))
 			return
 		}
 	}
@@ -643,8 +1009,8 @@ func (h *Handler) DeleteRule(w http.ResponseWriter, r *http.Request) {
 	ruleIdx, _ := strconv.Atoi(r.Header.Get("ruleIdx"))
 	groupWrapper.Group.Rules = append(groupWrapper.Group.Rules[:ruleIdx], groupWrapper.Group.Rules[ruleIdx+1:]...)
 	if enabled {
-		if err := groupWrapper.Sync(); err != nil {
-			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync group: %v", err))
+		if err := h.app.SyncGroups(); err != nil {
+			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sync groups: %v", err))
 			return
 		}
 	}
@@ -25,6 +25,7 @@ func NewRouter(h *Handler) chi.Router {
 			r.Get("/", h.GetGroups)
 			r.Put("/", h.PutGroups)
 			r.Post("/", h.CreateGroup)
+			r.Get("/conflicts", h.GetConflicts)
 			r.Route("/{groupID}", func(r chi.Router) {
 				r.Use(func(next http.Handler) http.Handler {
 					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +48,15 @@ func NewRouter(h *Handler) chi.Router {
 				r.Get("/", h.GetGroup)
 				r.Put("/", h.PutGroup)
 				r.Delete("/", h.DeleteGroup)
+				r.Get("/failover", h.GetFailover)
+				r.Get("/links", h.GetLinks)
+				r.Get("/stats", h.GetStats)
+				r.Route("/ips", func(r chi.Router) {
+					r.Get("/", h.GetIPs)
+					r.Post("/", h.AddIP)
+					r.Delete("/", h.DeleteIPs)
+					r.Post("/sync", h.SyncIPs)
+				})
 				r.Route("/rules", func(r chi.Router) {
 					r.Get("/", h.GetRules)
 					r.Put("/", h.PutRules)
@@ -78,8 +88,17 @@ func NewRouter(h *Handler) chi.Router {
 				})
 			})
 		})
+		r.Route("/records", func(r chi.Router) {
+			r.Get("/", h.GetRecords)
+			r.Delete("/", h.FlushRecords)
+			r.Delete("/{name}", h.DeleteRecord)
+		})
+		r.Route("/diagnostics", func(r chi.Router) {
+			r.Get("/explain", h.Explain)
+		})
 		r.Route("/system", func(r chi.Router) {
 			r.Get("/interfaces", h.ListInterfaces)
+			r.Get("/reconciler", h.GetReconciler)
 			r.Route("/config", func(r chi.Router) {
 				r.Post("/save", h.SaveConfig)
 			})
@@ -14,6 +14,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	dnsMitmProxy "magitrickle/dns-mitm-proxy"
+	"magitrickle/geodata"
 	"magitrickle/models"
 	netfilterHelper "magitrickle/netfilter-helper"
 	"magitrickle/records"
@@ -33,6 +34,9 @@ var defaultAppConfig = models.App{
 		DisableRemap53:  false,
 		DisableFakePTR:  false,
 		DisableDropAAAA: false,
+		Hijack: models.DNSHijack{
+			DoHServers: defaultDoHServers,
+		},
 	},
 	HTTPWeb: models.HTTPWeb{
 		Enabled: true,
@@ -43,6 +47,7 @@ var defaultAppConfig = models.App{
 		Skin: "default",
 	},
 	Netfilter: models.Netfilter{
+		Backend: netfilterHelper.BackendIPTables,
 		IPTables: models.IPTables{
 			ChainPrefix: "MT_",
 		},
@@ -50,6 +55,11 @@ var defaultAppConfig = models.App{
 			TablePrefix:   "mt_",
 			AdditionalTTL: 3600,
 		},
+		Routing: models.Routing{
+			MarkMask:   0x00ff0000,
+			TableStart: 1000,
+			TableEnd:   1999,
+		},
 		DisableIPv4: false,
 		DisableIPv6: false,
 	},
@@ -70,6 +80,7 @@ type App struct {
 	dnsMITM  *dnsMitmProxy.DNSMITMProxy
 	nfHelper *netfilterHelper.NetfilterHelper
 	records  *records.Records
+	geoData  *geodata.Store
 	groups   []*Group
 	// Log ring buffer for API log streaming/polling
 	logBuffer *RingBuffer
@@ -79,12 +90,20 @@ type App struct {
 	// TODO: доделать
 	enabled      atomic.Bool
 	dnsOverrider *netfilterHelper.PortRemap
+	dnsHijack    dnsHijack
+	reconciler   reconciler
+	// conntrackQueue – адреса, соединения которых ждут сброса, см. flushQueuedConntrack
+	conntrackQueue conntrackQueue
+
+	// priorityOrder – группы в порядке применения, см. sortGroups
+	priorityOrder atomic.Pointer[[]*Group]
 }
 
 // New создаёт новый экземпляр App
 func New() *App {
 	a := &App{
 		config:    defaultAppConfig,
+		geoData:   geodata.New(geoDataFolderLocation),
 		logBuffer: NewRingBuffer(500), // store last 500 logs (adjust as needed)
 	}
 
@@ -206,6 +225,7 @@ func (a *App) ClearGroups() {
 		_ = g.Disable()
 	}
 	a.groups = a.groups[:0]
+	a.sortGroups()
 }
 
 // AddGroup добавляет новую группу
@@ -224,21 +244,27 @@ func (a *App) AddGroup(groupModel *models.Group) error {
 		dup[rule.ID] = struct{}{}
 	}
 
+	if err := a.assignMarkAndTable(groupModel); err != nil {
+		return err
+	}
+
 	grp, err := NewGroup(groupModel, a)
 	if err != nil {
 		return fmt.Errorf("failed to create group: %w", err)
 	}
 	a.groups = append(a.groups, grp)
+	a.sortGroups()
 
 	log.Debug().Str("id", grp.ID.String()).Str("name", grp.Name).Msg("added group")
 
 	// если приложение уже запущено – включаем группу и выполняем синхронизацию
+	// всех групп, так как новая группа может забрать адреса у группы с меньшим приоритетом
 	if a.enabled.Load() {
 		if err = grp.Enable(); err != nil {
 			return fmt.Errorf("failed to enable group: %w", err)
 		}
-		if err = grp.Sync(); err != nil {
-			return fmt.Errorf("failed to sync group: %w", err)
+		if err = a.SyncGroups(); err != nil {
+			return fmt.Errorf("failed to sync groups: %w", err)
 		}
 	}
 	return nil
@@ -247,6 +273,10 @@ func (a *App) AddGroup(groupModel *models.Group) error {
 // RemoveGroupByIndex удаляет группу по индексу
 func (a *App) RemoveGroupByIndex(idx int) {
 	a.groups = append(a.groups[:idx], a.groups[idx+1:]...)
+	a.sortGroups()
+	if err := a.SyncGroups(); err != nil {
+		log.Error().Err(err).Msg("failed to sync groups")
+	}
 }
 
 // ListInterfaces возвращает список сетевых интерфейсов, удовлетворяющих заданным критериям
@@ -274,3 +304,24 @@ func (a *App) ListInterfaces() ([]net.Interface, error) {
 func (a *App) DnsOverrider() *netfilterHelper.PortRemap {
 	return a.dnsOverrider
 }
+
+// NetfilterDHook восстанавливает правила после их сброса прошивкой (хук netfilter.d).
+// Правила всех групп применяются разом, а не отдельным вызовом на каждую группу.
+func (a *App) NetfilterDHook(iptType, table string) error {
+	if !a.enabled.Load() {
+		return nil
+	}
+	return a.nfHelper.BatchRules(func() error {
+		if a.dnsOverrider != nil {
+			if err := a.dnsOverrider.NetfilterDHook(iptType, table); err != nil {
+				log.Error().Err(err).Msg("error fixing iptables after netfilter.d")
+			}
+		}
+		for _, group := range a.groups {
+			if err := group.NetfilterDHook(iptType, table); err != nil {
+				log.Error().Err(err).Msg("error while fixing iptables in group")
+			}
+		}
+		return nil
+	})
+}
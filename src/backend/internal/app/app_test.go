@@ -0,0 +1,270 @@
+package app
+
+import (
+	"net"
+	"testing"
+
+	"magitrickle/api/types"
+	"magitrickle/geodata"
+	"magitrickle/models"
+	"magitrickle/models/config"
+	netfilterHelper "magitrickle/netfilter-helper"
+	"magitrickle/netfilter-helper/fake"
+	"magitrickle/records"
+
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// testApp – приложение поверх бэкенда и netlink в памяти
+type testApp struct {
+	*App
+	backend *fake.Backend
+	netlink *fake.Netlink
+}
+
+func newTestApp(t *testing.T) *testApp {
+	backend := fake.NewBackend()
+	nl := fake.NewNetlink()
+	a := &App{
+		config:   defaultAppConfig,
+		nfHelper: netfilterHelper.NewWithBackend(backend, nl, "MT_", "mt_"),
+		records:  records.New(),
+		geoData:  geodata.New(t.TempDir()),
+	}
+	return &testApp{App: a, backend: backend, netlink: nl}
+}
+
+// addGroup добавляет и включает группу с правилами-пространствами имён
+func (a *testApp) addGroup(t *testing.T, ifaceName string, rules ...string) *Group {
+	group := &models.Group{ID: types.RandomID(), Interface: ifaceName, Enable: true}
+	for _, rule := range rules {
+		group.Rules = append(group.Rules, &models.Rule{ID: types.RandomID(), Type: "namespace", Rule: rule, Enable: true})
+	}
+	g, _ := NewGroup(group, a.App)
+	a.groups = append(a.groups, g)
+	a.sortGroups()
+	if err := g.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = g.Disable() })
+	return g
+}
+
+func (a *testApp) answer(records ...dns.RR) {
+	a.handleMessage(dns.Msg{Answer: records}, nil, nil)
+}
+
+func (a *testApp) inGroup(g *Group, addr string) bool {
+	return a.backend.Contains("mt_"+g.ID.String(), net.ParseIP(addr).To4())
+}
+
+// groupTable возвращает таблицу маршрутизации, выделенную группе
+func (a *testApp) groupTable(t *testing.T, g *Group) int {
+	spec, ok := a.backend.Link("MT_" + g.ID.String())
+	if !ok {
+		t.Fatal("group has no link rules")
+	}
+	for _, rule := range a.netlink.Rules() {
+		if rule.Mark == spec.Mark {
+			return rule.Table
+		}
+	}
+	t.Fatal("group has no routing rule")
+	return 0
+}
+
+func aRecord(name, addr string, ttl uint32) *dns.A {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP(addr).To4(),
+	}
+}
+
+func cNameRecord(name, target string, ttl uint32) *dns.CNAME {
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: dns.Fqdn(target),
+	}
+}
+
+func TestApp_AnswerAddsAddressToMatchingGroup(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	a.netlink.AddLink("nwg1", true)
+	example := a.addGroup(t, "nwg0", "example.com")
+	other := a.addGroup(t, "nwg1", "example.org")
+
+	a.answer(aRecord("www.example.com", "93.184.216.34", 300))
+	a.answer(aRecord("unrelated.net", "10.1.1.1", 300))
+
+	if !a.inGroup(example, "93.184.216.34") {
+		t.Error("address should be added to the matching group")
+	}
+	if a.inGroup(other, "93.184.216.34") {
+		t.Error("address should not be added to other groups")
+	}
+	if a.inGroup(example, "10.1.1.1") || a.inGroup(other, "10.1.1.1") {
+		t.Error("unmatched address should not be added anywhere")
+	}
+
+	entries := a.backend.Entries("mt_" + example.ID.String())
+	if len(entries) != 1 || entries[0].Timeout == nil || *entries[0].Timeout != 300+a.config.Netfilter.IPSet.AdditionalTTL {
+		t.Errorf("unexpected set entries %+v", entries)
+	}
+}
+
+func TestApp_AnswerFollowsCNameChain(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+
+	a.answer(
+		cNameRecord("www.example.com", "edge.cdn.net", 300),
+		aRecord("edge.cdn.net", "203.0.113.7", 60),
+	)
+
+	if !a.inGroup(group, "203.0.113.7") {
+		t.Error("address of the CNAME target should be added to the group of the alias")
+	}
+}
+
+func TestApp_SyncRestoresAndPrunesAddresses(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+	set := "mt_" + group.ID.String()
+
+	a.answer(aRecord("example.com", "198.51.100.1", 300))
+	stale := uint32(100)
+	if err := a.backend.AddSetEntry(set, netfilterHelper.SetEntry{Net: net.IPNet{IP: net.ParseIP("198.51.100.99").To4(), Mask: net.CIDRMask(32, 32)}, Timeout: &stale}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.backend.DelSetEntry(set, net.IPNet{IP: net.ParseIP("198.51.100.1").To4(), Mask: net.CIDRMask(32, 32)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := group.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.inGroup(group, "198.51.100.1") {
+		t.Error("known address should be restored")
+	}
+	if a.inGroup(group, "198.51.100.99") {
+		t.Error("unknown address should be removed")
+	}
+}
+
+func TestApp_HandleLinkAddsRouteWhenInterfaceComesUp(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", false)
+	group := a.addGroup(t, "nwg0", "example.com")
+	table := a.groupTable(t, group)
+
+	if routes := a.netlink.Routes(table); len(routes) != 0 {
+		t.Fatalf("route should not be added while the interface is down: %+v", routes)
+	}
+
+	events := make(chan netlink.LinkUpdate, 1)
+	done := make(chan struct{})
+	defer close(done)
+	if err := a.netlink.LinkSubscribe(events, done); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.netlink.SetLinkUp("nwg0", true); err != nil {
+		t.Fatal(err)
+	}
+	event := <-events
+	if event.Change != unix.IFF_UP {
+		t.Fatalf("unexpected event change %x", event.Change)
+	}
+	a.handleLink(event)
+
+	routes := a.netlink.Routes(table)
+	if len(routes) != 1 || routes[0].LinkIndex != event.Link.Attrs().Index {
+		t.Fatalf("default route via the interface should be added: %+v", routes)
+	}
+}
+
+func TestApp_GroupsAreDispatchedByPriority(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	first := a.addGroup(t, "nwg0", "example.com")
+	second := a.addGroup(t, "nwg0", "example.org")
+
+	dispatcher := a.backend.Dispatcher()
+	if len(dispatcher) != 2 ||
+		dispatcher[0].Chain != "MT_"+first.ID.String() ||
+		dispatcher[1].Chain != "MT_"+second.ID.String() {
+		t.Fatalf("unexpected dispatcher order %+v", dispatcher)
+	}
+
+	if err := second.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if a.backend.HasSet("mt_" + second.ID.String()) {
+		t.Error("set should be destroyed with the group")
+	}
+	if _, ok := a.backend.Link("MT_" + second.ID.String()); ok {
+		t.Error("link rules should be removed with the group")
+	}
+	if dispatcher := a.backend.Dispatcher(); len(dispatcher) != 1 {
+		t.Errorf("disabled group should leave the dispatcher: %+v", dispatcher)
+	}
+}
+
+func TestApp_BypassGroupsAreDispatchedFirst(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	route := a.addGroup(t, "nwg0", "example.com")
+	bypass, _ := NewGroup(&models.Group{
+		ID:       types.RandomID(),
+		Kind:     models.GroupKindBypass,
+		Priority: 10,
+		Enable:   true,
+		Rules:    []*models.Rule{{ID: types.RandomID(), Type: "namespace", Rule: "bank.example.com", Enable: true}},
+	}, a.App)
+	a.groups = append(a.groups, bypass)
+	a.sortGroups()
+	if err := bypass.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = bypass.Disable() })
+
+	dispatcher := a.backend.Dispatcher()
+	if len(dispatcher) != 2 ||
+		dispatcher[0].Chain != "MT_"+bypass.ID.String() ||
+		dispatcher[1].Chain != "MT_"+route.ID.String() {
+		t.Fatalf("bypass group should be dispatched first: %+v", dispatcher)
+	}
+
+	a.answer(aRecord("bank.example.com", "198.51.100.7", 300))
+	if !a.inGroup(bypass, "198.51.100.7") || a.inGroup(route, "198.51.100.7") {
+		t.Error("bypass group should win the address regardless of priority")
+	}
+}
+
+func TestApp_InvalidImportKeepsGroups(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+
+	err := a.ImportConfig(config.Config{
+		ConfigVersion: "0.1.2",
+		Groups: &[]config.Group{
+			{ID: types.RandomID(), Interface: "nwg0"},
+			{ID: types.RandomID(), Interface: "nwg0", Ports: []string{"sctp/1"}},
+		},
+	})
+	if err == nil {
+		t.Fatal("invalid group accepted")
+	}
+	if len(a.groups) != 1 || a.groups[0] != group || !group.Enabled() {
+		t.Fatalf("rejected import should keep running groups: %+v", a.groups)
+	}
+	if _, ok := a.backend.Link("MT_" + group.ID.String()); !ok {
+		t.Error("rejected import should keep routing of running groups")
+	}
+}
@@ -0,0 +1,28 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"magitrickle/models"
+)
+
+var ErrInvalidGroupKind = errors.New("invalid group kind")
+
+// ValidateSourceGroup проверяет, что у группы по источнику задан список устройств
+func ValidateSourceGroup(kind string, clients []string) error {
+	if kind == models.GroupKindSource && len(clients) == 0 {
+		return fmt.Errorf("%w: source group requires clients", ErrInvalidGroupKind)
+	}
+	return nil
+}
+
+// ValidateGroupKind проверяет тип группы
+func ValidateGroupKind(kind string) error {
+	switch kind {
+	case models.GroupKindRoute, models.GroupKindBypass, models.GroupKindSource:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidGroupKind, kind)
+	}
+}
@@ -0,0 +1,166 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"magitrickle/models"
+	netfilterHelper "magitrickle/netfilter-helper"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrInvalidClient = errors.New("invalid client")
+
+// clientSetPrefix отмечает ссылку на именованный список устройств
+const clientSetPrefix = "@"
+
+// ValidateClients проверяет список устройств группы: адреса, подсети, MAC-адреса и ссылки @name
+func ValidateClients(clients []string) error {
+	for _, client := range clients {
+		if name, ok := strings.CutPrefix(client, clientSetPrefix); ok {
+			if name == "" {
+				return fmt.Errorf("%w: empty client set name", ErrInvalidClient)
+			}
+			continue
+		}
+		if err := validateClient(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateClientSets проверяет именованные списки устройств. Списки не могут ссылаться друг на друга.
+func ValidateClientSets(clientSets []models.ClientSet) error {
+	names := make(map[string]struct{})
+	for _, clientSet := range clientSets {
+		if clientSet.Name == "" || strings.HasPrefix(clientSet.Name, clientSetPrefix) {
+			return fmt.Errorf("%w: invalid client set name %q", ErrInvalidClient, clientSet.Name)
+		}
+		if _, exists := names[clientSet.Name]; exists {
+			return fmt.Errorf("%w: duplicate client set %s", ErrInvalidClient, clientSet.Name)
+		}
+		names[clientSet.Name] = struct{}{}
+		for _, client := range clientSet.Clients {
+			if err := validateClient(client); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateClient(client string) error {
+	if net.ParseIP(client) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(client); err == nil {
+		return nil
+	}
+	if _, err := net.ParseMAC(client); err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not an address, a subnet or a MAC address", ErrInvalidClient, client)
+}
+
+// resolveClients раскрывает список устройств в адреса и подсети и MAC-адреса.
+// Ссылки @name ищутся в именованных списках.
+func (a *App) resolveClients(clients []string) (nets []net.IPNet, macs []net.HardwareAddr) {
+	var resolve func(client string)
+	resolve = func(client string) {
+		if name, ok := strings.CutPrefix(client, clientSetPrefix); ok {
+			for _, clientSet := range a.config.ClientSets {
+				if clientSet.Name == name {
+					for _, member := range clientSet.Clients {
+						resolve(member)
+					}
+					return
+				}
+			}
+			log.Warn().Str("clientSet", name).Msg("unknown client set")
+			return
+		}
+		if ip := net.ParseIP(client); ip != nil {
+			nets = append(nets, addrNet(ip))
+			return
+		}
+		if _, ipNet, err := net.ParseCIDR(client); err == nil {
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				ipNet.IP = ip4
+			}
+			nets = append(nets, *ipNet)
+			return
+		}
+		if mac, err := net.ParseMAC(client); err == nil {
+			macs = append(macs, mac)
+		}
+	}
+	for _, client := range clients {
+		resolve(client)
+	}
+	return nets, macs
+}
+
+// addrNet возвращает подсеть из одного адреса
+func addrNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// syncClients приводит набор устройств группы и MAC-адреса её правил к текущему списку
+func (g *Group) syncClients(ipsetToLink *netfilterHelper.IPSetToLink) error {
+	if g.clientSet == nil {
+		return nil
+	}
+	nets, macs := g.app.resolveClients(g.Clients)
+	if err := syncSetNets(g.clientSet, nets); err != nil {
+		return err
+	}
+	return ipsetToLink.SetClients(g.clientSet, macs)
+}
+
+// syncSetNets приводит бессрочные записи набора к заданному списку адресов и подсетей
+func syncSetNets(set *netfilterHelper.IPSet, nets []net.IPNet) error {
+	desired := make(map[string]net.IPNet)
+	for _, ipNet := range nets {
+		desired[ipNet.String()] = ipNet
+	}
+
+	current := make(map[string]net.IPNet)
+	addrs, err := set.ListIPs()
+	if err != nil {
+		return fmt.Errorf("failed to list set entries: %w", err)
+	}
+	for addr := range addrs {
+		ipNet := addrNet(net.IP(addr))
+		current[ipNet.String()] = ipNet
+	}
+	currentNets, err := set.ListNets()
+	if err != nil {
+		return fmt.Errorf("failed to list set entries: %w", err)
+	}
+	for key, ipNet := range currentNets {
+		current[key] = ipNet
+	}
+
+	permanent := uint32(0)
+	var errs []error
+	for key, ipNet := range desired {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		errs = append(errs, set.AddNet(ipNet, &permanent))
+	}
+	for key, ipNet := range current {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		errs = append(errs, set.DelNet(ipNet))
+	}
+	return errors.Join(errs...)
+}
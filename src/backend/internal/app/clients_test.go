@@ -0,0 +1,129 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"magitrickle/api/types"
+	"magitrickle/models"
+)
+
+func TestValidateClients(t *testing.T) {
+	if err := ValidateClients([]string{"192.168.1.20", "192.168.2.0/24", "aa:bb:cc:dd:ee:ff", "@kids"}); err != nil {
+		t.Errorf("valid clients should be accepted: %v", err)
+	}
+	for _, invalid := range []string{"tablet", "@", "192.168.1.300"} {
+		if err := ValidateClients([]string{invalid}); !errors.Is(err, ErrInvalidClient) {
+			t.Errorf("%q should be rejected, got %v", invalid, err)
+		}
+	}
+	if err := ValidateClientSets([]models.ClientSet{{Name: "kids", Clients: []string{"@tv"}}}); !errors.Is(err, ErrInvalidClient) {
+		t.Errorf("nested client sets should be rejected, got %v", err)
+	}
+}
+
+func TestApp_GroupScopedByClients(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	a.config.ClientSets = []models.ClientSet{{Name: "kids", Clients: []string{mac.String()}}}
+
+	group, _ := NewGroup(&models.Group{ID: types.RandomID(), Interface: "nwg0", Enable: true, Clients: []string{"192.168.1.20", "@kids"}}, a.App)
+	a.groups = append(a.groups, group)
+	a.sortGroups()
+	if err := group.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = group.Disable() })
+
+	clientSet := "mt_" + group.ID.String() + "_c"
+	spec, ok := a.backend.Link("MT_" + group.ID.String())
+	if !ok || spec.ClientSet != clientSet {
+		t.Fatalf("link should be scoped by the client set: %+v", spec)
+	}
+	if !a.backend.Contains(clientSet, net.ParseIP("192.168.1.20").To4()) {
+		t.Error("static client address should be in the client set")
+	}
+
+	// MAC-адреса сопоставляются в правилах, а не раскрываются в адреса набора
+	if len(spec.ClientMACs) != 1 || spec.ClientMACs[0].String() != mac.String() {
+		t.Errorf("MAC client should be matched by the link rules: %+v", spec.ClientMACs)
+	}
+}
+
+func TestApp_SourceGroupExceptions(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	a.netlink.AddLink("nwg1", true)
+
+	source, _ := NewGroup(&models.Group{
+		ID:        types.RandomID(),
+		Kind:      models.GroupKindSource,
+		Interface: "nwg0",
+		Enable:    true,
+		Clients:   []string{"192.168.1.50"},
+		Rules:     []*models.Rule{{ID: types.RandomID(), Type: "namespace", Rule: "bank.example", Enable: true}},
+	}, a.App)
+	a.groups = append(a.groups, source)
+	a.sortGroups()
+	if err := source.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = source.Disable() })
+	domain := a.addGroup(t, "nwg1", "bank.example")
+
+	spec, _ := a.backend.Link("MT_" + source.ID.String())
+	if !spec.Source || spec.ClientSet == "" {
+		t.Fatalf("source group should match clients by source: %+v", spec)
+	}
+
+	a.answer(aRecord("www.bank.example", "198.51.100.10", 300))
+	if !a.inGroup(source, "198.51.100.10") {
+		t.Error("exception address should be added to the source group")
+	}
+	if !a.inGroup(domain, "198.51.100.10") {
+		t.Error("exception of the source group should not take the address from the domain group")
+	}
+
+	if err := ValidateSourceGroup(models.GroupKindSource, nil); !errors.Is(err, ErrInvalidGroupKind) {
+		t.Errorf("source group without clients should be rejected, got %v", err)
+	}
+}
+
+func TestApp_ScopedGroupKeepsBroaderGroup(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	a.netlink.AddLink("nwg1", true)
+
+	scoped, _ := NewGroup(&models.Group{
+		ID:        types.RandomID(),
+		Interface: "nwg0",
+		Enable:    true,
+		Clients:   []string{"192.168.1.20"},
+		Rules:     []*models.Rule{{ID: types.RandomID(), Type: "namespace", Rule: "example.com", Enable: true}},
+	}, a.App)
+	a.groups = append(a.groups, scoped)
+	a.sortGroups()
+	if err := scoped.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = scoped.Disable() })
+	global := a.addGroup(t, "nwg1", "example.com")
+	third := a.addGroup(t, "nwg1", "example.com")
+
+	a.answer(aRecord("www.example.com", "203.0.113.7", 300))
+	if !a.inGroup(scoped, "203.0.113.7") || !a.inGroup(global, "203.0.113.7") {
+		t.Fatal("other devices should keep routing through the broader group")
+	}
+	if a.inGroup(third, "203.0.113.7") {
+		t.Fatal("group below the unscoped one should not get the address")
+	}
+
+	if err := global.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !a.inGroup(global, "203.0.113.7") {
+		t.Fatal("sync should keep the address in the broader group")
+	}
+}
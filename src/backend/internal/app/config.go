@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"magitrickle/api/types"
 	"magitrickle/constant"
 	"magitrickle/models"
 	"magitrickle/models/config"
@@ -58,6 +59,14 @@ func (a *App) ImportConfig(cfg config.Config) error {
 		return ErrConfigUnsupportedVersion
 	}
 
+	var groups []*models.Group
+	if cfg.Groups != nil {
+		var err error
+		if groups, err = importGroups(*cfg.Groups); err != nil {
+			return err
+		}
+	}
+
 	if cfg.App != nil {
 		if cfg.App.HTTPWeb != nil {
 			if cfg.App.HTTPWeb.Enabled != nil {
@@ -115,9 +124,31 @@ func (a *App) ImportConfig(cfg config.Config) error {
 			if cfg.App.DNSProxy.DisableDropAAAA != nil {
 				a.config.DNSProxy.DisableDropAAAA = *cfg.App.DNSProxy.DisableDropAAAA
 			}
+			if cfg.App.DNSProxy.Hijack != nil {
+				hijack := a.config.DNSProxy.Hijack
+				if cfg.App.DNSProxy.Hijack.Enabled != nil {
+					hijack.Enabled = *cfg.App.DNSProxy.Hijack.Enabled
+				}
+				if cfg.App.DNSProxy.Hijack.Exempt != nil {
+					hijack.Exempt = *cfg.App.DNSProxy.Hijack.Exempt
+				}
+				if cfg.App.DNSProxy.Hijack.BlockEncryptedDNS != nil {
+					hijack.BlockEncryptedDNS = *cfg.App.DNSProxy.Hijack.BlockEncryptedDNS
+				}
+				if cfg.App.DNSProxy.Hijack.DoHServers != nil {
+					hijack.DoHServers = *cfg.App.DNSProxy.Hijack.DoHServers
+				}
+				if err := ValidateDNSHijack(hijack); err != nil {
+					return err
+				}
+				a.config.DNSProxy.Hijack = hijack
+			}
 		}
 
 		if cfg.App.Netfilter != nil {
+			if cfg.App.Netfilter.Backend != nil {
+				a.config.Netfilter.Backend = *cfg.App.Netfilter.Backend
+			}
 			if cfg.App.Netfilter.IPTables != nil {
 				if cfg.App.Netfilter.IPTables.ChainPrefix != nil {
 					a.config.Netfilter.IPTables.ChainPrefix = *cfg.App.Netfilter.IPTables.ChainPrefix
@@ -131,6 +162,22 @@ func (a *App) ImportConfig(cfg config.Config) error {
 					a.config.Netfilter.IPSet.AdditionalTTL = *cfg.App.Netfilter.IPSet.AdditionalTTL
 				}
 			}
+			if cfg.App.Netfilter.Routing != nil {
+				routing := a.config.Netfilter.Routing
+				if cfg.App.Netfilter.Routing.MarkMask != nil {
+					routing.MarkMask = *cfg.App.Netfilter.Routing.MarkMask
+				}
+				if cfg.App.Netfilter.Routing.TableStart != nil {
+					routing.TableStart = *cfg.App.Netfilter.Routing.TableStart
+				}
+				if cfg.App.Netfilter.Routing.TableEnd != nil {
+					routing.TableEnd = *cfg.App.Netfilter.Routing.TableEnd
+				}
+				if err := ValidateRouting(routing); err != nil {
+					return err
+				}
+				a.config.Netfilter.Routing = routing
+			}
 			if cfg.App.Netfilter.DisableIPv4 != nil {
 				a.config.Netfilter.DisableIPv4 = *cfg.App.Netfilter.DisableIPv4
 			}
@@ -143,6 +190,17 @@ func (a *App) ImportConfig(cfg config.Config) error {
 			a.config.Link = *cfg.App.Link
 		}
 
+		if cfg.App.ClientSets != nil {
+			clientSets := make([]models.ClientSet, len(*cfg.App.ClientSets))
+			for idx, clientSet := range *cfg.App.ClientSets {
+				clientSets[idx] = models.ClientSet{Name: clientSet.Name, Clients: clientSet.Clients}
+			}
+			if err := ValidateClientSets(clientSets); err != nil {
+				return err
+			}
+			a.config.ClientSets = clientSets
+		}
+
 		if cfg.App.ShowAllInterfaces != nil {
 			a.config.ShowAllInterfaces = *cfg.App.ShowAllInterfaces
 		}
@@ -152,50 +210,115 @@ func (a *App) ImportConfig(cfg config.Config) error {
 		}
 	}
 
-	if cfg.Groups != nil {
-		// отключаем старые группы и очищаем срез
-		for _, group := range a.groups {
-			_ = group.Disable()
+	if groups != nil {
+		// отключаем старые группы и импортируем новые только после проверки всего конфига
+		a.ClearGroups()
+		for _, group := range groups {
+			if err := a.AddGroup(group); err != nil {
+				return err
+			}
 		}
-		a.groups = a.groups[:0]
+	}
 
-		// импортируем новые группы
-		for _, group := range *cfg.Groups {
-			rules := make([]*models.Rule, len(group.Rules))
-			for idx, rule := range group.Rules {
-				rules[idx] = &models.Rule{
-					ID:     rule.ID,
-					Name:   rule.Name,
-					Type:   rule.Type,
-					Rule:   rule.Rule,
-					Enable: rule.Enable,
-				}
+	return nil
+}
+
+// importGroups собирает и проверяет группы конфига, не трогая работающие группы,
+// чтобы ошибка в любой из них не оставила роутер без маршрутизации.
+func importGroups(cfgGroups []config.Group) ([]*models.Group, error) {
+	groups := make([]*models.Group, 0, len(cfgGroups))
+	ids := make(map[types.ID]struct{})
+	for _, group := range cfgGroups {
+		if _, exists := ids[group.ID]; exists {
+			return nil, ErrGroupIDConflict
+		}
+		ids[group.ID] = struct{}{}
+		rules := make([]*models.Rule, len(group.Rules))
+		ruleIDs := make(map[types.ID]struct{})
+		for idx, rule := range group.Rules {
+			if _, exists := ruleIDs[rule.ID]; exists {
+				return nil, ErrRuleIDConflict
 			}
-			if match, _ := colorRegExp.MatchString(group.Color); !match {
-				group.Color = "#ffffff"
-			} else {
-				group.Color = strings.ToLower(group.Color)
+			ruleIDs[rule.ID] = struct{}{}
+			rules[idx] = &models.Rule{
+				ID:      rule.ID,
+				Name:    rule.Name,
+				Type:    rule.Type,
+				Rule:    rule.Rule,
+				Enable:  rule.Enable,
+				Exclude: rule.Exclude,
 			}
-			// TODO: Make required after 1.0.0
-			enable := true
-			if group.Enable != nil {
-				enable = *group.Enable
+		}
+		if match, _ := colorRegExp.MatchString(group.Color); !match {
+			group.Color = "#ffffff"
+		} else {
+			group.Color = strings.ToLower(group.Color)
+		}
+		// TODO: Make required after 1.0.0
+		enable := true
+		if group.Enable != nil {
+			enable = *group.Enable
+		}
+		var probe models.Probe
+		if group.Probe != nil {
+			probe = models.Probe{
+				Type:     group.Probe.Type,
+				Target:   group.Probe.Target,
+				Interval: group.Probe.Interval,
+				Timeout:  group.Probe.Timeout,
+				Fails:    group.Probe.Fails,
 			}
-			err := a.AddGroup(&models.Group{
-				ID:        group.ID,
-				Name:      group.Name,
-				Color:     group.Color,
-				Interface: group.Interface,
-				Enable:    enable,
-				Rules:     rules,
-			})
-			if err != nil {
-				return err
+			if err := ValidateProbe(probe); err != nil {
+				return nil, err
 			}
 		}
+		var multipath []models.Nexthop
+		for _, nexthop := range group.Multipath {
+			multipath = append(multipath, models.Nexthop{Interface: nexthop.Interface, Weight: nexthop.Weight})
+		}
+		if err := ValidateMultipath(multipath); err != nil {
+			return nil, err
+		}
+		if err := ValidateGateway(group.Gateway); err != nil {
+			return nil, err
+		}
+		if err := ValidateGroupKind(group.Kind); err != nil {
+			return nil, err
+		}
+		if err := ValidateClients(group.Clients); err != nil {
+			return nil, err
+		}
+		if err := ValidateSourceGroup(group.Kind, group.Clients); err != nil {
+			return nil, err
+		}
+		if err := ValidatePorts(group.Ports); err != nil {
+			return nil, err
+		}
+		if err := ValidateRules(rules); err != nil {
+			return nil, err
+		}
+		groups = append(groups, &models.Group{
+			ID:         group.ID,
+			Name:       group.Name,
+			Color:      group.Color,
+			Kind:       group.Kind,
+			Interface:  group.Interface,
+			Gateway:    group.Gateway,
+			Failover:   group.Failover,
+			Probe:      probe,
+			Multipath:  multipath,
+			KillSwitch: group.KillSwitch,
+			RouteLocal: group.RouteLocal,
+			Clients:    group.Clients,
+			Ports:      group.Ports,
+			Enable:     enable,
+			Priority:   group.Priority,
+			Mark:       group.Mark,
+			Table:      group.Table,
+			Rules:      rules,
+		})
 	}
-
-	return nil
+	return groups, nil
 }
 
 // Helper function to convert from models.DNSProxyServer to config.DNSProxyServer
@@ -217,23 +340,51 @@ func exportDNSProxyHosts(hosts []models.DNSProxyServer) *[]config.DNSProxyServer
 }
 
 func (a *App) ExportConfig() config.Config {
+	clientSets := make([]config.ClientSet, len(a.config.ClientSets))
+	for idx, clientSet := range a.config.ClientSets {
+		clientSets[idx] = config.ClientSet{Name: clientSet.Name, Clients: clientSet.Clients}
+	}
+
 	groups := make([]config.Group, len(a.groups))
 	for idx, group := range a.groups {
 		groupCfg := config.Group{
-			ID:        group.ID,
-			Name:      group.Name,
-			Color:     group.Color,
-			Interface: group.Interface,
-			Enable:    &group.Group.Enable,
-			Rules:     make([]config.Rule, len(group.Rules)),
+			ID:         group.ID,
+			Name:       group.Name,
+			Color:      group.Color,
+			Kind:       group.Kind,
+			Interface:  group.Interface,
+			Gateway:    group.Gateway,
+			Failover:   group.Failover,
+			KillSwitch: group.KillSwitch,
+			RouteLocal: group.RouteLocal,
+			Clients:    group.Clients,
+			Ports:      group.Ports,
+			Enable:     &group.Group.Enable,
+			Priority:   group.Priority,
+			Mark:       group.Mark,
+			Table:      group.Table,
+			Rules:      make([]config.Rule, len(group.Rules)),
+		}
+		for _, nexthop := range group.Multipath {
+			groupCfg.Multipath = append(groupCfg.Multipath, config.Nexthop{Interface: nexthop.Interface, Weight: nexthop.Weight})
+		}
+		if group.Probe != (models.Probe{}) {
+			groupCfg.Probe = &config.Probe{
+				Type:     group.Probe.Type,
+				Target:   group.Probe.Target,
+				Interval: group.Probe.Interval,
+				Timeout:  group.Probe.Timeout,
+				Fails:    group.Probe.Fails,
+			}
 		}
 		for idx, rule := range group.Rules {
 			groupCfg.Rules[idx] = config.Rule{
-				ID:     rule.ID,
-				Name:   rule.Name,
-				Type:   rule.Type,
-				Rule:   rule.Rule,
-				Enable: rule.Enable,
+				ID:      rule.ID,
+				Name:    rule.Name,
+				Type:    rule.Type,
+				Rule:    rule.Rule,
+				Enable:  rule.Enable,
+				Exclude: rule.Exclude,
 			}
 		}
 		groups[idx] = groupCfg
@@ -263,8 +414,15 @@ func (a *App) ExportConfig() config.Config {
 				DisableRemap53:  &a.config.DNSProxy.DisableRemap53,
 				DisableFakePTR:  &a.config.DNSProxy.DisableFakePTR,
 				DisableDropAAAA: &a.config.DNSProxy.DisableDropAAAA,
+				Hijack: &config.DNSHijack{
+					Enabled:           &a.config.DNSProxy.Hijack.Enabled,
+					Exempt:            &a.config.DNSProxy.Hijack.Exempt,
+					BlockEncryptedDNS: &a.config.DNSProxy.Hijack.BlockEncryptedDNS,
+					DoHServers:        &a.config.DNSProxy.Hijack.DoHServers,
+				},
 			},
 			Netfilter: &config.Netfilter{
+				Backend: &a.config.Netfilter.Backend,
 				IPTables: &config.IPTables{
 					ChainPrefix: &a.config.Netfilter.IPTables.ChainPrefix,
 				},
@@ -272,10 +430,16 @@ func (a *App) ExportConfig() config.Config {
 					TablePrefix:   &a.config.Netfilter.IPSet.TablePrefix,
 					AdditionalTTL: &a.config.Netfilter.IPSet.AdditionalTTL,
 				},
+				Routing: &config.Routing{
+					MarkMask:   &a.config.Netfilter.Routing.MarkMask,
+					TableStart: &a.config.Netfilter.Routing.TableStart,
+					TableEnd:   &a.config.Netfilter.Routing.TableEnd,
+				},
 				DisableIPv4: &a.config.Netfilter.DisableIPv4,
 				DisableIPv6: &a.config.Netfilter.DisableIPv6,
 			},
 			Link:              &a.config.Link,
+			ClientSets:        &clientSets,
 			ShowAllInterfaces: &a.config.ShowAllInterfaces,
 			LogLevel:          &a.config.LogLevel,
 		},
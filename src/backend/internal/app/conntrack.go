@@ -0,0 +1,151 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// routedAddrs запоминает, до какого момента адрес уже находится в ipset группы.
+// Conntrack сбрасывается только при первом добавлении адреса, продление TTL
+// повторным DNS-ответом соединения не трогает. Нулевой момент – адрес без срока.
+type routedAddrs map[string]time.Time
+
+// routedDeadline возвращает момент, когда адрес с таким TTL выйдет из ipset.
+// TTL 0 в ipset означает запись без срока.
+func routedDeadline(ttl uint32, now time.Time) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(ttl) * time.Second)
+}
+
+// firstInsertion отмечает адрес добавленным и сообщает, что раньше его в ipset не было
+func (r routedAddrs) firstInsertion(address net.IP, ttl uint32, now time.Time) bool {
+	key := string(addrNet(address).IP)
+	deadline, exists := r[key]
+	r[key] = routedDeadline(ttl, now)
+	return !exists || routedExpired(deadline, now)
+}
+
+func routedExpired(deadline, now time.Time) bool {
+	return !deadline.IsZero() && now.After(deadline)
+}
+
+// expire забывает адреса, срок которых в ipset уже вышел
+func (r routedAddrs) expire(now time.Time) {
+	for key, deadline := range r {
+		if routedExpired(deadline, now) {
+			delete(r, key)
+		}
+	}
+}
+
+// conntrackQueue копит адреса, соединения которых нужно сбросить после ответов DNS.
+// Сброс выполняется в основном цикле одним проходом по conntrack, ответ DNS его не ждёт.
+type conntrackQueue struct {
+	locker  sync.Mutex
+	pending []net.IPNet
+	ready   chan struct{}
+}
+
+// signal возвращает канал, в который приходит сигнал о новых адресах в очереди
+func (q *conntrackQueue) signal() <-chan struct{} {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	if q.ready == nil {
+		q.ready = make(chan struct{}, 1)
+	}
+	return q.ready
+}
+
+// add ставит адреса в очередь на сброс
+func (q *conntrackQueue) add(nets []net.IPNet) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	if q.ready == nil {
+		q.ready = make(chan struct{}, 1)
+	}
+	q.pending = append(q.pending, nets...)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take забирает накопленные адреса
+func (q *conntrackQueue) take() []net.IPNet {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	nets := q.pending
+	q.pending = nil
+	return nets
+}
+
+// flushQueuedConntrack сбрасывает соединения всех адресов из очереди за один проход
+func (a *App) flushQueuedConntrack() {
+	nets := a.conntrackQueue.take()
+	if len(nets) == 0 {
+		return
+	}
+	deleted, err := a.nfHelper.FlushConntrack(nets)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to flush conntrack entries")
+		return
+	}
+	if deleted != 0 {
+		log.Debug().Int("addresses", len(nets)).Uint("entries", deleted).Msg("flushed conntrack entries")
+	}
+}
+
+// flushConntrack удаляет записи conntrack для адресов и подсетей, чтобы уже открытые
+// соединения сразу пошли новым маршрутом, а не ждали закрытия
+func (g *Group) flushConntrack(nets []net.IPNet) {
+	if len(nets) == 0 {
+		return
+	}
+	deleted, err := g.app.nfHelper.FlushConntrack(nets)
+	if err != nil {
+		log.Warn().Str("group", g.ID.String()).Err(err).Msg("failed to flush conntrack entries")
+		return
+	}
+	if deleted != 0 {
+		log.Debug().Str("group", g.ID.String()).Uint("entries", deleted).Msg("flushed conntrack entries")
+	}
+}
+
+// routedNets возвращает все адреса и подсети из ipset группы
+func (g *Group) routedNets() ([]net.IPNet, error) {
+	if g.ipset == nil {
+		return nil, nil
+	}
+	addrs, err := g.ipset.ListIPs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses: %w", err)
+	}
+	nets, err := g.ipset.ListNets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subnets: %w", err)
+	}
+	routed := make([]net.IPNet, 0, len(addrs)+len(nets))
+	for addr := range addrs {
+		routed = append(routed, addrNet(net.IP(addr)))
+	}
+	for _, ipNet := range nets {
+		routed = append(routed, ipNet)
+	}
+	return routed, nil
+}
+
+// flushRouted сбрасывает conntrack для всего содержимого ipset группы
+func (g *Group) flushRouted() {
+	nets, err := g.routedNets()
+	if err != nil {
+		log.Warn().Str("group", g.ID.String()).Err(err).Msg("failed to flush conntrack entries")
+		return
+	}
+	g.flushConntrack(nets)
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestApp_ConntrackFlushedOnRoutingChanges(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+	client := net.ParseIP("192.168.1.20").To4()
+	a.netlink.AddConntrack(client, net.ParseIP("93.184.216.34").To4())
+	a.netlink.AddConntrack(client, net.ParseIP("10.1.1.1").To4())
+
+	a.answer(aRecord("example.com", "93.184.216.34", 300))
+	if flows := a.netlink.Conntrack(); len(flows) != 2 {
+		t.Fatalf("DNS answers should not wait for the flush, left %v", flows)
+	}
+	a.flushQueuedConntrack()
+	if flows := a.netlink.Conntrack(); len(flows) != 1 || !flows[0].Equal(net.ParseIP("10.1.1.1")) {
+		t.Fatalf("connections to the new address should be flushed, left %v", flows)
+	}
+
+	a.netlink.AddConntrack(client, net.ParseIP("93.184.216.34").To4())
+	a.answer(aRecord("example.com", "93.184.216.34", 300))
+	a.flushQueuedConntrack()
+	if flows := a.netlink.Conntrack(); len(flows) != 2 {
+		t.Fatalf("refreshing a known address should keep connections, left %v", flows)
+	}
+
+	if err := group.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if flows := a.netlink.Conntrack(); len(flows) != 1 || !flows[0].Equal(net.ParseIP("10.1.1.1")) {
+		t.Fatalf("connections of a disabled group should be flushed, left %v", flows)
+	}
+}
+
+func TestRoutedAddrs(t *testing.T) {
+	now := time.Now()
+	routed := make(routedAddrs)
+	permanent := net.ParseIP("198.51.100.1")
+	temporary := net.ParseIP("198.51.100.2")
+	if !routed.firstInsertion(permanent, 0, now) || !routed.firstInsertion(temporary, 60, now) {
+		t.Fatal("new addresses should be reported as first insertions")
+	}
+
+	later := now.Add(time.Hour)
+	if routed.firstInsertion(permanent, 0, later) {
+		t.Error("address without a timeout should never expire")
+	}
+	routed.expire(later)
+	if _, ok := routed[string(temporary.To4())]; ok {
+		t.Error("expired address should be forgotten")
+	}
+	if _, ok := routed[string(permanent.To4())]; !ok {
+		t.Error("address without a timeout should be kept")
+	}
+}
@@ -186,8 +186,14 @@ func (a *App) dnsResponseHook(clientAddr net.Addr, reqMsg dns.Msg, respMsg dns.M
 
 // handleMessage processes the received DNS message
 func (a *App) handleMessage(msg dns.Msg, clientAddr net.Addr, network *string) {
-	for _, rr := range msg.Answer {
-		a.handleRecord(rr, clientAddr, network)
+	// Адреса из одного ответа добавляются в наборы разом, до отправки ответа клиенту
+	err := a.nfHelper.BatchSetEntries(func() {
+		for _, rr := range msg.Answer {
+			a.handleRecord(rr, clientAddr, network)
+		}
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to add addresses")
 	}
 }
 
@@ -222,31 +228,21 @@ func (a *App) processARecord(aRecord dns.A, clientAddr net.Addr, network *string
 	a.records.AddARecord(aRecord.Hdr.Name[:len(aRecord.Hdr.Name)-1], aRecord.A, ttlDuration)
 
 	names := a.records.GetAliases(aRecord.Hdr.Name[:len(aRecord.Hdr.Name)-1])
-	for _, group := range a.groups {
-	Rule:
-		for _, domain := range group.Rules {
-			if !domain.IsEnabled() {
-				continue
-			}
-			for _, name := range names {
-				if !domain.IsMatch(name) {
-					continue
-				}
-				// TODO: Check already existed
-				if err := group.AddIP(aRecord.A, ttlDuration); err != nil {
-					log.Error().
-						Str("address", aRecord.A.String()).
-						Err(err).
-						Msg("failed to add address")
-				} else {
-					log.Debug().
-						Str("address", aRecord.A.String()).
-						Str("aRecordDomain", aRecord.Hdr.Name).
-						Str("cNameDomain", name).
-						Msg("add address")
-				}
-				break Rule
-			}
+	groups, name := a.addressGroups(names)
+	for _, group := range groups {
+		// TODO: Check already existed
+		if err := group.AddIP(aRecord.A, ttlDuration); err != nil {
+			log.Error().
+				Str("address", aRecord.A.String()).
+				Err(err).
+				Msg("failed to add address")
+		} else {
+			log.Debug().
+				Str("address", aRecord.A.String()).
+				Str("aRecordDomain", aRecord.Hdr.Name).
+				Str("cNameDomain", name).
+				Str("group", group.ID.String()).
+				Msg("add address")
 		}
 	}
 }
@@ -275,31 +271,23 @@ func (a *App) processCNameRecord(cNameRecord dns.CNAME, clientAddr net.Addr, net
 
 	now := time.Now()
 	aRecords := a.records.GetARecords(cNameRecord.Hdr.Name[:len(cNameRecord.Hdr.Name)-1])
-	names := a.records.GetAliases(cNameRecord.Hdr.Name[:len(cNameRecord.Hdr.Name)-1])
-	for _, group := range a.groups {
-	Rule:
-		for _, domain := range group.Rules {
-			if !domain.IsEnabled() {
-				continue
-			}
-			for _, name := range names {
-				if !domain.IsMatch(name) {
-					continue
-				}
-				for _, aRecord := range aRecords {
-					if err := group.AddIP(aRecord.Address, uint32(now.Sub(aRecord.Deadline).Seconds())); err != nil {
-						log.Error().
-							Str("address", aRecord.Address.String()).
-							Err(err).
-							Msg("failed to add address")
-					} else {
-						log.Debug().
-							Str("address", aRecord.Address.String()).
-							Str("cNameDomain", name).
-							Msg("add address")
-					}
-				}
-				continue Rule
+	// Имена берутся от конца цепочки, чтобы исключения проверялись по всей цепочке,
+	// как и при обработке A-записи
+	names := a.records.GetAliases(a.records.GetCanonicalName(cNameRecord.Hdr.Name[:len(cNameRecord.Hdr.Name)-1]))
+	groups, name := a.addressGroups(names)
+	for _, group := range groups {
+		for _, aRecord := range aRecords {
+			if err := group.AddIP(aRecord.Address, aRecord.TTL(now)); err != nil {
+				log.Error().
+					Str("address", aRecord.Address.String()).
+					Err(err).
+					Msg("failed to add address")
+			} else {
+				log.Debug().
+					Str("address", aRecord.Address.String()).
+					Str("cNameDomain", name).
+					Str("group", group.ID.String()).
+					Msg("add address")
 			}
 		}
 	}
@@ -0,0 +1,30 @@
+package app
+
+import (
+	"net"
+	"testing"
+)
+
+func TestApp_DNSRemapFollowsLinkAddresses(t *testing.T) {
+	a := newTestApp(t)
+	a.config.Link = []string{"br0", "br1"}
+	a.netlink.AddLink("br0", true, &net.IPNet{IP: net.ParseIP("192.168.1.1").To4(), Mask: net.CIDRMask(24, 32)})
+
+	addrs, err := a.getInterfaceAddresses()
+	if err != nil {
+		t.Fatal("missing links should be skipped:", err)
+	}
+	a.dnsOverrider = a.nfHelper.PortRemap("DNSOR", 53, 3553, addrs)
+	if err := a.dnsOverrider.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	a.netlink.AddAddr("br0", &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)})
+	a.netlink.AddLink("br1", true, &net.IPNet{IP: net.ParseIP("192.168.2.1").To4(), Mask: net.CIDRMask(24, 32)})
+	a.updateDNSRemap()
+
+	spec, _ := a.backend.Remap("MT_DNSOR")
+	if len(spec.Addresses) != 3 || !spec.Addresses[1].Equal(net.ParseIP("2001:db8::1")) || !spec.Addresses[2].Equal(net.ParseIP("192.168.2.1")) {
+		t.Fatalf("remap should include new addresses and links: %v", spec.Addresses)
+	}
+}
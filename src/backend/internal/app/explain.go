@@ -0,0 +1,231 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"magitrickle/api/types"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vishvananda/netlink"
+)
+
+var ErrInvalidExplain = errors.New("invalid explain request")
+
+// RuleMatch – правило группы, под которое подходит имя из цепочки CNAME
+type RuleMatch struct {
+	Group types.ID
+	Rule  types.ID
+	// Name – имя цепочки, совпавшее с правилом
+	Name    string
+	Exclude bool
+}
+
+// AddressState – адрес из кеша DNS и группы, в ipset которых он сейчас лежит
+type AddressState struct {
+	Address  net.IP
+	Deadline time.Time
+	Groups   []types.ID
+}
+
+// NameExplanation объясняет, какие группы маршрутизируют домен и почему
+type NameExplanation struct {
+	Name string
+	// Canonical – конец цепочки CNAME, у него хранятся A-записи
+	Canonical string
+	// Aliases – все имена цепочки, по ним проверяются правила
+	Aliases []string
+	Matches []RuleMatch
+	// Groups – группы, которым достаются адреса домена, с учётом приоритетов и исключений
+	Groups    []types.ID
+	Addresses []AddressState
+}
+
+// RouteLookup – маршрут, который ядро выбрало для адреса с меткой
+type RouteLookup struct {
+	Mark      uint32
+	Table     int
+	Interface string
+	Gateway   net.IP
+	Error     string
+}
+
+// GroupRoute – группа, в ipset которой лежит адрес, и маршрут по её метке
+type GroupRoute struct {
+	Group types.ID
+	RouteLookup
+}
+
+// IPExplanation объясняет, куда ядро отправит пакеты к адресу
+type IPExplanation struct {
+	Address net.IP
+	// Domains – имена из кеша DNS, которые разрешаются в адрес
+	Domains []string
+	Groups  []GroupRoute
+	// Default – маршрут пакетов без метки, в обход групп
+	Default RouteLookup
+}
+
+// ExplainName проверяет домен правилами всех групп и показывает его адреса из кеша DNS
+func (a *App) ExplainName(name string) (NameExplanation, error) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" {
+		return NameExplanation{}, fmt.Errorf("%w: empty name", ErrInvalidExplain)
+	}
+
+	canonical := a.records.GetCanonicalName(name)
+	aliases := a.records.GetAliases(canonical)
+	slices.Sort(aliases)
+	explanation := NameExplanation{Name: name, Canonical: canonical, Aliases: aliases}
+
+	groups := a.groupsByPriority()
+	for _, group := range groups {
+		for _, rule := range group.Rules {
+			if !rule.IsEnabled() {
+				continue
+			}
+			for _, alias := range aliases {
+				if a.ruleMatch(rule, alias) {
+					explanation.Matches = append(explanation.Matches, RuleMatch{
+						Group:   group.ID,
+						Rule:    rule.ID,
+						Name:    alias,
+						Exclude: rule.IsExclude(),
+					})
+				}
+			}
+		}
+	}
+	addressGroups, _ := a.addressGroups(aliases)
+	for _, group := range addressGroups {
+		explanation.Groups = append(explanation.Groups, group.ID)
+	}
+
+	contents := listGroupContents(groups)
+	for _, aRecord := range a.records.GetARecords(canonical) {
+		state := AddressState{Address: aRecord.Address, Deadline: aRecord.Deadline}
+		for _, group := range groups {
+			if contents[group].contains(aRecord.Address) {
+				state.Groups = append(state.Groups, group.ID)
+			}
+		}
+		explanation.Addresses = append(explanation.Addresses, state)
+	}
+	return explanation, nil
+}
+
+// ExplainIP показывает группы, в ipset которых лежит адрес, и маршрут, который ядро
+// выберет по метке каждой из них (как `ip route get <адрес> mark <метка>`)
+func (a *App) ExplainIP(address string) (IPExplanation, error) {
+	ip := net.ParseIP(strings.TrimSpace(address))
+	if ip == nil {
+		return IPExplanation{}, fmt.Errorf("%w: %s is not an address", ErrInvalidExplain, address)
+	}
+	ip = addrNet(ip).IP
+
+	explanation := IPExplanation{Address: ip, Domains: a.addressNames(ip)}
+	groups := a.groupsByPriority()
+	contents := listGroupContents(groups)
+	for _, group := range groups {
+		if !contents[group].contains(ip) {
+			continue
+		}
+		explanation.Groups = append(explanation.Groups, GroupRoute{Group: group.ID, RouteLookup: a.routeLookup(ip, group.Mark)})
+	}
+	explanation.Default = a.routeLookup(ip, 0)
+	return explanation, nil
+}
+
+// routeLookup спрашивает у ядра маршрут до адреса для пакета с меткой
+func (a *App) routeLookup(ip net.IP, mark uint32) RouteLookup {
+	lookup := RouteLookup{Mark: mark}
+	routes, err := a.nfHelper.Netlink().RouteGetWithOptions(ip, &netlink.RouteGetOptions{Mark: mark})
+	if err != nil {
+		lookup.Error = err.Error()
+		return lookup
+	}
+	if len(routes) == 0 {
+		lookup.Error = "no route"
+		return lookup
+	}
+	route := routes[0]
+	lookup.Table = route.Table
+	lookup.Gateway = route.Gw
+	if route.LinkIndex != 0 {
+		if link, err := a.nfHelper.Netlink().LinkByIndex(route.LinkIndex); err == nil {
+			lookup.Interface = link.Attrs().Name
+		} else {
+			lookup.Interface = fmt.Sprintf("#%d", route.LinkIndex)
+		}
+	}
+	return lookup
+}
+
+// addressNames возвращает имена из кеша DNS, которые разрешаются в адрес
+func (a *App) addressNames(ip net.IP) []string {
+	var names []string
+	for _, domainName := range a.records.ListARecordDomains() {
+		for _, aRecord := range a.records.GetARecords(domainName) {
+			if aRecord.Address.Equal(ip) {
+				names = append(names, a.records.GetAliases(domainName)...)
+				break
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// groupContents – содержимое ipset группы, прочитанное один раз на запрос объяснения
+type groupContents struct {
+	addresses map[string]*uint32
+	nets      map[string]net.IPNet
+}
+
+// listGroupContents читает ipset каждой включённой группы
+func listGroupContents(groups []*Group) map[*Group]groupContents {
+	contents := make(map[*Group]groupContents, len(groups))
+	for _, group := range groups {
+		if groupContent, ok := group.listContents(); ok {
+			contents[group] = groupContent
+		}
+	}
+	return contents
+}
+
+func (g *Group) listContents() (groupContents, bool) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if !g.Enabled() || !g.Group.Enable {
+		return groupContents{}, false
+	}
+	addresses, err := g.listIPs()
+	if err != nil {
+		log.Error().Str("group", g.ID.String()).Err(err).Msg("failed to list addresses")
+		return groupContents{}, false
+	}
+	nets, err := g.ipset.ListNets()
+	if err != nil {
+		log.Error().Str("group", g.ID.String()).Err(err).Msg("failed to list networks")
+		return groupContents{}, false
+	}
+	return groupContents{addresses: addresses, nets: nets}, true
+}
+
+// contains сообщает, что адрес лежит в ipset группы отдельно или в составе подсети
+func (c groupContents) contains(ip net.IP) bool {
+	if _, ok := c.addresses[string(addrNet(ip).IP)]; ok {
+		return true
+	}
+	for _, ipNet := range c.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"magitrickle/api/types"
+	"magitrickle/models"
+)
+
+func TestApp_ExplainName(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	a.netlink.AddLink("nwg1", true)
+	first := a.addGroup(t, "nwg0", "example.com")
+	second := a.addGroup(t, "nwg1", "cdn.net")
+	// Исключение во второй группе не мешает первой
+	second.Rules = append(second.Rules, &models.Rule{ID: types.RandomID(), Type: "namespace", Rule: "example.com", Enable: true, Exclude: true})
+
+	// Регистр имён в ответе не важен, как и в запросе
+	a.answer(
+		cNameRecord("Www.Example.COM", "edge.cdn.net", 300),
+		aRecord("EDGE.cdn.net", "203.0.113.7", 60),
+	)
+
+	explanation, err := a.ExplainName("WWW.Example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Canonical != "edge.cdn.net" || !slices.Equal(explanation.Aliases, []string{"edge.cdn.net", "www.example.com"}) {
+		t.Fatalf("unexpected chain: %+v", explanation)
+	}
+	if len(explanation.Matches) != 3 || explanation.Matches[0].Group != first.ID || !explanation.Matches[2].Exclude {
+		t.Fatalf("every matching rule should be reported: %+v", explanation.Matches)
+	}
+	if !slices.Equal(explanation.Groups, []types.ID{first.ID}) {
+		t.Fatalf("only the first group should get the addresses: %+v", explanation.Groups)
+	}
+	if len(explanation.Addresses) != 1 || !slices.Equal(explanation.Addresses[0].Groups, []types.ID{first.ID}) {
+		t.Fatalf("address should be found in the ipset of the first group: %+v", explanation.Addresses)
+	}
+
+	if _, err := a.ExplainName(" "); !errors.Is(err, ErrInvalidExplain) {
+		t.Fatalf("empty name should be rejected: %v", err)
+	}
+}
+
+func TestApp_ExplainIP(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true, &net.IPNet{IP: net.ParseIP("10.8.0.2").To4(), Mask: net.CIDRMask(24, 32)})
+	group := a.addGroup(t, "nwg0", "example.com")
+	a.answer(aRecord("www.example.com", "93.184.216.34", 300))
+
+	explanation, err := a.ExplainIP("93.184.216.34")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(explanation.Domains, []string{"www.example.com"}) {
+		t.Fatalf("address should be mapped to its domain: %+v", explanation.Domains)
+	}
+	if len(explanation.Groups) != 1 || explanation.Groups[0].Group != group.ID {
+		t.Fatalf("group should be found by its ipset: %+v", explanation.Groups)
+	}
+	lookup := explanation.Groups[0].RouteLookup
+	if lookup.Mark != group.Mark || lookup.Table != a.groupTable(t, group) || lookup.Interface != "nwg0" {
+		t.Fatalf("marked packets should use the group table: %+v", lookup)
+	}
+	if explanation.Default.Error == "" {
+		t.Fatalf("unmarked packets have no route in the fake main table: %+v", explanation.Default)
+	}
+
+	if _, err := a.ExplainIP("example.com"); !errors.Is(err, ErrInvalidExplain) {
+		t.Fatalf("invalid address should be rejected: %v", err)
+	}
+}
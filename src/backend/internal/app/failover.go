@@ -0,0 +1,277 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"magitrickle/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+const failoverHistorySize = 20
+
+// InterfaceHealth – результат последних проверок интерфейса
+type InterfaceHealth struct {
+	Name      string
+	Healthy   bool
+	LastCheck time.Time
+	Latency   time.Duration
+	Error     string
+
+	fails uint32
+}
+
+// FailoverSwitch – запись о переключении группы на другой интерфейс
+type FailoverSwitch struct {
+	Time   time.Time
+	From   string
+	To     string
+	Reason string
+}
+
+// FailoverStatus – текущее состояние резервирования группы
+type FailoverStatus struct {
+	Active     string
+	Interfaces []InterfaceHealth
+	Switches   []FailoverSwitch
+}
+
+type failover struct {
+	locker sync.Mutex
+
+	group    *Group
+	probe    models.Probe
+	active   string
+	health   []*InterfaceHealth
+	switches []FailoverSwitch
+
+	cancel  context.CancelFunc
+	trigger chan struct{}
+	probeFn func(ctx context.Context, ifaceName string, probe models.Probe) error
+}
+
+// needsFailover сообщает, нужно ли группе следить за доступностью интерфейсов.
+// При балансировке недоступные пути убираются из маршрута и без переключения.
+func (g *Group) needsFailover() bool {
+	if len(g.Multipath) != 0 {
+		return false
+	}
+	return len(g.Interfaces()) > 1 || g.Probe.Type != ""
+}
+
+// startFailover запускает проверку интерфейсов группы. История переключений
+// сохраняется между перезапусками группы.
+func (g *Group) startFailover() {
+	if !g.needsFailover() {
+		return
+	}
+
+	f := g.newFailover(g.switches)
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	g.failover = f
+	go f.run(ctx)
+}
+
+func (g *Group) stopFailover() {
+	if g.failover == nil {
+		return
+	}
+	if g.failover.cancel != nil {
+		g.failover.cancel()
+	}
+	g.switches = g.failover.status().Switches
+	g.failover = nil
+}
+
+func (g *Group) newFailover(switches []FailoverSwitch) *failover {
+	f := &failover{
+		group:    g,
+		probe:    probeSettings(g.Probe),
+		active:   g.Interface,
+		switches: switches,
+		trigger:  make(chan struct{}, 1),
+		probeFn:  probeInterface,
+	}
+	for _, iface := range g.Interfaces() {
+		f.health = append(f.health, &InterfaceHealth{Name: iface, Healthy: true})
+	}
+	return f
+}
+
+// triggerProbe запускает внеочередную проверку, например при изменении состояния интерфейса
+func (g *Group) triggerProbe() {
+	g.locker.Lock()
+	f := g.failover
+	g.locker.Unlock()
+	if f == nil {
+		return
+	}
+	select {
+	case f.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (f *failover) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(f.probe.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		f.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-f.trigger:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check проверяет все интерфейсы и переключает группу на первый доступный по порядку
+func (f *failover) check(ctx context.Context) {
+	errs := make([]error, len(f.health))
+	latencies := make([]time.Duration, len(f.health))
+	var wg sync.WaitGroup
+	for idx, health := range f.health {
+		wg.Add(1)
+		go func(idx int, ifaceName string) {
+			defer wg.Done()
+			start := time.Now()
+			errs[idx] = f.probeFn(ctx, ifaceName, f.probe)
+			latencies[idx] = time.Since(start)
+		}(idx, health.Name)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	f.locker.Lock()
+	now := time.Now()
+	var best *InterfaceHealth
+	var activeHealth *InterfaceHealth
+	for idx, health := range f.health {
+		health.LastCheck = now
+		health.Latency = latencies[idx]
+		if errs[idx] == nil {
+			health.fails = 0
+			health.Healthy = true
+			health.Error = ""
+		} else {
+			health.fails++
+			health.Error = errs[idx].Error()
+			if health.fails >= f.probe.Fails {
+				health.Healthy = false
+			}
+			log.Debug().
+				Str("group", f.group.ID.String()).
+				Str("interface", health.Name).
+				Err(errs[idx]).
+				Msg("interface probe failed")
+		}
+		if best == nil && health.Healthy {
+			best = health
+		}
+		if health.Name == f.active {
+			activeHealth = health
+		}
+	}
+	from := f.active
+	f.locker.Unlock()
+
+	if best == nil {
+		log.Warn().Str("group", f.group.ID.String()).Msg("no healthy interfaces, keeping current one")
+		return
+	}
+	if best.Name == from {
+		return
+	}
+
+	reason := fmt.Sprintf("%s is preferred and healthy", best.Name)
+	if activeHealth != nil && !activeHealth.Healthy {
+		reason = fmt.Sprintf("%s is unhealthy: %s", from, activeHealth.Error)
+	}
+	switched, err := f.group.switchInterface(ctx, f, best.Name)
+	if err != nil {
+		log.Error().
+			Str("group", f.group.ID.String()).
+			Str("from", from).
+			Str("to", best.Name).
+			Err(err).
+			Msg("failed to switch interface")
+		return
+	}
+	if !switched {
+		return
+	}
+
+	f.locker.Lock()
+	f.active = best.Name
+	f.switches = append(f.switches, FailoverSwitch{Time: now, From: from, To: best.Name, Reason: reason})
+	if len(f.switches) > failoverHistorySize {
+		f.switches = f.switches[len(f.switches)-failoverHistorySize:]
+	}
+	f.locker.Unlock()
+
+	log.Info().
+		Str("group", f.group.ID.String()).
+		Str("from", from).
+		Str("to", best.Name).
+		Str("reason", reason).
+		Msg("group switched interface")
+}
+
+// switchInterface переводит маршрут группы на другой интерфейс, если проверка всё ещё актуальна.
+// Возвращает false, если группа уже остановлена и переключения не было.
+func (g *Group) switchInterface(ctx context.Context, f *failover, ifaceName string) (bool, error) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if ctx.Err() != nil || g.failover != f || g.ipsetToLink == nil {
+		return false, nil
+	}
+	if err := g.ipsetToLink.SetInterface(ifaceName); err != nil {
+		return false, err
+	}
+	// Открытые соединения привязаны NAT к старому интерфейсу
+	g.flushRouted()
+	return true, nil
+}
+
+func (f *failover) status() FailoverStatus {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	status := FailoverStatus{
+		Active:     f.active,
+		Interfaces: make([]InterfaceHealth, len(f.health)),
+		Switches:   make([]FailoverSwitch, len(f.switches)),
+	}
+	for idx, health := range f.health {
+		status.Interfaces[idx] = *health
+	}
+	copy(status.Switches, f.switches)
+	return status
+}
+
+// FailoverStatus возвращает активный интерфейс, результаты проверок и историю переключений
+func (g *Group) FailoverStatus() FailoverStatus {
+	g.locker.Lock()
+	f := g.failover
+	switches := make([]FailoverSwitch, len(g.switches))
+	copy(switches, g.switches)
+	g.locker.Unlock()
+	if f != nil {
+		return f.status()
+	}
+
+	status := FailoverStatus{Active: g.Interface, Switches: switches}
+	for _, iface := range g.Interfaces() {
+		status.Interfaces = append(status.Interfaces, InterfaceHealth{Name: iface, Healthy: iface == g.Interface})
+	}
+	return status
+}
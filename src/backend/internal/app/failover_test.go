@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"magitrickle/api/types"
+	"magitrickle/models"
+)
+
+func TestProbeSettings(t *testing.T) {
+	probe := probeSettings(models.Probe{Type: "dns", Target: "9.9.9.9"})
+	if probe.Target != "9.9.9.9:53" || probe.Interval != defaultProbeInterval || probe.Fails != defaultProbeFails {
+		t.Fatalf("unexpected probe settings: %+v", probe)
+	}
+	if probe = probeSettings(models.Probe{}); probe.Type != "link" {
+		t.Fatalf("link probe should be the default, got %q", probe.Type)
+	}
+	if err := ValidateProbe(models.Probe{Type: "http"}); err == nil {
+		t.Fatal("unknown probe type accepted")
+	}
+}
+
+func TestFailover_SwitchesToHealthyInterface(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	backup := a.netlink.AddLink("nwg1", true)
+	group, _ := NewGroup(&models.Group{
+		ID:        types.RandomID(),
+		Interface: "nwg0",
+		Failover:  []string{"nwg1"},
+		Probe:     models.Probe{Fails: 2},
+		Enable:    true,
+	}, a.App)
+	a.groups = append(a.groups, group)
+	a.sortGroups()
+	if err := group.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = group.Disable() })
+
+	// Заменяем запущенную проверку на управляемую тестом
+	group.locker.Lock()
+	group.stopFailover()
+	f := group.newFailover(nil)
+	f.probeFn = func(_ context.Context, ifaceName string, _ models.Probe) error {
+		if ifaceName == "nwg0" {
+			return errors.New("probe failed")
+		}
+		return nil
+	}
+	group.failover = f
+	group.locker.Unlock()
+	ctx := context.Background()
+
+	f.check(ctx)
+	if status := group.FailoverStatus(); status.Active != "nwg0" || len(status.Switches) != 0 {
+		t.Fatalf("single failure should not switch: %+v", status)
+	}
+
+	f.check(ctx)
+	status := group.FailoverStatus()
+	if status.Active != "nwg1" || len(status.Switches) != 1 || status.Switches[0].From != "nwg0" {
+		t.Fatalf("group should switch to nwg1: %+v", status)
+	}
+	if status.Interfaces[0].Healthy || !status.Interfaces[1].Healthy {
+		t.Fatalf("unexpected health: %+v", status.Interfaces)
+	}
+	routes := a.netlink.Routes(a.groupTable(t, group))
+	if len(routes) != 1 || routes[0].LinkIndex != backup.Attrs().Index {
+		t.Fatalf("route should go through nwg1: %+v", routes)
+	}
+}
+
+func TestFailover_StoppedGroupDoesNotSwitch(t *testing.T) {
+	group, _ := NewGroup(&models.Group{
+		Interface: "nwg0",
+		Failover:  []string{"nwg1"},
+		Probe:     models.Probe{Fails: 1},
+	}, &App{})
+	f := group.newFailover(nil)
+	f.probeFn = func(_ context.Context, ifaceName string, _ models.Probe) error {
+		if ifaceName == "nwg0" {
+			return errors.New("probe failed")
+		}
+		return nil
+	}
+	group.failover = f
+
+	// Группа без правил маршрутизации не может переключиться
+	f.check(context.Background())
+	if status := group.FailoverStatus(); status.Active != "nwg0" || len(status.Switches) != 0 {
+		t.Fatalf("switch without a route should not be recorded: %+v", status)
+	}
+}
+
+func TestFailover_CancelledCheck(t *testing.T) {
+	group, _ := NewGroup(&models.Group{
+		Interface: "mt-missing0",
+		Failover:  []string{"lo"},
+		Probe:     models.Probe{Fails: 1},
+	}, &App{})
+	group.failover = group.newFailover(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	group.failover.check(ctx)
+	if status := group.FailoverStatus(); status.Active != "mt-missing0" || len(status.Switches) != 0 {
+		t.Fatalf("stopped failover should not switch: %+v", status)
+	}
+}
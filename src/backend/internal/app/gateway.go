@@ -0,0 +1,29 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var ErrInvalidGateway = errors.New("invalid gateway")
+
+// ValidateGateway проверяет адрес шлюза группы, пустая строка означает маршрут через интерфейс
+func ValidateGateway(gateway string) error {
+	if gateway == "" {
+		return nil
+	}
+	ip := net.ParseIP(gateway)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("%w: %s is not an IPv4 address", ErrInvalidGateway, gateway)
+	}
+	return nil
+}
+
+// gateway возвращает адрес шлюза группы или nil
+func (g *Group) gateway() net.IP {
+	if g.Gateway == "" {
+		return nil
+	}
+	return net.ParseIP(g.Gateway).To4()
+}
@@ -0,0 +1,19 @@
+package app
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateGateway(t *testing.T) {
+	for _, valid := range []string{"", "192.168.1.2"} {
+		if err := ValidateGateway(valid); err != nil {
+			t.Errorf("%q should be accepted: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"router.lan", "fe80::1", "192.168.1"} {
+		if err := ValidateGateway(invalid); !errors.Is(err, ErrInvalidGateway) {
+			t.Errorf("%q should be rejected, got %v", invalid, err)
+		}
+	}
+}
@@ -23,7 +23,13 @@ type Group struct {
 
 	app         *App
 	ipset       *netfilterHelper.IPSet
+	clientSet   *netfilterHelper.IPSet
 	ipsetToLink *netfilterHelper.IPSetToLink
+	failover    *failover
+	switches    []FailoverSwitch
+	routed      routedAddrs
+	manual      manualAddrs
+	stats       trafficStats
 }
 
 func (g *Group) Enabled() bool {
@@ -38,7 +44,13 @@ func NewGroup(group *models.Group, app *App) (*Group, error) {
 }
 
 func (g *Group) addIP(address net.IP, ttl uint32) error {
-	return g.ipset.AddIP(address, &ttl)
+	if err := g.ipset.AddIP(address, &ttl); err != nil {
+		return err
+	}
+	if g.routed.firstInsertion(address, ttl, time.Now()) {
+		g.app.conntrackQueue.add([]net.IPNet{addrNet(address)})
+	}
+	return nil
 }
 
 func (g *Group) AddIP(address net.IP, ttl uint32) error {
@@ -52,10 +64,13 @@ func (g *Group) AddIP(address net.IP, ttl uint32) error {
 		return nil
 	}
 
+	// Ответ DNS не укорачивает срок адреса, добавленного вручную
+	ttl = g.manual.extend(string(addrNet(address).IP), ttl, time.Now())
 	return g.addIP(address, ttl)
 }
 
 func (g *Group) delIP(address net.IP) error {
+	delete(g.routed, string(addrNet(address).IP))
 	return g.ipset.DelIP(address)
 }
 
@@ -100,29 +115,73 @@ func (g *Group) enable() error {
 		return nil
 	}
 
+	if err := g.app.assignMarkAndTable(g.Group); err != nil {
+		return fmt.Errorf("failed to assign mark and table: %w", err)
+	}
+
 	ipset := g.app.nfHelper.IPSet(g.ID.String())
-	ipsetToLink := g.app.nfHelper.IPSetToLink(g.ID.String(), g.Interface, ipset)
+	ipsetToLink := g.app.nfHelper.IPSetToLink(g.ID.String(), g.Interface, ipset, g.app.groupRank(g))
 	if err := ipsetToLink.ClearIfDisabled(); err != nil {
 		return fmt.Errorf("failed to clear iptables: %w", err)
 	}
+	if err := ipsetToLink.SetMarkAndTable(g.Mark, g.app.config.Netfilter.Routing.MarkMask, g.Table); err != nil {
+		return fmt.Errorf("failed to set mark and table: %w", err)
+	}
+	if err := ipsetToLink.SetNexthops(g.nexthops()); err != nil {
+		return fmt.Errorf("failed to set nexthops: %w", err)
+	}
+	if err := ipsetToLink.SetGateway(g.gateway()); err != nil {
+		return fmt.Errorf("failed to set gateway: %w", err)
+	}
+	if err := ipsetToLink.SetBypass(g.Kind == models.GroupKindBypass); err != nil {
+		return fmt.Errorf("failed to set bypass: %w", err)
+	}
+	if err := ipsetToLink.SetKillSwitch(g.KillSwitch); err != nil {
+		return fmt.Errorf("failed to set kill switch: %w", err)
+	}
+	if err := ipsetToLink.SetRouteLocal(g.RouteLocal); err != nil {
+		return fmt.Errorf("failed to set local routing: %w", err)
+	}
+	if err := ipsetToLink.SetSource(g.Kind == models.GroupKindSource); err != nil {
+		return fmt.Errorf("failed to set source routing: %w", err)
+	}
+	if err := ipsetToLink.SetPorts(g.ports()); err != nil {
+		return fmt.Errorf("failed to set ports: %w", err)
+	}
 
 	if err := ipset.Enable(); err != nil {
 		return fmt.Errorf("failed to initialize ipset: %w", err)
 	}
 	g.ipset = ipset
+	g.routed = make(routedAddrs)
+	g.manual = make(manualAddrs)
+
+	if len(g.Clients) != 0 {
+		clientSet := g.app.nfHelper.IPSet(g.ID.String() + "_c")
+		if err := clientSet.Enable(); err != nil {
+			return fmt.Errorf("failed to initialize client ipset: %w", err)
+		}
+		g.clientSet = clientSet
+	}
+	if err := g.syncClients(ipsetToLink); err != nil {
+		return fmt.Errorf("failed to sync clients: %w", err)
+	}
 
 	if err := ipsetToLink.Enable(); err != nil {
 		return fmt.Errorf("failed to link ipset to interface: %w", err)
 	}
 	g.ipsetToLink = ipsetToLink
 
+	g.startFailover()
+
 	return nil
 }
 
 func (g *Group) Enable() error {
 	g.locker.Lock()
 	defer g.locker.Unlock()
-	if err := g.enable(); err != nil {
+	// Правила группы, её связки и диспетчера применяются разом, а не по каждому изменению
+	if err := g.app.nfHelper.BatchRules(g.enable); err != nil {
 		_ = g.disable()
 		return err
 	}
@@ -139,6 +198,16 @@ func (g *Group) disable() error {
 		return nil
 	}
 
+	g.stopFailover()
+
+	// Соединения сбрасываются после удаления правил, иначе они сразу получили бы метку снова
+	routed, err := g.routedNets()
+	if err != nil {
+		log.Warn().Str("group", g.ID.String()).Err(err).Msg("failed to list routed addresses")
+	}
+	defer g.flushConntrack(routed)
+	g.routed = nil
+
 	var errs []error
 	errs = append(errs, func() error {
 		if g.ipsetToLink == nil {
@@ -150,6 +219,16 @@ func (g *Group) disable() error {
 		g.ipsetToLink = nil
 		return nil
 	}())
+	errs = append(errs, func() error {
+		if g.clientSet == nil {
+			return nil
+		}
+		if err := g.clientSet.Disable(); err != nil {
+			return fmt.Errorf("failed to destroy client ipset: %w", err)
+		}
+		g.clientSet = nil
+		return nil
+	}())
 	errs = append(errs, func() error {
 		if g.ipset == nil {
 			return nil
@@ -166,7 +245,7 @@ func (g *Group) disable() error {
 func (g *Group) Disable() error {
 	g.locker.Lock()
 	defer g.locker.Unlock()
-	return g.disable()
+	return g.app.nfHelper.BatchRules(g.disable)
 }
 
 func (g *Group) Sync() error {
@@ -181,36 +260,80 @@ func (g *Group) Sync() error {
 		return nil
 	}
 
+	for _, domain := range g.Rules {
+		if !domain.IsEnabled() || domain.Type != "geosite" {
+			continue
+		}
+		if _, err := g.app.geoData.Domains(domain.Rule); err != nil {
+			log.Warn().
+				Str("group", g.ID.String()).
+				Str("rule", domain.Rule).
+				Err(err).
+				Msg("failed to load geosite category")
+		}
+	}
+
+	if err := g.syncClients(g.ipsetToLink); err != nil {
+		return err
+	}
+
 	now := time.Now()
 	addresses := make(map[string]uint32)
-	knownDomains := g.app.records.ListKnownDomains()
-	for _, domain := range g.Rules {
-		if !domain.IsEnabled() {
+	for _, domainName := range g.app.records.ListARecordDomains() {
+		// Адрес достаётся только первой подходящей по приоритету группе
+		if !g.ownsNames(g.app.records.GetAliases(domainName)) {
 			continue
 		}
-		for _, domainName := range knownDomains {
-			if !domain.IsMatch(domainName) {
-				continue
-			}
-			domainAddresses := g.app.records.GetARecords(domainName)
-			for _, address := range domainAddresses {
-				ttl := uint32(now.Sub(address.Deadline).Seconds())
-				if oldTTL, ok := addresses[string(address.Address)]; !ok || ttl > oldTTL {
-					addresses[string(address.Address)] = ttl
-				}
+		domainAddresses := g.app.records.GetARecords(domainName)
+		for _, address := range domainAddresses {
+			ttl := address.TTL(now)
+			if oldTTL, ok := addresses[string(address.Address)]; !ok || ttl > oldTTL {
+				addresses[string(address.Address)] = ttl
 			}
 		}
 	}
+	// Адреса, добавленные вручную, делятся между группами по тем же приоритетам, что и адреса
+	// из DNS. Срок записи не опускается ниже заданного пользователем, нулевой – бессрочно.
+	manual := g.manual.active(now)
+	for addr, ttl := range manual {
+		if g.manualOwner(g.app.addressNames(net.IP(addr))) != g {
+			delete(manual, addr)
+			continue
+		}
+		if dnsTTL, ok := addresses[addr]; ok && ttl != 0 && dnsTTL > ttl {
+			continue
+		}
+		addresses[addr] = ttl
+	}
+	staticHosts, err := g.syncNets(g.geoIPNets())
+	if err != nil {
+		return err
+	}
 	currentAddresses, err := g.listIPs()
 	if err != nil {
 		return fmt.Errorf("failed to get old ipset list: %w", err)
 	}
+	g.routed.expire(now)
+	for addr, ttl := range currentAddresses {
+		// Адреса, уже лежащие в ipset, маршрутизируются группой, их соединения не сбрасываются
+		if _, known := g.routed[addr]; !known {
+			if ttl == nil {
+				g.routed[addr] = time.Time{}
+			} else {
+				g.routed[addr] = routedDeadline(*ttl, now)
+			}
+		}
+	}
 	for addr, ttl := range addresses {
+		if _, ok := staticHosts[addr]; ok {
+			continue
+		}
 		if currTTL, exists := currentAddresses[addr]; exists {
 			if currTTL == nil {
 				continue
 			} else {
-				if ttl < *currTTL {
+				_, isManual := manual[addr]
+				if ttl < *currTTL && (ttl != 0 || !isManual) {
 					continue
 				}
 			}
@@ -226,6 +349,9 @@ func (g *Group) Sync() error {
 		if _, ok := addresses[addr]; ok {
 			continue
 		}
+		if _, ok := staticHosts[addr]; ok {
+			continue
+		}
 		ip := net.IP(addr)
 		if err := g.delIP(ip); err != nil {
 			log.Error().Str("address", ip.String()).Err(err).Msg("failed to delete address")
@@ -236,6 +362,72 @@ func (g *Group) Sync() error {
 	return nil
 }
 
+// syncNets приводит статические подсети в ipset к заданному списку.
+// Подсети из одного адреса хранятся как обычные адреса, они возвращаются отдельно,
+// чтобы синхронизация адресов из DNS их не удаляла.
+func (g *Group) syncNets(nets []net.IPNet) (map[string]struct{}, error) {
+	permanent := uint32(0)
+	staticHosts := make(map[string]struct{})
+	staticNets := make(map[string]net.IPNet)
+	for _, ipNet := range nets {
+		if ones, bits := ipNet.Mask.Size(); ones == bits {
+			staticHosts[string(ipNet.IP)] = struct{}{}
+			continue
+		}
+		staticNets[ipNet.String()] = ipNet
+	}
+	// Вложенные подсети не нужны, а наборы nftables с интервалами не допускают пересечений
+	for key, ipNet := range staticNets {
+		for otherKey, other := range staticNets {
+			if key != otherKey && containsNet(other, ipNet) {
+				delete(staticNets, key)
+				break
+			}
+		}
+	}
+
+	currentNets, err := g.ipset.ListNets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get old ipset list: %w", err)
+	}
+	for key, ipNet := range staticNets {
+		if _, ok := currentNets[key]; ok {
+			continue
+		}
+		if err := g.ipset.AddNet(ipNet, &permanent); err != nil {
+			log.Error().Str("network", key).Err(err).Msg("failed to add network")
+		} else {
+			log.Trace().Str("network", key).Msg("added network")
+		}
+	}
+	for key, ipNet := range currentNets {
+		if _, ok := staticNets[key]; ok {
+			continue
+		}
+		if err := g.ipset.DelNet(ipNet); err != nil {
+			log.Error().Str("network", key).Err(err).Msg("failed to delete network")
+		} else {
+			log.Trace().Str("network", key).Msg("deleted network")
+		}
+	}
+	for addr := range staticHosts {
+		if err := g.addIP(net.IP(addr), permanent); err != nil {
+			log.Error().Str("address", net.IP(addr).String()).Err(err).Msg("failed to add address")
+		}
+	}
+	return staticHosts, nil
+}
+
+func (g *Group) setPriority(priority int) error {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if g.ipsetToLink == nil {
+		return nil
+	}
+	return g.ipsetToLink.SetPriority(priority)
+}
+
 func (g *Group) NetfilterDHook(iptType, table string) error {
 	g.locker.Lock()
 	defer g.locker.Unlock()
@@ -251,6 +443,18 @@ func (g *Group) NetfilterDHook(iptType, table string) error {
 	return g.ipsetToLink.NetfilterDHook(iptType, table)
 }
 
+// Reconcile восстанавливает правило маршрутизации и маршруты группы, удалённые извне
+func (g *Group) Reconcile() ([]string, error) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if !g.Enabled() || !g.Group.Enable || g.ipsetToLink == nil {
+		return nil, nil
+	}
+
+	return g.ipsetToLink.Reconcile()
+}
+
 func (g *Group) LinkUpdateHook(event netlink.LinkUpdate) error {
 	g.locker.Lock()
 	defer g.locker.Unlock()
@@ -265,3 +469,25 @@ func (g *Group) LinkUpdateHook(event netlink.LinkUpdate) error {
 
 	return g.ipsetToLink.LinkUpdateHook(event)
 }
+
+func (g *Group) NeighUpdateHook(event netlink.NeighUpdate) error {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if !g.Enabled() {
+		return nil
+	}
+
+	if !g.Group.Enable {
+		return nil
+	}
+
+	return g.ipsetToLink.NeighUpdateHook(event)
+}
+
+// containsNet сообщает, входит ли подсеть inner в подсеть outer
+func containsNet(outer, inner net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"magitrickle/models"
+	netfilterHelper "magitrickle/netfilter-helper"
+)
+
+var ErrInvalidDNSHijack = errors.New("invalid DNS hijack settings")
+
+// defaultDoHServers – адреса публичных DNS-сервисов, которые принимают DoH и DoT
+var defaultDoHServers = []string{
+	"1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001",
+	"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844",
+	"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9",
+	"94.140.14.14", "94.140.15.15", "2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff",
+	"208.67.222.222", "208.67.220.220",
+	"77.88.8.8", "77.88.8.1",
+}
+
+const (
+	// dotPort – DNS over TLS и DNS over QUIC
+	dotPort uint16 = 853
+	// dohPort – DNS over HTTPS, включая HTTP/3
+	dohPort uint16 = 443
+)
+
+// dnsHijack – наборы и правила перехвата DNS, созданные при запуске
+type dnsHijack struct {
+	exempt  *netfilterHelper.IPSet
+	servers *netfilterHelper.IPSet
+	block   *netfilterHelper.PortBlock
+}
+
+// ValidateDNSHijack проверяет исключения (в формате устройств группы) и адреса DoH-серверов
+func ValidateDNSHijack(hijack models.DNSHijack) error {
+	if err := ValidateClients(hijack.Exempt); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDNSHijack, err)
+	}
+	if _, err := parseServerNets(hijack.DoHServers); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseServerNets разбирает список адресов и подсетей серверов
+func parseServerNets(servers []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(servers))
+	for _, server := range servers {
+		if ip := net.ParseIP(server); ip != nil {
+			nets = append(nets, addrNet(ip))
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(server)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is not an address or a subnet", ErrInvalidDNSHijack, server)
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			ipNet.IP = ip4
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
+}
+
+// enableDNSHijack расширяет перенаправление DNS на запросы к любым серверам с интерфейсов LAN
+// и, если нужно, запрещает шифрованный DNS, чтобы устройства вернулись к обычному
+func (a *App) enableDNSHijack(remap *netfilterHelper.PortRemap) error {
+	hijack := a.config.DNSProxy.Hijack
+	if !hijack.Enabled {
+		return nil
+	}
+
+	exempt := a.nfHelper.IPSet("dnsexempt")
+	if err := exempt.Enable(); err != nil {
+		return fmt.Errorf("failed to initialize exempt ipset: %w", err)
+	}
+	a.dnsHijack.exempt = exempt
+	exemptNets, exemptMACs := a.resolveClients(hijack.Exempt)
+	if err := syncSetNets(exempt, exemptNets); err != nil {
+		return fmt.Errorf("failed to sync exempt clients: %w", err)
+	}
+	if err := remap.SetHijack(a.config.Link, exempt, exemptMACs); err != nil {
+		return fmt.Errorf("failed to hijack DNS: %w", err)
+	}
+
+	if !hijack.BlockEncryptedDNS {
+		return nil
+	}
+	servers := a.nfHelper.IPSet("doh")
+	if err := servers.Enable(); err != nil {
+		return fmt.Errorf("failed to initialize DoH ipset: %w", err)
+	}
+	a.dnsHijack.servers = servers
+	nets, err := parseServerNets(hijack.DoHServers)
+	if err != nil {
+		return err
+	}
+	if err := syncSetNets(servers, nets); err != nil {
+		return fmt.Errorf("failed to sync DoH servers: %w", err)
+	}
+	block := a.nfHelper.PortBlock("DNSBLOCK", a.config.Link, exempt, exemptMACs, []uint16{dotPort}, servers, []uint16{dohPort})
+	if err := block.Enable(); err != nil {
+		return fmt.Errorf("failed to block encrypted DNS: %w", err)
+	}
+	a.dnsHijack.block = block
+	return nil
+}
+
+// disableDNSHijack удаляет запрет шифрованного DNS и наборы перехвата.
+// Правила перенаправления удаляются вместе с dnsOverrider.
+func (a *App) disableDNSHijack() error {
+	var errs []error
+	if a.dnsHijack.block != nil {
+		errs = append(errs, a.dnsHijack.block.Disable())
+	}
+	if a.dnsHijack.servers != nil {
+		errs = append(errs, a.dnsHijack.servers.Disable())
+	}
+	if a.dnsHijack.exempt != nil {
+		errs = append(errs, a.dnsHijack.exempt.Disable())
+	}
+	a.dnsHijack = dnsHijack{}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"magitrickle/models"
+)
+
+func TestApp_DNSHijack(t *testing.T) {
+	a := newTestApp(t)
+	a.config.Link = []string{"br0"}
+	a.config.DNSProxy.Hijack = models.DNSHijack{
+		Enabled:           true,
+		Exempt:            []string{"192.168.1.50", "aa:bb:cc:dd:ee:ff"},
+		BlockEncryptedDNS: true,
+		DoHServers:        []string{"1.1.1.1", "2606:4700:4700::1111"},
+	}
+	remap := a.nfHelper.PortRemap("DNSOR", 53, 3553, nil)
+	if err := remap.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.enableDNSHijack(remap); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, ok := a.backend.Remap("MT_DNSOR")
+	if !ok || !slices.Equal(spec.Interfaces, []string{"br0"}) || spec.ExemptSet != "mt_dnsexempt" {
+		t.Fatalf("DNS should be hijacked on LAN interfaces: %+v", spec)
+	}
+	if !a.backend.Contains("mt_dnsexempt", net.ParseIP("192.168.1.50").To4()) {
+		t.Error("exempt client should be in the exempt set")
+	}
+	if len(spec.ExemptMACs) != 1 || spec.ExemptMACs[0].String() != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("exempt MAC should be matched by the hijack rules: %+v", spec.ExemptMACs)
+	}
+	block, ok := a.backend.Block("MT_DNSBLOCK")
+	if !ok || block.Set != "mt_doh" || !slices.Equal(block.Ports, []uint16{dotPort}) || len(block.ExemptMACs) != 1 {
+		t.Fatalf("encrypted DNS should be blocked: %+v", block)
+	}
+	if !a.backend.Contains("mt_doh", net.ParseIP("2606:4700:4700::1111")) {
+		t.Error("DoH servers should be in the blocked set")
+	}
+
+	if err := remap.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.disableDNSHijack(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.backend.Block("MT_DNSBLOCK"); ok {
+		t.Error("block should be removed")
+	}
+}
+
+func TestValidateDNSHijack(t *testing.T) {
+	if err := ValidateDNSHijack(models.DNSHijack{DoHServers: defaultDoHServers}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateDNSHijack(models.DNSHijack{DoHServers: []string{"dns.google"}}); err == nil {
+		t.Error("host names should be rejected")
+	}
+	if err := ValidateDNSHijack(models.DNSHijack{Exempt: []string{"tv"}}); err == nil {
+		t.Error("invalid exemption should be rejected")
+	}
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrGroupDisabled = errors.New("group is disabled")
+	ErrAddressOwned  = errors.New("address belongs to a group with higher priority")
+)
+
+// manualAddrs – адреса, добавленные вручную, и срок их действия (нулевой – бессрочно).
+// Sync не удаляет их из ipset и возвращает после пересоздания наборов.
+type manualAddrs map[string]time.Time
+
+// active возвращает оставшееся время жизни адресов, истёкшие адреса забываются
+func (m manualAddrs) active(now time.Time) map[string]uint32 {
+	addresses := make(map[string]uint32)
+	for addr, deadline := range m {
+		if deadline.IsZero() {
+			addresses[addr] = 0
+			continue
+		}
+		if !now.Before(deadline) {
+			delete(m, addr)
+			continue
+		}
+		addresses[addr] = uint32(deadline.Sub(now).Seconds())
+	}
+	return addresses
+}
+
+// extend продлевает ttl до срока адреса, если он добавлен вручную и ещё действует
+func (m manualAddrs) extend(addr string, ttl uint32, now time.Time) uint32 {
+	deadline, ok := m[addr]
+	switch {
+	case !ok:
+		return ttl
+	case deadline.IsZero():
+		return 0
+	case now.Before(deadline):
+		return max(ttl, uint32(deadline.Sub(now).Seconds()))
+	}
+	return ttl
+}
+
+// GroupIP – запись ipset группы
+type GroupIP struct {
+	Net net.IPNet
+	// Timeout – оставшееся время жизни записи в секундах, nil – бессрочная запись
+	Timeout *uint32
+	// Manual – адрес добавлен вручную
+	Manual bool
+	// Domains – имена, DNS-ответы на которые добавили адрес
+	Domains []string
+}
+
+// IPs возвращает содержимое ipset группы вместе с доменами, из-за которых добавлены адреса
+func (g *Group) IPs() ([]GroupIP, error) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if !g.Enabled() || !g.Group.Enable {
+		return nil, ErrGroupDisabled
+	}
+
+	addresses, err := g.listIPs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses: %w", err)
+	}
+	nets, err := g.ipset.ListNets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	domains := g.addressDomains()
+	manual := g.manual.active(time.Now())
+
+	ips := make([]GroupIP, 0, len(addresses)+len(nets))
+	for addr, timeout := range addresses {
+		_, isManual := manual[addr]
+		ips = append(ips, GroupIP{
+			Net:     addrNet(net.IP(addr)),
+			Timeout: timeout,
+			Manual:  isManual,
+			Domains: domains[addr],
+		})
+	}
+	for _, ipNet := range nets {
+		ips = append(ips, GroupIP{Net: ipNet})
+	}
+	slices.SortFunc(ips, func(a, b GroupIP) int {
+		if cmp := bytes.Compare(a.Net.IP.To16(), b.Net.IP.To16()); cmp != 0 {
+			return cmp
+		}
+		return bytes.Compare(a.Net.Mask, b.Net.Mask)
+	})
+	return ips, nil
+}
+
+// addressDomains сопоставляет адресам из кеша DNS имена цепочек, которые принадлежат группе
+func (g *Group) addressDomains() map[string][]string {
+	domains := make(map[string][]string)
+	for _, domainName := range g.app.records.ListARecordDomains() {
+		aliases := g.app.records.GetAliases(domainName)
+		if !g.ownsNames(aliases) {
+			continue
+		}
+		for _, aRecord := range g.app.records.GetARecords(domainName) {
+			key := string(aRecord.Address)
+			domains[key] = append(domains[key], aliases...)
+		}
+	}
+	for key, names := range domains {
+		slices.Sort(names)
+		domains[key] = slices.Compact(names)
+	}
+	return domains
+}
+
+// AddManualIP добавляет адрес в ipset группы. Нулевой ttl – бессрочно.
+// Адрес остаётся в группе до истечения ttl, даже если его нет в кеше DNS.
+func (g *Group) AddManualIP(address net.IP, ttl uint32) error {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if !g.Enabled() || !g.Group.Enable {
+		return ErrGroupDisabled
+	}
+
+	address = addrNet(address).IP
+	if owner := g.manualOwner(g.app.addressNames(address)); owner != g {
+		return fmt.Errorf("%w: %s", ErrAddressOwned, owner.Name)
+	}
+	var deadline time.Time
+	if ttl != 0 {
+		deadline = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+	if err := g.addIP(address, ttl); err != nil {
+		return fmt.Errorf("failed to add address: %w", err)
+	}
+	g.manual[string(address)] = deadline
+	return nil
+}
+
+// RemoveIP удаляет адрес из ipset группы и сбрасывает его соединения.
+// Адрес из кеша DNS вернётся со следующим ответом сервера.
+func (g *Group) RemoveIP(address net.IP) error {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if !g.Enabled() || !g.Group.Enable {
+		return ErrGroupDisabled
+	}
+
+	address = addrNet(address).IP
+	delete(g.manual, string(address))
+	if err := g.delIP(address); err != nil {
+		return fmt.Errorf("failed to delete address: %w", err)
+	}
+	g.flushConntrack([]net.IPNet{addrNet(address)})
+	return nil
+}
+
+// FlushIPs удаляет из ipset группы адреса из DNS и добавленные вручную.
+// Подсети и адреса из правил geoip остаются.
+func (g *Group) FlushIPs() error {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	if !g.Enabled() || !g.Group.Enable {
+		return ErrGroupDisabled
+	}
+
+	g.manual = make(manualAddrs)
+	staticHosts, err := g.syncNets(g.geoIPNets())
+	if err != nil {
+		return err
+	}
+	addresses, err := g.listIPs()
+	if err != nil {
+		return fmt.Errorf("failed to list addresses: %w", err)
+	}
+	var flushed []net.IPNet
+	var errs []error
+	for addr := range addresses {
+		if _, ok := staticHosts[addr]; ok {
+			continue
+		}
+		ip := net.IP(addr)
+		if err := g.delIP(ip); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete address %s: %w", ip, err))
+			continue
+		}
+		flushed = append(flushed, addrNet(ip))
+	}
+	g.flushConntrack(flushed)
+	log.Debug().Str("group", g.ID.String()).Int("addresses", len(flushed)).Msg("flushed group addresses")
+	return errors.Join(errs...)
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestApp_GroupIPsShowDomains(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+
+	a.answer(
+		cNameRecord("www.example.com", "edge.cdn.net", 300),
+		aRecord("edge.cdn.net", "203.0.113.7", 60),
+	)
+	if err := group.AddManualIP(net.ParseIP("198.51.100.1"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := group.IPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("unexpected addresses: %+v", ips)
+	}
+	if !ips[0].Net.IP.Equal(net.ParseIP("198.51.100.1")) || !ips[0].Manual || len(ips[0].Domains) != 0 {
+		t.Errorf("manual address should be marked: %+v", ips[0])
+	}
+	if ips[1].Timeout == nil || !slices.Equal(ips[1].Domains, []string{"edge.cdn.net", "www.example.com"}) {
+		t.Errorf("address should be mapped to the whole CNAME chain: %+v", ips[1])
+	}
+}
+
+func TestApp_ManualIPSurvivesSync(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+
+	if err := group.AddManualIP(net.ParseIP("198.51.100.1"), 600); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !a.inGroup(group, "198.51.100.1") {
+		t.Fatal("sync should keep manual addresses")
+	}
+
+	if err := group.RemoveIP(net.ParseIP("198.51.100.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if a.inGroup(group, "198.51.100.1") {
+		t.Fatal("removed address should not come back")
+	}
+}
+
+func TestApp_FlushGroupIPs(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+
+	a.answer(aRecord("www.example.com", "93.184.216.34", 300))
+	if err := group.AddManualIP(net.ParseIP("198.51.100.1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	a.netlink.AddConntrack(net.ParseIP("192.168.1.20"), net.ParseIP("198.51.100.1"))
+	if err := group.FlushIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if a.inGroup(group, "198.51.100.1") || a.inGroup(group, "93.184.216.34") {
+		t.Fatal("flush should remove manual addresses and addresses from DNS")
+	}
+	if flows := a.netlink.Conntrack(); len(flows) != 0 {
+		t.Fatalf("connections of flushed addresses should be reset: %v", flows)
+	}
+
+	if err := group.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := group.IPs(); !errors.Is(err, ErrGroupDisabled) {
+		t.Fatalf("disabled group has no addresses: %v", err)
+	}
+}
+
+func TestApp_ManualIPKeepsTimeout(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+
+	if err := group.AddManualIP(net.ParseIP("203.0.113.7"), 3600); err != nil {
+		t.Fatal(err)
+	}
+	a.answer(aRecord("example.com", "203.0.113.7", 60))
+	if err := group.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	entries := a.backend.Entries("mt_" + group.ID.String())
+	if len(entries) != 1 || entries[0].Timeout == nil || *entries[0].Timeout < 3000 {
+		t.Fatalf("DNS answer should not shorten the manual timeout: %+v", entries)
+	}
+}
+
+func TestApp_ManualIPFollowsPriority(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	a.netlink.AddLink("nwg1", true)
+	high := a.addGroup(t, "nwg0", "example.com")
+	low := a.addGroup(t, "nwg1", "example.org")
+
+	if err := low.AddManualIP(net.ParseIP("203.0.113.7"), 0); err != nil {
+		t.Fatal(err)
+	}
+	a.answer(aRecord("example.com", "203.0.113.7", 300))
+	if err := low.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !a.inGroup(high, "203.0.113.7") || a.inGroup(low, "203.0.113.7") {
+		t.Fatal("address of the higher priority group should not stay in the lower one")
+	}
+	if err := low.AddManualIP(net.ParseIP("203.0.113.7"), 0); !errors.Is(err, ErrAddressOwned) {
+		t.Fatalf("adding an address owned by a higher priority group should fail, got %v", err)
+	}
+	if err := high.AddManualIP(net.ParseIP("198.51.100.1"), 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"net"
+	"slices"
+)
+
+// LinkState – состояние интерфейса группы
+type LinkState struct {
+	Name    string
+	Index   int
+	Present bool
+	Up      bool
+	// Routed – через интерфейс проложен маршрут группы
+	Routed bool
+}
+
+// LinkStates возвращает состояние всех интерфейсов группы, включая резервные
+func (g *Group) LinkStates() []LinkState {
+	g.locker.Lock()
+	var routeLinks []int
+	if g.ipsetToLink != nil {
+		routeLinks = g.ipsetToLink.RouteLinks()
+	}
+	g.locker.Unlock()
+
+	var states []LinkState
+	for _, ifaceName := range g.Links() {
+		if ifaceName == "" {
+			continue
+		}
+		state := LinkState{Name: ifaceName}
+		if g.app.nfHelper != nil {
+			if iface, err := g.app.nfHelper.Netlink().LinkByName(ifaceName); err == nil {
+				state.Index = iface.Attrs().Index
+				state.Present = true
+				state.Up = iface.Attrs().Flags&net.FlagUp != 0
+				state.Routed = slices.Contains(routeLinks, state.Index)
+			}
+		}
+		states = append(states, state)
+	}
+	return states
+}
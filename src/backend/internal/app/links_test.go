@@ -0,0 +1,63 @@
+package app
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// linkEvents подписывается на события интерфейсов fake netlink
+func (a *testApp) linkEvents(t *testing.T) chan netlink.LinkUpdate {
+	events := make(chan netlink.LinkUpdate, 4)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	if err := a.netlink.LinkSubscribe(events, done); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestApp_RouteFollowsRecreatedLink(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("wg0", true)
+	group := a.addGroup(t, "wg0", "example.com")
+	table := a.groupTable(t, group)
+	events := a.linkEvents(t)
+
+	if err := a.netlink.DelLink("wg0"); err != nil {
+		t.Fatal(err)
+	}
+	a.handleLink(<-events)
+	if states := group.LinkStates(); len(states) != 1 || states[0].Present || states[0].Routed {
+		t.Fatalf("deleted link should be reported as missing: %+v", states)
+	}
+
+	// Пересозданный туннель получает новый индекс
+	link := a.netlink.AddLink("wg0", true)
+	a.handleLink(netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: link})
+	routes := a.netlink.Routes(table)
+	if len(routes) != 1 || routes[0].LinkIndex != link.Attrs().Index {
+		t.Fatalf("route should point at the new link: %+v", routes)
+	}
+	if states := group.LinkStates(); len(states) != 1 || !states[0].Up || !states[0].Routed {
+		t.Fatalf("recreated link should be routed: %+v", states)
+	}
+}
+
+func TestApp_RouteDroppedWhenLinkRenamed(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("wg0", true, &net.IPNet{IP: net.ParseIP("10.8.0.2").To4(), Mask: net.CIDRMask(24, 32)})
+	group := a.addGroup(t, "wg0", "example.com")
+	table := a.groupTable(t, group)
+	events := a.linkEvents(t)
+
+	if err := a.netlink.RenameLink("wg0", "wg0-old"); err != nil {
+		t.Fatal(err)
+	}
+	a.handleLink(<-events)
+	if routes := a.netlink.Routes(table); len(routes) != 0 {
+		t.Fatalf("route through the renamed link should be removed: %+v", routes)
+	}
+}
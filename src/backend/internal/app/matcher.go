@@ -0,0 +1,122 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"magitrickle/constant"
+	"magitrickle/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrInvalidRule = errors.New("invalid rule")
+
+const (
+	geoDataFolderLocation = constant.AppDataDir + "/geodata"
+	geoDataCheckInterval  = time.Minute
+)
+
+// ValidateRules проверяет правила группы. Исключающими могут быть только правила по имени
+// домена: правила geoip добавляют подсети напрямую, и исключение по ним ничего бы не делало.
+func ValidateRules(rules []*models.Rule) error {
+	for _, rule := range rules {
+		if !rule.IsExclude() {
+			continue
+		}
+		switch rule.Type {
+		case "wildcard", "regex", "domain", "namespace", "geosite":
+		default:
+			return fmt.Errorf("%w: %s rules cannot be excluded", ErrInvalidRule, rule.Type)
+		}
+	}
+	return nil
+}
+
+// ruleMatch проверяет домен на соответствие правилу, подгружая категории geosite из хранилища
+func (a *App) ruleMatch(rule *models.Rule, domainName string) bool {
+	if rule.Type != "geosite" {
+		return rule.IsMatch(domainName)
+	}
+	matcher, err := a.geoData.Domains(rule.Rule)
+	if err != nil {
+		return false
+	}
+	return matcher.Match(domainName)
+}
+
+// matchNames проверяет цепочку имён (A-запись и её CNAME-алиасы) на соответствие группе.
+// Возвращает имя, совпавшее с включающим правилом. Совпадение любого имени цепочки
+// с исключающим правилом отменяет группу для всей цепочки, так как адрес у них общий.
+func (g *Group) matchNames(names []string) (string, bool) {
+	var matched string
+	for _, rule := range g.Rules {
+		if !rule.IsEnabled() {
+			continue
+		}
+		if matched != "" && !rule.IsExclude() {
+			continue
+		}
+		for _, name := range names {
+			if !g.app.ruleMatch(rule, name) {
+				continue
+			}
+			if rule.IsExclude() {
+				return "", false
+			}
+			matched = name
+			break
+		}
+	}
+	return matched, matched != ""
+}
+
+// geoIPNets собирает статические подсети из включённых правил geoip группы
+func (g *Group) geoIPNets() []net.IPNet {
+	var nets []net.IPNet
+	for _, rule := range g.Rules {
+		if !rule.IsEnabled() || rule.IsExclude() || rule.Type != "geoip" {
+			continue
+		}
+		ruleNets, err := g.app.geoData.CIDRs(rule.Rule)
+		if err != nil {
+			log.Warn().
+				Str("group", g.ID.String()).
+				Str("rule", rule.Rule).
+				Err(err).
+				Msg("failed to load geoip category")
+			continue
+		}
+		nets = append(nets, ruleNets...)
+	}
+	return nets
+}
+
+// hasGeoRules сообщает, есть ли в группе правила, зависящие от dat-файлов
+func (g *Group) hasGeoRules() bool {
+	for _, rule := range g.Rules {
+		if rule.Type == "geosite" || rule.Type == "geoip" {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadGeoData сбрасывает кэш изменившихся dat-файлов и пересинхронизирует группы, если они от них зависят
+func (a *App) reloadGeoData() {
+	if !a.geoData.Refresh() {
+		return
+	}
+	log.Info().Msg("geodata files changed, reloading")
+	for _, group := range a.groups {
+		if group.hasGeoRules() {
+			// Изменение категорий может перераспределить адреса между группами
+			if err := a.SyncGroups(); err != nil {
+				log.Error().Err(err).Msg("failed to sync groups")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"magitrickle/geodata"
+	"magitrickle/models"
+	"magitrickle/records"
+)
+
+func newMatcherTestGroup(t *testing.T, rules ...*models.Rule) (*Group, *records.Records) {
+	t.Helper()
+	a := &App{
+		records: records.New(),
+		geoData: geodata.New(t.TempDir()),
+	}
+	for _, rule := range rules {
+		rule.Enable = true
+	}
+	group, _ := NewGroup(&models.Group{Rules: rules}, a)
+	return group, a.records
+}
+
+func TestMatchNames_Exclude(t *testing.T) {
+	group, r := newMatcherTestGroup(t,
+		&models.Rule{Type: "namespace", Rule: "google.com"},
+		&models.Rule{Type: "domain", Rule: "mail.google.com", Exclude: true},
+	)
+
+	r.AddARecord("www.google.com", net.IP{1, 1, 1, 1}, 60)
+	r.AddARecord("mail.google.com", net.IP{2, 2, 2, 2}, 60)
+
+	if name, ok := group.matchNames(r.GetAliases("www.google.com")); !ok || name != "www.google.com" {
+		t.Fatalf("www.google.com should match, got %q", name)
+	}
+	if _, ok := group.matchNames(r.GetAliases("mail.google.com")); ok {
+		t.Fatal("mail.google.com should be excluded")
+	}
+}
+
+func TestMatchNames_ExcludeCNameChain(t *testing.T) {
+	group, r := newMatcherTestGroup(t,
+		&models.Rule{Type: "namespace", Rule: "google.com"},
+		&models.Rule{Type: "domain", Rule: "mail.google.com", Exclude: true},
+	)
+
+	// mail.google.com -> googlemail.l.google.com -> edge.l.google.com
+	r.AddARecord("edge.l.google.com", net.IP{3, 3, 3, 3}, 60)
+	r.AddCNameRecord("googlemail.l.google.com", "edge.l.google.com", 60)
+	r.AddCNameRecord("mail.google.com", "googlemail.l.google.com", 60)
+	// www.google.com -> www3.l.google.com
+	r.AddARecord("www3.l.google.com", net.IP{4, 4, 4, 4}, 60)
+	r.AddCNameRecord("www.google.com", "www3.l.google.com", 60)
+
+	if _, ok := group.matchNames(r.GetAliases("edge.l.google.com")); ok {
+		t.Fatal("chain with excluded alias should be vetoed")
+	}
+	if _, ok := group.matchNames(r.GetAliases(r.GetCanonicalName("googlemail.l.google.com"))); ok {
+		t.Fatal("chain with excluded alias should be vetoed from the middle as well")
+	}
+	if _, ok := group.matchNames(r.GetAliases("www3.l.google.com")); !ok {
+		t.Fatal("chain without excluded aliases should match")
+	}
+}
+
+func TestMatchNames_ExcludeOneOfAliases(t *testing.T) {
+	group, r := newMatcherTestGroup(t,
+		&models.Rule{Type: "wildcard", Rule: "*.example.com"},
+		&models.Rule{Type: "domain", Rule: "b.example.com", Exclude: true},
+	)
+
+	// a.example.com and b.example.com share the same address
+	r.AddARecord("cdn.example.net", net.IP{5, 5, 5, 5}, 60)
+	r.AddCNameRecord("a.example.com", "cdn.example.net", 60)
+	r.AddCNameRecord("b.example.com", "cdn.example.net", 60)
+	r.AddARecord("c.example.com", net.IP{6, 6, 6, 6}, 60)
+
+	if _, ok := group.matchNames(r.GetAliases("cdn.example.net")); ok {
+		t.Fatal("shared address should not be routed when one of its aliases is excluded")
+	}
+	if _, ok := group.matchNames(r.GetAliases("c.example.com")); !ok {
+		t.Fatal("c.example.com should match")
+	}
+}
+
+func TestMatchNames_ExcludeOnly(t *testing.T) {
+	group, r := newMatcherTestGroup(t,
+		&models.Rule{Type: "domain", Rule: "example.com", Exclude: true},
+	)
+	r.AddARecord("example.com", net.IP{7, 7, 7, 7}, 60)
+	r.AddARecord("example.org", net.IP{8, 8, 8, 8}, 60)
+
+	if _, ok := group.matchNames(r.GetAliases("example.com")); ok {
+		t.Fatal("exclusion alone should not match")
+	}
+	if _, ok := group.matchNames(r.GetAliases("example.org")); ok {
+		t.Fatal("group without include rules should not match")
+	}
+}
+
+func TestValidateRules_ExcludeGeoIP(t *testing.T) {
+	if err := ValidateRules([]*models.Rule{
+		{Type: "domain", Rule: "example.com", Exclude: true},
+		{Type: "geosite", Rule: "category-ads-all", Exclude: true},
+		{Type: "geoip", Rule: "ru"},
+	}); err != nil {
+		t.Fatalf("valid rules rejected: %v", err)
+	}
+	err := ValidateRules([]*models.Rule{{Type: "geoip", Rule: "ru", Exclude: true}})
+	if !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("excluded geoip rule should be rejected, got %v", err)
+	}
+}
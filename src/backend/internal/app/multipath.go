@@ -0,0 +1,47 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"magitrickle/models"
+	netfilterHelper "magitrickle/netfilter-helper"
+)
+
+const maxNexthopWeight = 256
+
+var ErrInvalidNexthop = errors.New("invalid nexthop")
+
+// ValidateMultipath проверяет интерфейсы и веса балансировки, нулевой вес заменяется на 1
+func ValidateMultipath(nexthops []models.Nexthop) error {
+	seen := make(map[string]struct{}, len(nexthops))
+	for idx := range nexthops {
+		nexthop := &nexthops[idx]
+		if nexthop.Interface == "" {
+			return fmt.Errorf("%w: empty interface", ErrInvalidNexthop)
+		}
+		if _, ok := seen[nexthop.Interface]; ok {
+			return fmt.Errorf("%w: duplicate interface %s", ErrInvalidNexthop, nexthop.Interface)
+		}
+		seen[nexthop.Interface] = struct{}{}
+		if nexthop.Weight == 0 {
+			nexthop.Weight = 1
+		}
+		if nexthop.Weight < 1 || nexthop.Weight > maxNexthopWeight {
+			return fmt.Errorf("%w: weight of %s must be between 1 and %d", ErrInvalidNexthop, nexthop.Interface, maxNexthopWeight)
+		}
+	}
+	return nil
+}
+
+// nexthops переводит настройки балансировки группы в пути маршрута
+func (g *Group) nexthops() []netfilterHelper.Nexthop {
+	if len(g.Multipath) == 0 {
+		return nil
+	}
+	nexthops := make([]netfilterHelper.Nexthop, len(g.Multipath))
+	for idx, nexthop := range g.Multipath {
+		nexthops[idx] = netfilterHelper.Nexthop{IfaceName: nexthop.Interface, Weight: nexthop.Weight}
+	}
+	return nexthops
+}
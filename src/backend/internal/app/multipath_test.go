@@ -0,0 +1,46 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"magitrickle/models"
+)
+
+func TestValidateMultipath(t *testing.T) {
+	nexthops := []models.Nexthop{{Interface: "nwg0"}, {Interface: "nwg1", Weight: 3}}
+	if err := ValidateMultipath(nexthops); err != nil {
+		t.Fatal(err)
+	}
+	if nexthops[0].Weight != 1 {
+		t.Fatalf("zero weight should default to 1, got %d", nexthops[0].Weight)
+	}
+
+	for _, invalid := range [][]models.Nexthop{
+		{{Interface: ""}},
+		{{Interface: "nwg0"}, {Interface: "nwg0"}},
+		{{Interface: "nwg0", Weight: 257}},
+		{{Interface: "nwg0", Weight: -1}},
+	} {
+		if err := ValidateMultipath(invalid); !errors.Is(err, ErrInvalidNexthop) {
+			t.Errorf("%+v should be rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestNexthops(t *testing.T) {
+	group, _ := NewGroup(&models.Group{
+		Interface: "nwg0",
+		Multipath: []models.Nexthop{{Interface: "nwg1", Weight: 2}},
+	}, &App{})
+	nexthops := group.nexthops()
+	if len(nexthops) != 1 || nexthops[0].IfaceName != "nwg1" || nexthops[0].Weight != 2 {
+		t.Fatalf("unexpected nexthops: %+v", nexthops)
+	}
+	if links := group.Links(); len(links) != 2 || links[0] != "nwg0" || links[1] != "nwg1" {
+		t.Fatalf("unexpected links: %v", links)
+	}
+	if group.needsFailover() {
+		t.Fatal("multipath group should not use failover")
+	}
+}
@@ -2,52 +2,118 @@ package app
 
 import (
 	"fmt"
+	"slices"
 
 	"github.com/rs/zerolog/log"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-func subscribeLinkUpdates() (chan netlink.LinkUpdate, chan struct{}, error) {
+func (a *App) subscribeLinkUpdates() (chan netlink.LinkUpdate, chan struct{}, error) {
 	linkUpdateChannel := make(chan netlink.LinkUpdate)
 	done := make(chan struct{})
-	if err := netlink.LinkSubscribe(linkUpdateChannel, done); err != nil {
+	if err := a.nfHelper.Netlink().LinkSubscribe(linkUpdateChannel, done); err != nil {
 		return nil, nil, fmt.Errorf("failed to subscribe to link updates: %w", err)
 	}
 	return linkUpdateChannel, done, nil
 }
 
-// handleLink обрабатывает события изменения состояния сетевых интерфейсов
+func (a *App) subscribeNeighUpdates() (chan netlink.NeighUpdate, chan struct{}, error) {
+	neighUpdateChannel := make(chan netlink.NeighUpdate)
+	done := make(chan struct{})
+	if err := a.nfHelper.Netlink().NeighSubscribe(neighUpdateChannel, done); err != nil {
+		return nil, nil, fmt.Errorf("failed to subscribe to neighbour updates: %w", err)
+	}
+	return neighUpdateChannel, done, nil
+}
+
+func (a *App) subscribeRouteUpdates() (chan netlink.RouteUpdate, chan struct{}, error) {
+	routeUpdateChannel := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+	if err := a.nfHelper.Netlink().RouteSubscribe(routeUpdateChannel, done); err != nil {
+		return nil, nil, fmt.Errorf("failed to subscribe to route updates: %w", err)
+	}
+	return routeUpdateChannel, done, nil
+}
+
+func (a *App) subscribeAddrUpdates() (chan netlink.AddrUpdate, chan struct{}, error) {
+	addrUpdateChannel := make(chan netlink.AddrUpdate)
+	done := make(chan struct{})
+	if err := a.nfHelper.Netlink().AddrSubscribe(addrUpdateChannel, done); err != nil {
+		return nil, nil, fmt.Errorf("failed to subscribe to address updates: %w", err)
+	}
+	return addrUpdateChannel, done, nil
+}
+
+// handleLink обрабатывает события сетевых интерфейсов. Событие получают все группы:
+// переименованный интерфейс приходит под новым именем, и группа узнаёт его по индексу.
 func (a *App) handleLink(event netlink.LinkUpdate) {
-	switch event.Change {
-	case 0x00000001:
+	ifaceName := event.Link.Attrs().Name
+	switch event.Header.Type {
+	case unix.RTM_NEWLINK:
 		log.Trace().
-			Str("interface", event.Link.Attrs().Name).
+			Str("interface", ifaceName).
+			Int("index", event.Link.Attrs().Index).
 			Int("change", int(event.Change)).
 			Msg("interface event")
-		ifaceName := event.Link.Attrs().Name
-		for _, group := range a.groups {
-			if group.Interface != ifaceName {
-				continue
-			}
-			if err := group.LinkUpdateHook(event); err != nil {
-				log.Error().
-					Str("group", group.ID.String()).
-					Err(err).
-					Msg("error while handling interface up")
-			}
+		if event.Change == 0xFFFFFFFF && slices.Contains(a.config.Link, ifaceName) {
+			a.updateDNSRemap()
+		}
+	case unix.RTM_DELLINK:
+		log.Debug().
+			Str("interface", ifaceName).
+			Int("index", event.Link.Attrs().Index).
+			Msg("interface del")
+	default:
+		return
+	}
+
+	for _, group := range a.groups {
+		if err := group.LinkUpdateHook(event); err != nil {
+			log.Error().
+				Str("group", group.ID.String()).
+				Str("interface", ifaceName).
+				Err(err).
+				Msg("error while handling interface event")
 		}
-	case 0xFFFFFFFF:
-		switch event.Header.Type {
-		case 16:
-			log.Debug().
-				Str("interface", event.Link.Attrs().Name).
-				Int("type", int(event.Header.Type)).
-				Msg("interface add")
-		case 17:
-			log.Debug().
-				Str("interface", event.Link.Attrs().Name).
-				Int("type", int(event.Header.Type)).
-				Msg("interface del")
+		if slices.Contains(group.Links(), ifaceName) {
+			group.triggerProbe()
 		}
 	}
 }
+
+// handleNeigh передаёт изменения таблицы соседей группам, которые ходят через этот шлюз
+func (a *App) handleNeigh(event netlink.NeighUpdate) {
+	for _, group := range a.groups {
+		gateway := group.gateway()
+		if gateway == nil || !gateway.Equal(event.IP) {
+			continue
+		}
+		log.Trace().
+			Str("gateway", event.IP.String()).
+			Int("state", event.State).
+			Msg("gateway neighbour event")
+		if err := group.NeighUpdateHook(event); err != nil {
+			log.Error().
+				Str("group", group.ID.String()).
+				Err(err).
+				Msg("error while handling gateway state")
+		}
+	}
+}
+
+// updateDNSRemap перечитывает адреса интерфейсов LAN и обновляет перенаправление DNS,
+// чтобы в него попадали новые адреса и интерфейсы, появившиеся после запуска
+func (a *App) updateDNSRemap() {
+	if a.dnsOverrider == nil {
+		return
+	}
+	addrs, err := a.getInterfaceAddresses()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get interface addresses")
+		return
+	}
+	if err := a.dnsOverrider.SetAddresses(addrs); err != nil {
+		log.Error().Err(err).Msg("failed to update DNS remap")
+	}
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	netfilterHelper "magitrickle/netfilter-helper"
+)
+
+var ErrInvalidPorts = errors.New("invalid ports")
+
+// ValidatePorts проверяет фильтры портов группы вида tcp/443 или udp/8000-8100
+func ValidatePorts(ports []string) error {
+	for _, port := range ports {
+		if _, err := parsePortRange(port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parsePortRange(port string) (netfilterHelper.PortRange, error) {
+	protocol, portRange, ok := strings.Cut(port, "/")
+	if !ok || (protocol != "tcp" && protocol != "udp") {
+		return netfilterHelper.PortRange{}, fmt.Errorf("%w: %s should look like tcp/443 or udp/8000-8100", ErrInvalidPorts, port)
+	}
+	fromStr, toStr, isRange := strings.Cut(portRange, "-")
+	if !isRange {
+		toStr = fromStr
+	}
+	from, err := strconv.ParseUint(fromStr, 10, 16)
+	if err != nil || from == 0 {
+		return netfilterHelper.PortRange{}, fmt.Errorf("%w: %s has invalid port", ErrInvalidPorts, port)
+	}
+	to, err := strconv.ParseUint(toStr, 10, 16)
+	if err != nil || to < from {
+		return netfilterHelper.PortRange{}, fmt.Errorf("%w: %s has invalid port range", ErrInvalidPorts, port)
+	}
+	return netfilterHelper.PortRange{Protocol: protocol, From: uint16(from), To: uint16(to)}, nil
+}
+
+// ports возвращает фильтры портов группы
+func (g *Group) ports() []netfilterHelper.PortRange {
+	var ports []netfilterHelper.PortRange
+	for _, port := range g.Ports {
+		portRange, err := parsePortRange(port)
+		if err != nil {
+			continue
+		}
+		ports = append(ports, portRange)
+	}
+	return ports
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"magitrickle/api/types"
+	"magitrickle/models"
+	netfilterHelper "magitrickle/netfilter-helper"
+)
+
+func TestValidatePorts(t *testing.T) {
+	if err := ValidatePorts([]string{"tcp/443", "udp/8000-8100"}); err != nil {
+		t.Errorf("valid ports should be accepted: %v", err)
+	}
+	for _, invalid := range []string{"443", "icmp/1", "tcp/0", "udp/100-10", "tcp/70000", "tcp/https"} {
+		if err := ValidatePorts([]string{invalid}); !errors.Is(err, ErrInvalidPorts) {
+			t.Errorf("%q should be rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	got, err := parsePortRange("udp/8000-8100")
+	if err != nil || got != (netfilterHelper.PortRange{Protocol: "udp", From: 8000, To: 8100}) {
+		t.Fatalf("unexpected range %+v: %v", got, err)
+	}
+}
+
+func TestApp_PortScopedGroupKeepsBroaderGroup(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	a.netlink.AddLink("nwg1", true)
+
+	web, _ := NewGroup(&models.Group{
+		ID:        types.RandomID(),
+		Interface: "nwg0",
+		Enable:    true,
+		Ports:     []string{"tcp/443"},
+		Rules:     []*models.Rule{{ID: types.RandomID(), Type: "namespace", Rule: "example.com", Enable: true}},
+	}, a.App)
+	a.groups = append(a.groups, web)
+	a.sortGroups()
+	if err := web.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = web.Disable() })
+	global := a.addGroup(t, "nwg1", "example.com")
+
+	a.answer(aRecord("www.example.com", "203.0.113.7", 300))
+	if !a.inGroup(web, "203.0.113.7") || !a.inGroup(global, "203.0.113.7") {
+		t.Fatal("traffic to other ports should keep routing through the broader group")
+	}
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+
+	"magitrickle/api/types"
+	"magitrickle/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DomainConflict – домен, подходящий под правила нескольких групп
+type DomainConflict struct {
+	Domain string
+	// Groups в порядке приоритета, первая группа получает домен
+	Groups []types.ID
+}
+
+// AddressConflict – адрес, находящийся в ipset нескольких групп
+type AddressConflict struct {
+	Address net.IP
+	Groups  []types.ID
+}
+
+// sortGroups пересчитывает порядок применения групп: группы-исключения всегда первые,
+// как и в цепочке-диспетчере, дальше меньший приоритет – раньше, при равном приоритете
+// сохраняется порядок списка. Вызывается при изменении списка групп и перед применением
+// приоритетов.
+func (a *App) sortGroups() {
+	groups := make([]*Group, len(a.groups))
+	copy(groups, a.groups)
+	sort.SliceStable(groups, func(i, j int) bool {
+		iBypass, jBypass := groups[i].Kind == models.GroupKindBypass, groups[j].Kind == models.GroupKindBypass
+		if iBypass != jBypass {
+			return iBypass
+		}
+		return groups[i].Priority < groups[j].Priority
+	})
+	a.priorityOrder.Store(&groups)
+}
+
+// groupsByPriority возвращает группы в порядке применения, посчитанном sortGroups.
+// Вызывается на каждый ответ DNS, поэтому группы здесь не сортируются.
+func (a *App) groupsByPriority() []*Group {
+	groups := a.priorityOrder.Load()
+	if groups == nil {
+		a.sortGroups()
+		groups = a.priorityOrder.Load()
+	}
+	return *groups
+}
+
+// groupRank возвращает позицию группы в порядке применения
+func (a *App) groupRank(group *Group) int {
+	for idx, g := range a.groupsByPriority() {
+		if g == group {
+			return idx
+		}
+	}
+	return len(a.groups)
+}
+
+// winnerGroup возвращает первую включённую группу, подходящую под цепочку имён.
+// Домены групп по источнику – исключения, они не забирают адреса у других групп.
+func (a *App) winnerGroup(names []string) (*Group, string) {
+	for _, group := range a.groupsByPriority() {
+		if !group.Group.Enable || group.Kind == models.GroupKindSource {
+			continue
+		}
+		if name, ok := group.matchNames(names); ok {
+			return group, name
+		}
+	}
+	return nil, ""
+}
+
+// winnerGroups возвращает группы, которым достаются адреса цепочки имён: победителя
+// (см. winnerGroup) и следующие подходящие группы, пока не встретится группа без ограничений.
+// Диспетчер пропускает дальше пакеты, не подошедшие ограниченной группе, поэтому адрес
+// нужен и более общим группам ниже по приоритету.
+func (a *App) winnerGroups(names []string) ([]*Group, string) {
+	var groups []*Group
+	var winnerName string
+	for _, group := range a.groupsByPriority() {
+		if !group.Group.Enable || group.Kind == models.GroupKindSource {
+			continue
+		}
+		name, ok := group.matchNames(names)
+		if !ok {
+			continue
+		}
+		if len(groups) == 0 {
+			winnerName = name
+		}
+		groups = append(groups, group)
+		if !group.scoped() {
+			break
+		}
+	}
+	return groups, winnerName
+}
+
+// scoped сообщает, что группа забирает не весь трафик к своим адресам, а только трафик
+// выбранных устройств или к выбранным портам
+func (g *Group) scoped() bool {
+	return len(g.Clients) != 0 || len(g.Ports) != 0
+}
+
+// addressGroups возвращает группы, которым нужен адрес домена: группы-победители
+// и все группы по источнику, для которых домен – исключение
+func (a *App) addressGroups(names []string) ([]*Group, string) {
+	groups, winnerName := a.winnerGroups(names)
+	for _, group := range a.groups {
+		if !group.Group.Enable || group.Kind != models.GroupKindSource {
+			continue
+		}
+		if name, ok := group.matchNames(names); ok {
+			groups = append(groups, group)
+			if winnerName == "" {
+				winnerName = name
+			}
+		}
+	}
+	return groups, winnerName
+}
+
+// ownsNames сообщает, что адреса цепочки имён должны быть в ipset группы
+func (g *Group) ownsNames(names []string) bool {
+	if g.Kind == models.GroupKindSource {
+		_, ok := g.matchNames(names)
+		return ok
+	}
+	winners, _ := g.app.winnerGroups(names)
+	return slices.Contains(winners, g)
+}
+
+// manualOwner возвращает группу, которой достаётся адрес, добавленный в g вручную.
+// Адрес делится по тем же приоритетам, что и адреса из DNS: если по цепочке имён,
+// разрешающихся в него, он нужен группе без ограничений выше по приоритету
+// (см. winnerGroups), он достаётся ей.
+func (g *Group) manualOwner(names []string) *Group {
+	if g.Kind == models.GroupKindSource {
+		return g
+	}
+	winners, _ := g.app.winnerGroups(names)
+	for _, winner := range winners {
+		if g.app.groupRank(winner) >= g.app.groupRank(g) {
+			break
+		}
+		if !winner.scoped() {
+			return winner
+		}
+	}
+	return g
+}
+
+// applyPriorities переносит порядок групп в цепочку-диспетчер netfilter
+func (a *App) applyPriorities() error {
+	a.sortGroups()
+	var errs []error
+	for idx, group := range a.groupsByPriority() {
+		if err := group.setPriority(idx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set priority of group %s: %w", group.ID.String(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SyncGroups применяет приоритеты и синхронизирует все группы,
+// так как изменение одной группы может перераспределить адреса между остальными
+func (a *App) SyncGroups() error {
+	if !a.enabled.Load() {
+		return nil
+	}
+	var errs []error
+	if err := a.applyPriorities(); err != nil {
+		errs = append(errs, err)
+	}
+	err := a.nfHelper.BatchSetEntries(func() {
+		for _, group := range a.groups {
+			if err := group.Sync(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to sync group %s: %w", group.ID.String(), err))
+			}
+		}
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Conflicts возвращает домены, подходящие под несколько групп, и адреса,
+// оказавшиеся сразу в нескольких ipset
+func (a *App) Conflicts() ([]DomainConflict, []AddressConflict) {
+	groups := a.groupsByPriority()
+
+	var domainConflicts []DomainConflict
+	domains := a.records.ListKnownDomains()
+	sort.Strings(domains)
+	for _, domain := range domains {
+		var matched []types.ID
+		for _, group := range groups {
+			if !group.Group.Enable {
+				continue
+			}
+			if _, ok := group.matchNames([]string{domain}); ok {
+				matched = append(matched, group.ID)
+			}
+		}
+		if len(matched) > 1 {
+			domainConflicts = append(domainConflicts, DomainConflict{Domain: domain, Groups: matched})
+		}
+	}
+
+	var addressOrder []string
+	addressGroups := make(map[string][]types.ID)
+	for _, group := range groups {
+		addresses, err := group.ListIPs()
+		if err != nil {
+			log.Error().Str("group", group.ID.String()).Err(err).Msg("failed to list addresses")
+			continue
+		}
+		for addr := range addresses {
+			if _, ok := addressGroups[addr]; !ok {
+				addressOrder = append(addressOrder, addr)
+			}
+			addressGroups[addr] = append(addressGroups[addr], group.ID)
+		}
+	}
+	sort.Strings(addressOrder)
+
+	var addressConflicts []AddressConflict
+	for _, addr := range addressOrder {
+		if len(addressGroups[addr]) < 2 {
+			continue
+		}
+		addressConflicts = append(addressConflicts, AddressConflict{
+			Address: net.IP(addr),
+			Groups:  addressGroups[addr],
+		})
+	}
+
+	return domainConflicts, addressConflicts
+}
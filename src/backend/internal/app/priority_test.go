@@ -0,0 +1,45 @@
+package app
+
+import (
+	"testing"
+
+	"magitrickle/geodata"
+	"magitrickle/models"
+	"magitrickle/records"
+)
+
+func TestWinnerGroup_Priority(t *testing.T) {
+	a := &App{
+		records: records.New(),
+		geoData: geodata.New(t.TempDir()),
+	}
+	newGroup := func(priority int, rule string) *Group {
+		group, _ := NewGroup(&models.Group{
+			Enable:   true,
+			Priority: priority,
+			Rules:    []*models.Rule{{Type: "namespace", Rule: rule, Enable: true}},
+		}, a)
+		a.groups = append(a.groups, group)
+		a.sortGroups()
+		return group
+	}
+	broad := newGroup(10, "example.com")
+	first := newGroup(0, "cdn.example.com")
+	second := newGroup(0, "example.com")
+
+	if winner, _ := a.winnerGroup([]string{"cdn.example.com"}); winner != first {
+		t.Fatal("group with the lowest priority should win")
+	}
+	if winner, _ := a.winnerGroup([]string{"www.example.com"}); winner != second {
+		t.Fatal("equal priority should keep the list order")
+	}
+
+	second.Group.Enable = false
+	if winner, _ := a.winnerGroup([]string{"www.example.com"}); winner != broad {
+		t.Fatal("disabled group should not win")
+	}
+
+	if rank := a.groupRank(broad); rank != 2 {
+		t.Fatalf("unexpected rank of the broad group: %d", rank)
+	}
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"magitrickle/models"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultProbeInterval = 10
+	defaultProbeTimeout  = 2
+	defaultProbeFails    = 3
+
+	defaultPingTarget = "1.1.1.1"
+	defaultTCPTarget  = "1.1.1.1:443"
+	defaultDNSTarget  = "1.1.1.1:53"
+)
+
+var ErrInvalidProbeType = errors.New("invalid probe type")
+
+// ValidateProbe проверяет тип проверки доступности
+func ValidateProbe(probe models.Probe) error {
+	switch probe.Type {
+	case "", "link", "ping", "tcp", "dns":
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidProbeType, probe.Type)
+	}
+}
+
+// probeSettings подставляет значения по умолчанию в незаданные поля
+func probeSettings(probe models.Probe) models.Probe {
+	if probe.Type == "" {
+		probe.Type = "link"
+	}
+	if probe.Interval == 0 {
+		probe.Interval = defaultProbeInterval
+	}
+	if probe.Timeout == 0 {
+		probe.Timeout = defaultProbeTimeout
+	}
+	if probe.Fails == 0 {
+		probe.Fails = defaultProbeFails
+	}
+	switch probe.Type {
+	case "ping":
+		if probe.Target == "" {
+			probe.Target = defaultPingTarget
+		}
+	case "tcp":
+		probe.Target = withDefaultPort(probe.Target, defaultTCPTarget, "443")
+	case "dns":
+		probe.Target = withDefaultPort(probe.Target, defaultDNSTarget, "53")
+	}
+	return probe
+}
+
+func withDefaultPort(target, defaultTarget, defaultPort string) string {
+	if target == "" {
+		return defaultTarget
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return net.JoinHostPort(target, defaultPort)
+	}
+	return target
+}
+
+// bindToDevice привязывает сокет к интерфейсу, чтобы проверка шла именно через него,
+// а не по маршруту из основной таблицы
+func bindToDevice(ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifaceName)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// probeInterface проверяет доступность сети через интерфейс
+func probeInterface(ctx context.Context, ifaceName string, probe models.Probe) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to get interface: %w", err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return errors.New("interface is down")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(probe.Timeout)*time.Second)
+	defer cancel()
+
+	switch probe.Type {
+	case "ping":
+		return probePing(ctx, ifaceName, probe.Target)
+	case "tcp":
+		return probeTCP(ctx, ifaceName, probe.Target)
+	case "dns":
+		return probeDNS(ctx, ifaceName, probe.Target)
+	}
+	return nil
+}
+
+func probePing(ctx context.Context, ifaceName, target string) error {
+	dst, err := net.ResolveIPAddr("ip4", target)
+	if err != nil {
+		return fmt.Errorf("failed to resolve target: %w", err)
+	}
+
+	lc := net.ListenConfig{Control: bindToDevice(ifaceName)}
+	conn, err := lc.ListenPacket(ctx, "ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return fmt.Errorf("failed to open icmp socket: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	id := os.Getpid() & 0xffff
+	seq := int(time.Now().UnixNano() & 0xffff)
+	req, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("magitrickle")},
+	}).Marshal(nil)
+	if err != nil {
+		return fmt.Errorf("failed to build echo request: %w", err)
+	}
+	if _, err = conn.WriteTo(req, dst); err != nil {
+		return fmt.Errorf("failed to send echo request: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("failed to receive echo reply: %w", err)
+		}
+		// Raw-сокет получает все ICMP-пакеты, отбираем ответ на свой запрос
+		if peerAddr, ok := peer.(*net.IPAddr); !ok || !peerAddr.IP.Equal(dst.IP) {
+			continue
+		}
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := msg.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+			return nil
+		}
+	}
+}
+
+func probeTCP(ctx context.Context, ifaceName, target string) error {
+	dialer := net.Dialer{Control: bindToDevice(ifaceName)}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	return conn.Close()
+}
+
+func probeDNS(ctx context.Context, ifaceName, target string) error {
+	client := dns.Client{Dialer: &net.Dialer{Control: bindToDevice(ifaceName)}}
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	resp, _, err := client.ExchangeContext(ctx, msg, target)
+	if err != nil {
+		return fmt.Errorf("failed to query dns: %w", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dns server answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
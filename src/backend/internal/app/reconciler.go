@@ -0,0 +1,85 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	reconcileInterval = time.Minute
+	// reconcileDelay собирает пачку событий netlink в одну проверку
+	reconcileDelay = 2 * time.Second
+)
+
+// ReconcilerStats – счётчики проверок правил и маршрутов
+type ReconcilerStats struct {
+	Runs       uint64
+	Repairs    uint64
+	LastRun    time.Time
+	LastRepair time.Time
+}
+
+type reconciler struct {
+	locker sync.Mutex
+	stats  ReconcilerStats
+}
+
+// ReconcilerStats возвращает счётчики проверок правил и маршрутов
+func (a *App) ReconcilerStats() ReconcilerStats {
+	a.reconciler.locker.Lock()
+	defer a.reconciler.locker.Unlock()
+	return a.reconciler.stats
+}
+
+// reconcile сверяет правила netfilter, правила маршрутизации и маршруты включённых групп
+// с ожидаемыми и восстанавливает то, что было изменено или удалено извне
+func (a *App) reconcile() {
+	var repairs uint64
+
+	repaired, err := a.nfHelper.Reconcile()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to reconcile netfilter rules")
+	}
+	if repaired {
+		repairs++
+		log.Warn().Msg("netfilter rules were changed externally, restored")
+	}
+
+	for _, group := range a.groups {
+		groupRepairs, err := group.Reconcile()
+		if err != nil {
+			log.Error().
+				Str("group", group.ID.String()).
+				Err(err).
+				Msg("failed to reconcile group")
+		}
+		for _, object := range groupRepairs {
+			repairs++
+			log.Warn().
+				Str("group", group.ID.String()).
+				Str("object", object).
+				Msg("group routing was changed externally, restored")
+		}
+		// Пересозданные наборы nftables пусты, адреса нужно вернуть
+		if repaired {
+			if err := group.Sync(); err != nil {
+				log.Error().
+					Str("group", group.ID.String()).
+					Err(err).
+					Msg("failed to sync group after reconcile")
+			}
+		}
+	}
+
+	a.reconciler.locker.Lock()
+	defer a.reconciler.locker.Unlock()
+	now := time.Now()
+	a.reconciler.stats.Runs++
+	a.reconciler.stats.LastRun = now
+	if repairs != 0 {
+		a.reconciler.stats.Repairs += repairs
+		a.reconciler.stats.LastRepair = now
+	}
+}
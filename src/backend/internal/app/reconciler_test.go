@@ -0,0 +1,43 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestApp_ReconcileRestoresDrift(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+	table := a.groupTable(t, group)
+
+	a.reconcile()
+	if stats := a.ReconcilerStats(); stats.Runs != 1 || stats.Repairs != 0 {
+		t.Fatalf("nothing should be repaired without drift: %+v", stats)
+	}
+
+	// Правило и маршрут удаляет сторонняя программа, правила netfilter сбрасывает прошивка
+	for _, rule := range a.netlink.Rules() {
+		if err := a.netlink.RuleDel(&rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, route := range a.netlink.Routes(table) {
+		if err := a.netlink.RouteDel(&route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.backend.Flush()
+
+	a.reconcile()
+
+	if len(a.netlink.Rules()) != 1 {
+		t.Error("ip rule should be restored")
+	}
+	if len(a.netlink.Routes(table)) != 1 {
+		t.Error("route should be restored")
+	}
+	stats := a.ReconcilerStats()
+	if stats.Runs != 2 || stats.Repairs != 3 || stats.LastRepair.IsZero() {
+		t.Errorf("repairs should be counted: %+v", stats)
+	}
+}
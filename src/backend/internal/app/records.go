@@ -0,0 +1,32 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"magitrickle/records"
+)
+
+var ErrRecordNotFound = errors.New("record not found")
+
+// Records возвращает страницу кеша DNS и число записей, подходящих под фильтр
+func (a *App) Records(search, entryType string, offset, limit int) ([]records.Entry, int) {
+	return a.records.ListEntries(search, entryType, offset, limit)
+}
+
+// DeleteRecord удаляет имя из кеша DNS. Группы синхронизируются, чтобы из ipset
+// ушли адреса, которые больше ничем не объясняются.
+func (a *App) DeleteRecord(name string) error {
+	if !a.records.Delete(strings.TrimSuffix(name, ".")) {
+		return fmt.Errorf("%w: %s", ErrRecordNotFound, name)
+	}
+	return a.SyncGroups()
+}
+
+// FlushRecords очищает кеш DNS и синхронизирует группы: в ipset остаются только
+// адреса из правил и добавленные вручную
+func (a *App) FlushRecords() error {
+	a.records.Flush()
+	return a.SyncGroups()
+}
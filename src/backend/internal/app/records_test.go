@@ -0,0 +1,40 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestApp_FlushRecordsSyncsGroups(t *testing.T) {
+	a := newTestApp(t)
+	a.enabled.Store(true)
+	a.netlink.AddLink("nwg0", true)
+	group := a.addGroup(t, "nwg0", "example.com")
+
+	a.answer(aRecord("www.example.com", "93.184.216.34", 300))
+	a.answer(aRecord("api.example.com", "93.184.216.35", 300))
+	if err := group.AddManualIP(net.ParseIP("198.51.100.1"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.DeleteRecord("www.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if a.inGroup(group, "93.184.216.34") || !a.inGroup(group, "93.184.216.35") {
+		t.Fatal("only the address of the deleted name should leave the group")
+	}
+	if err := a.DeleteRecord("www.example.com"); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("deleted name should be reported as missing: %v", err)
+	}
+
+	if err := a.FlushRecords(); err != nil {
+		t.Fatal(err)
+	}
+	if a.inGroup(group, "93.184.216.35") || !a.inGroup(group, "198.51.100.1") {
+		t.Fatal("flush should keep only manual addresses")
+	}
+	if _, total := a.Records("", "", 0, 0); total != 0 {
+		t.Fatalf("cache should be empty: %d", total)
+	}
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"magitrickle/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidRouting = errors.New("invalid routing settings")
+	ErrNoFreeMark     = errors.New("no free mark or routing table")
+)
+
+// reservedTables – служебные таблицы ядра (unspec, default, main, local)
+var reservedTables = map[int]struct{}{0: {}, 253: {}, 254: {}, 255: {}}
+
+// ValidateRouting проверяет маску меток и диапазон таблиц. Маска должна быть
+// непрерывным диапазоном бит, чтобы метки групп можно было пронумеровать внутри него.
+func ValidateRouting(routing models.Routing) error {
+	if routing.MarkMask == 0 {
+		return fmt.Errorf("%w: mark mask is empty", ErrInvalidRouting)
+	}
+	shifted := routing.MarkMask >> bits.TrailingZeros32(routing.MarkMask)
+	if shifted&(shifted+1) != 0 {
+		return fmt.Errorf("%w: mark mask 0x%x is not a contiguous bit range", ErrInvalidRouting, routing.MarkMask)
+	}
+	if routing.TableStart <= 0 || routing.TableEnd < routing.TableStart {
+		return fmt.Errorf("%w: table range %d-%d", ErrInvalidRouting, routing.TableStart, routing.TableEnd)
+	}
+	return nil
+}
+
+// markFits сообщает, что метка не пустая и лежит внутри маски
+func markFits(mark, mask uint32) bool {
+	return mark != 0 && mark&^mask == 0
+}
+
+// tableFits сообщает, что таблица лежит в диапазоне и не служебная
+func tableFits(table int, routing models.Routing) bool {
+	_, reserved := reservedTables[table]
+	return !reserved && table >= routing.TableStart && table <= routing.TableEnd
+}
+
+// assignMarkAndTable выделяет группе метку и таблицу, если они не заданы, не подходят
+// под текущие настройки или уже заняты другой группой. Назначение хранится в модели группы
+// и попадает в конфиг, поэтому между перезапусками метки и таблицы не меняются.
+func (a *App) assignMarkAndTable(group *models.Group) error {
+	routing := a.config.Netfilter.Routing
+	usedMarks := make(map[uint32]struct{})
+	usedTables := make(map[int]struct{})
+	for _, other := range a.groups {
+		if other.Group == group {
+			continue
+		}
+		usedMarks[other.Mark] = struct{}{}
+		usedTables[other.Table] = struct{}{}
+	}
+
+	_, markUsed := usedMarks[group.Mark]
+	if !markFits(group.Mark, routing.MarkMask) || markUsed {
+		step := uint32(1) << bits.TrailingZeros32(routing.MarkMask)
+		mark := uint32(0)
+		for candidate := step; markFits(candidate, routing.MarkMask); candidate += step {
+			if _, exists := usedMarks[candidate]; !exists {
+				mark = candidate
+				break
+			}
+		}
+		if mark == 0 {
+			return fmt.Errorf("%w: mark mask 0x%x is exhausted", ErrNoFreeMark, routing.MarkMask)
+		}
+		if group.Mark != 0 {
+			log.Warn().
+				Str("group", group.ID.String()).
+				Uint32("old", group.Mark).
+				Uint32("new", mark).
+				Msg("group mark does not fit the mark mask or is taken, reassigned")
+		}
+		group.Mark = mark
+	}
+
+	_, tableUsed := usedTables[group.Table]
+	if !tableFits(group.Table, routing) || tableUsed {
+		table := 0
+		for candidate := routing.TableStart; candidate <= routing.TableEnd; candidate++ {
+			if _, exists := usedTables[candidate]; !exists && tableFits(candidate, routing) {
+				table = candidate
+				break
+			}
+		}
+		if table == 0 {
+			return fmt.Errorf("%w: table range %d-%d is exhausted", ErrNoFreeMark, routing.TableStart, routing.TableEnd)
+		}
+		if group.Table != 0 {
+			log.Warn().
+				Str("group", group.ID.String()).
+				Int("old", group.Table).
+				Int("new", table).
+				Msg("group routing table is out of range or taken, reassigned")
+		}
+		group.Table = table
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"magitrickle/api/types"
+	"magitrickle/models"
+)
+
+func TestValidateRouting(t *testing.T) {
+	if err := ValidateRouting(defaultAppConfig.Netfilter.Routing); err != nil {
+		t.Errorf("default routing should be accepted: %v", err)
+	}
+	for _, invalid := range []models.Routing{
+		{MarkMask: 0, TableStart: 1000, TableEnd: 1999},
+		{MarkMask: 0x00f0f000, TableStart: 1000, TableEnd: 1999},
+		{MarkMask: 0xff, TableStart: 0, TableEnd: 10},
+		{MarkMask: 0xff, TableStart: 20, TableEnd: 10},
+	} {
+		if err := ValidateRouting(invalid); !errors.Is(err, ErrInvalidRouting) {
+			t.Errorf("%+v should be rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestApp_AssignMarkAndTable(t *testing.T) {
+	a := newTestApp(t)
+	a.config.Netfilter.Routing = models.Routing{MarkMask: 0x300, TableStart: 252, TableEnd: 257}
+
+	kept := &models.Group{ID: types.RandomID(), Mark: 0x200, Table: 256}
+	if err := a.AddGroup(kept); err != nil {
+		t.Fatal(err)
+	}
+	if kept.Mark != 0x200 || kept.Table != 256 {
+		t.Fatalf("valid assignment should be kept, got 0x%x/%d", kept.Mark, kept.Table)
+	}
+
+	// Метка вне маски и занятая таблица выделяются заново, служебные таблицы пропускаются
+	moved := &models.Group{ID: types.RandomID(), Mark: 0x1, Table: 256}
+	if err := a.AddGroup(moved); err != nil {
+		t.Fatal(err)
+	}
+	if moved.Mark != 0x100 || moved.Table != 252 {
+		t.Fatalf("expected 0x100/252, got 0x%x/%d", moved.Mark, moved.Table)
+	}
+
+	fresh := &models.Group{ID: types.RandomID()}
+	if err := a.AddGroup(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Mark != 0x300 || fresh.Table != 257 {
+		t.Fatalf("expected 0x300/257, got 0x%x/%d", fresh.Mark, fresh.Table)
+	}
+
+	if err := a.AddGroup(&models.Group{ID: types.RandomID()}); !errors.Is(err, ErrNoFreeMark) {
+		t.Fatalf("exhausted mask should be reported, got %v", err)
+	}
+}
@@ -2,13 +2,16 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"runtime/debug"
+	"time"
 
 	netfilterHelper "magitrickle/netfilter-helper"
 
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
 )
@@ -35,8 +38,8 @@ func (a *App) Start(ctx context.Context) error {
 	}
 	a.nfHelper = nfh
 
-	if err := a.nfHelper.CleanIPTables(); err != nil {
-		return fmt.Errorf("failed to clear iptables: %w", err)
+	if err := a.nfHelper.Clean(); err != nil {
+		return fmt.Errorf("failed to clean netfilter rules: %w", err)
 	}
 
 	newCtx, cancel := context.WithCancel(ctx)
@@ -52,35 +55,114 @@ func (a *App) Start(ctx context.Context) error {
 
 	if !a.config.DNSProxy.DisableRemap53 {
 		a.dnsOverrider = a.nfHelper.PortRemap("DNSOR", 53, a.config.DNSProxy.Host.Port, interfaceAddrs)
+		// Наборы перехвата удаляются последними, когда правила на них уже не ссылаются
+		defer func() {
+			_ = a.disableDNSHijack()
+		}()
 		if err := a.dnsOverrider.Enable(); err != nil {
 			return fmt.Errorf("failed to override DNS: %v", err)
 		}
 		defer func() {
 			_ = a.dnsOverrider.Disable()
 		}()
+		if err := a.enableDNSHijack(a.dnsOverrider); err != nil {
+			return err
+		}
+	} else if a.config.DNSProxy.Hijack.Enabled {
+		log.Warn().Msg("DNS hijack requires the port 53 remap, ignored")
 	}
 
-	for _, group := range a.groups {
-		if err := group.Enable(); err != nil {
-			return fmt.Errorf("failed to enable group: %w", err)
+	// Правила всех групп применяются одним вызовом в конце
+	err = a.nfHelper.BatchRules(func() error {
+		for _, group := range a.groups {
+			if err := group.Enable(); err != nil {
+				return fmt.Errorf("failed to enable group: %w", err)
+			}
+			// Группа уже включена, адреса досинхронизируются по ответам DNS и сверкой
+			if err := group.Sync(); err != nil {
+				log.Error().Str("group", group.ID.String()).Err(err).Msg("failed to sync group")
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	defer func() {
-		for _, group := range a.groups {
-			_ = group.Disable()
-		}
+		_ = a.nfHelper.BatchRules(func() error {
+			for _, group := range a.groups {
+				_ = group.Disable()
+			}
+			return nil
+		})
 	}()
 
-	linkUpdateChannel, linkUpdateDone, err := subscribeLinkUpdates()
+	linkUpdateChannel, linkUpdateDone, err := a.subscribeLinkUpdates()
 	if err != nil {
 		return err
 	}
 	defer close(linkUpdateDone)
 
+	neighUpdateChannel, neighUpdateDone, err := a.subscribeNeighUpdates()
+	if err != nil {
+		return err
+	}
+	defer close(neighUpdateDone)
+
+	routeUpdateChannel, routeUpdateDone, err := a.subscribeRouteUpdates()
+	if err != nil {
+		return err
+	}
+	defer close(routeUpdateDone)
+
+	addrUpdateChannel, addrUpdateDone, err := a.subscribeAddrUpdates()
+	if err != nil {
+		return err
+	}
+	defer close(addrUpdateDone)
+
+	reconcileTicker := time.NewTicker(reconcileInterval)
+	defer reconcileTicker.Stop()
+	// Таймер запускается первым событием netlink, следующие события в пределах задержки
+	// не откладывают проверку
+	reconcileTimer := time.NewTimer(reconcileDelay)
+	reconcileTimer.Stop()
+	reconcilePending := false
+	scheduleReconcile := func() {
+		if !reconcilePending {
+			reconcilePending = true
+			reconcileTimer.Reset(reconcileDelay)
+		}
+	}
+
+	geoDataTicker := time.NewTicker(geoDataCheckInterval)
+	defer geoDataTicker.Stop()
+
+	statsTicker := time.NewTicker(statsInterval)
+	defer statsTicker.Stop()
+
 	for {
 		select {
 		case event := <-linkUpdateChannel:
 			a.handleLink(event)
+		case event := <-neighUpdateChannel:
+			a.handleNeigh(event)
+		case <-routeUpdateChannel:
+			scheduleReconcile()
+		case <-addrUpdateChannel:
+			a.updateDNSRemap()
+			scheduleReconcile()
+		case <-reconcileTimer.C:
+			reconcilePending = false
+			a.reconcile()
+		case <-reconcileTicker.C:
+			a.reconcile()
+		case <-geoDataTicker.C:
+			a.reloadGeoData()
+		case <-statsTicker.C:
+			a.sampleStats()
+		case <-a.conntrackQueue.signal():
+			a.flushQueuedConntrack()
 		case err := <-errChan:
 			return err
 		case <-ctx.Done():
@@ -115,17 +197,22 @@ func (a *App) setupLogging() {
 }
 
 func (a *App) createNetfilterHelper() (*netfilterHelper.NetfilterHelper, error) {
-	return netfilterHelper.New(a.config.Netfilter.IPTables.ChainPrefix, a.config.Netfilter.IPSet.TablePrefix, a.config.Netfilter.DisableIPv4, a.config.Netfilter.DisableIPv6)
+	return netfilterHelper.New(a.config.Netfilter.Backend, a.config.Netfilter.IPTables.ChainPrefix, a.config.Netfilter.IPSet.TablePrefix, a.config.Netfilter.DisableIPv4, a.config.Netfilter.DisableIPv6)
 }
 
 func (a *App) getInterfaceAddresses() ([]netlink.Addr, error) {
 	var addrList []netlink.Addr
 	for _, linkName := range a.config.Link {
-		link, err := netlink.LinkByName(linkName)
+		link, err := a.nfHelper.Netlink().LinkByName(linkName)
+		if errors.Is(err, netfilterHelper.ErrLinkNotFound) {
+			// Интерфейс может появиться позже, его адреса добавятся по событию netlink
+			log.Debug().Str("interface", linkName).Msg("link is not present yet")
+			continue
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to find link %s: %w", linkName, err)
 		}
-		linkAddrList, err := netlink.AddrList(link, nl.FAMILY_ALL)
+		linkAddrList, err := a.nfHelper.Netlink().AddrList(link, nl.FAMILY_ALL)
 		if err != nil {
 			return nil, fmt.Errorf("failed to list address of interface %s: %w", linkName, err)
 		}
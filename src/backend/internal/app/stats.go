@@ -0,0 +1,173 @@
+package app
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	netfilterHelper "magitrickle/netfilter-helper"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// statsInterval – период опроса счётчиков. Один вызов iptables-save на все группы,
+	// поэтому опрос не нагружает слабые роутеры.
+	statsInterval = 15 * time.Second
+	// statsHistorySize – число хранимых замеров скорости (10 минут)
+	statsHistorySize = 40
+	// topDestinationsSize – число адресов в списке самых активных направлений
+	topDestinationsSize = 10
+)
+
+// TrafficSample – средняя скорость группы между двумя опросами, байт в секунду
+type TrafficSample struct {
+	Time   time.Time
+	TxRate float64
+	RxRate float64
+}
+
+// DestinationStats – соединения группы с одним адресом
+type DestinationStats struct {
+	Address     net.IP
+	Connections int
+	// Bytes – трафик в обе стороны, считается только при включённом nf_conntrack_acct
+	Bytes uint64
+}
+
+// GroupStats – трафик группы с момента запуска
+type GroupStats struct {
+	netfilterHelper.LinkCounters
+	TxRate          float64
+	RxRate          float64
+	Samples         []TrafficSample
+	TopDestinations []DestinationStats
+}
+
+// trafficStats накапливает счётчики группы. Правила подсчёта пересоздаются вместе
+// с диспетчером, поэтому уменьшение счётчика считается его сбросом.
+type trafficStats struct {
+	locker   sync.Mutex
+	last     netfilterHelper.LinkCounters
+	lastTime time.Time
+	total    netfilterHelper.LinkCounters
+	samples  []TrafficSample
+}
+
+func counterDelta(last, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// update добавляет к итогам прирост счётчиков и записывает замер скорости
+func (s *trafficStats) update(counters netfilterHelper.LinkCounters, now time.Time) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	txBytes := counterDelta(s.last.TxBytes, counters.TxBytes)
+	rxBytes := counterDelta(s.last.RxBytes, counters.RxBytes)
+	s.total.TxPackets += counterDelta(s.last.TxPackets, counters.TxPackets)
+	s.total.TxBytes += txBytes
+	s.total.RxPackets += counterDelta(s.last.RxPackets, counters.RxPackets)
+	s.total.RxBytes += rxBytes
+
+	if !s.lastTime.IsZero() {
+		if seconds := now.Sub(s.lastTime).Seconds(); seconds > 0 {
+			s.samples = append(s.samples, TrafficSample{
+				Time:   now,
+				TxRate: float64(txBytes) / seconds,
+				RxRate: float64(rxBytes) / seconds,
+			})
+			if len(s.samples) > statsHistorySize {
+				s.samples = slices.Delete(s.samples, 0, len(s.samples)-statsHistorySize)
+			}
+		}
+	}
+	s.last = counters
+	s.lastTime = now
+}
+
+func (s *trafficStats) snapshot() GroupStats {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	stats := GroupStats{
+		LinkCounters: s.total,
+		Samples:      slices.Clone(s.samples),
+	}
+	if len(s.samples) != 0 {
+		stats.TxRate = s.samples[len(s.samples)-1].TxRate
+		stats.RxRate = s.samples[len(s.samples)-1].RxRate
+	}
+	return stats
+}
+
+// sampleStats опрашивает счётчики трафика всех включённых групп
+func (a *App) sampleStats() {
+	counters, err := a.nfHelper.LinkCounters()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to read traffic counters")
+		return
+	}
+	now := time.Now()
+	for _, group := range a.groups {
+		group.locker.Lock()
+		var chain string
+		if group.Enabled() && group.ipsetToLink != nil {
+			chain = group.ipsetToLink.ChainName()
+		}
+		group.locker.Unlock()
+		if chain != "" {
+			group.stats.update(counters[chain], now)
+		}
+	}
+}
+
+// Stats возвращает трафик группы и адреса, с которыми у её устройств больше всего
+// соединений. Адреса берутся из таблицы conntrack в момент запроса.
+func (g *Group) Stats() GroupStats {
+	stats := g.stats.snapshot()
+	if !g.Enabled() || g.Mark == 0 {
+		return stats
+	}
+	flows, err := g.app.nfHelper.ConntrackFlows(g.Mark, g.app.config.Netfilter.Routing.MarkMask)
+	if err != nil {
+		log.Warn().Str("group", g.ID.String()).Err(err).Msg("failed to list group connections")
+		return stats
+	}
+
+	destinations := make(map[string]*DestinationStats)
+	for _, flow := range flows {
+		key := string(flow.Forward.DstIP.To16())
+		destination, ok := destinations[key]
+		if !ok {
+			destination = &DestinationStats{Address: flow.Forward.DstIP}
+			destinations[key] = destination
+		}
+		destination.Connections++
+		destination.Bytes += flow.Forward.Bytes + flow.Reverse.Bytes
+	}
+	for _, destination := range destinations {
+		stats.TopDestinations = append(stats.TopDestinations, *destination)
+	}
+	slices.SortFunc(stats.TopDestinations, func(a, b DestinationStats) int {
+		if a.Bytes != b.Bytes {
+			if a.Bytes > b.Bytes {
+				return -1
+			}
+			return 1
+		}
+		if a.Connections != b.Connections {
+			return b.Connections - a.Connections
+		}
+		return bytes.Compare(a.Address.To16(), b.Address.To16())
+	})
+	if len(stats.TopDestinations) > topDestinationsSize {
+		stats.TopDestinations = stats.TopDestinations[:topDestinationsSize]
+	}
+	return stats
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	netfilterHelper "magitrickle/netfilter-helper"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestTrafficStats_CounterReset(t *testing.T) {
+	var stats trafficStats
+	now := time.Now()
+	stats.update(netfilterHelper.LinkCounters{TxBytes: 1000, RxBytes: 5000}, now)
+	stats.update(netfilterHelper.LinkCounters{TxBytes: 2500, RxBytes: 8000}, now.Add(10*time.Second))
+	// Правила пересоздались, счётчики начались заново
+	stats.update(netfilterHelper.LinkCounters{TxBytes: 200, RxBytes: 100}, now.Add(20*time.Second))
+
+	snapshot := stats.snapshot()
+	if snapshot.TxBytes != 2700 || snapshot.RxBytes != 8100 {
+		t.Fatalf("reset counters should not decrease totals: %+v", snapshot.LinkCounters)
+	}
+	if len(snapshot.Samples) != 2 || snapshot.Samples[0].TxRate != 150 || snapshot.Samples[0].RxRate != 300 {
+		t.Fatalf("unexpected samples: %+v", snapshot.Samples)
+	}
+	if snapshot.TxRate != 20 || snapshot.RxRate != 10 {
+		t.Fatalf("current rate should be the latest sample: %v %v", snapshot.TxRate, snapshot.RxRate)
+	}
+}
+
+func TestApp_GroupStats(t *testing.T) {
+	a := newTestApp(t)
+	a.netlink.AddLink("wg0", true)
+	group := a.addGroup(t, "wg0", "example.com")
+	other := a.addGroup(t, "wg0", "example.org")
+	chain := "MT_" + group.ID.String()
+
+	a.backend.SetLinkCounters(chain, netfilterHelper.LinkCounters{TxPackets: 1, TxBytes: 100, RxPackets: 2, RxBytes: 900})
+	a.sampleStats()
+	a.backend.SetLinkCounters(chain, netfilterHelper.LinkCounters{TxPackets: 3, TxBytes: 400, RxPackets: 6, RxBytes: 3000})
+	a.sampleStats()
+
+	flow := func(mark uint32, dst string, bytes uint64) *netlink.ConntrackFlow {
+		flow := &netlink.ConntrackFlow{Mark: mark}
+		flow.Forward.SrcIP = net.ParseIP("192.168.1.20").To4()
+		flow.Forward.DstIP = net.ParseIP(dst).To4()
+		flow.Forward.Bytes = bytes
+		flow.Reverse.Bytes = bytes
+		return flow
+	}
+	a.netlink.AddFlow(flow(group.Mark, "198.51.100.1", 10))
+	a.netlink.AddFlow(flow(group.Mark, "198.51.100.2", 500))
+	a.netlink.AddFlow(flow(group.Mark, "198.51.100.1", 10))
+	a.netlink.AddFlow(flow(other.Mark, "198.51.100.3", 1000))
+	// IPv6 не маркируется группами, поэтому совпадение метки у такого соединения случайно
+	ipv6 := &netlink.ConntrackFlow{FamilyType: unix.AF_INET6, Mark: group.Mark}
+	ipv6.Forward.DstIP = net.ParseIP("2001:db8::1")
+	ipv6.Forward.Bytes = 1
+	a.netlink.AddFlow(ipv6)
+
+	stats := group.Stats()
+	if stats.TxBytes != 400 || stats.RxBytes != 3000 || stats.RxPackets != 6 || len(stats.Samples) != 1 {
+		t.Fatalf("unexpected totals: %+v", stats)
+	}
+	top := stats.TopDestinations
+	if len(top) != 2 || !top[0].Address.Equal(net.ParseIP("198.51.100.2")) || top[0].Bytes != 1000 ||
+		top[1].Connections != 2 || top[1].Bytes != 40 {
+		t.Fatalf("only connections of the group should be counted, busiest first: %+v", top)
+	}
+	if stats := other.Stats(); stats.TxBytes != 0 || len(stats.TopDestinations) != 1 {
+		t.Fatalf("other group should have its own stats: %+v", stats)
+	}
+}
@@ -10,10 +10,17 @@ type App struct {
 	DNSProxy          DNSProxy
 	Netfilter         Netfilter
 	Link              []string
+	ClientSets        []ClientSet
 	ShowAllInterfaces bool
 	LogLevel          string
 }
 
+// ClientSet – именованный список устройств LAN (адреса, подсети, MAC-адреса)
+type ClientSet struct {
+	Name    string
+	Clients []string
+}
+
 type HTTPWeb struct {
 	Enabled bool
 	Host    HTTPWebServer
@@ -32,6 +39,18 @@ type DNSProxy struct {
 	DisableRemap53  bool
 	DisableFakePTR  bool
 	DisableDropAAAA bool
+	Hijack          DNSHijack
+}
+
+// DNSHijack – перехват DNS-запросов устройств LAN к любым серверам, а не только к роутеру
+type DNSHijack struct {
+	Enabled bool
+	// Exempt – устройства, которым разрешено обращаться к своим серверам напрямую
+	Exempt []string
+	// BlockEncryptedDNS запрещает DoT и DoH к серверам из DoHServers, чтобы устройства
+	// вернулись к обычному DNS
+	BlockEncryptedDNS bool
+	DoHServers        []string
 }
 
 type DNSProxyServer struct {
@@ -40,8 +59,10 @@ type DNSProxyServer struct {
 }
 
 type Netfilter struct {
+	Backend     string
 	IPTables    IPTables
 	IPSet       IPSet
+	Routing     Routing
 	DisableIPv4 bool
 	DisableIPv6 bool
 }
@@ -54,3 +75,10 @@ type IPSet struct {
 	TablePrefix   string
 	AdditionalTTL uint32
 }
+
+// Routing – биты fwmark и диапазон таблиц маршрутизации, из которых группам выделяются метки и таблицы
+type Routing struct {
+	MarkMask   uint32
+	TableStart int
+	TableEnd   int
+}
@@ -7,12 +7,18 @@ type Config struct {
 }
 
 type App struct {
-	HTTPWeb           *HTTPWeb   `yaml:"httpWeb"`
-	DNSProxy          *DNSProxy  `yaml:"dnsProxy"`
-	Netfilter         *Netfilter `yaml:"netfilter"`
-	Link              *[]string  `yaml:"link"`
-	ShowAllInterfaces *bool      `yaml:"showAllInterfaces"`
-	LogLevel          *string    `yaml:"logLevel"`
+	HTTPWeb           *HTTPWeb     `yaml:"httpWeb"`
+	DNSProxy          *DNSProxy    `yaml:"dnsProxy"`
+	Netfilter         *Netfilter   `yaml:"netfilter"`
+	Link              *[]string    `yaml:"link"`
+	ClientSets        *[]ClientSet `yaml:"clientSets"`
+	ShowAllInterfaces *bool        `yaml:"showAllInterfaces"`
+	LogLevel          *string      `yaml:"logLevel"`
+}
+
+type ClientSet struct {
+	Name    string   `yaml:"name"`
+	Clients []string `yaml:"clients"`
 }
 
 type HTTPWeb struct {
@@ -35,6 +41,14 @@ type DNSProxy struct {
 	DisableRemap53  *bool             `yaml:"disableRemap53"`
 	DisableFakePTR  *bool             `yaml:"disableFakePTR"`
 	DisableDropAAAA *bool             `yaml:"disableDropAAAA"`
+	Hijack          *DNSHijack        `yaml:"hijack"`
+}
+
+type DNSHijack struct {
+	Enabled           *bool     `yaml:"enabled"`
+	Exempt            *[]string `yaml:"exempt"`
+	BlockEncryptedDNS *bool     `yaml:"blockEncryptedDNS"`
+	DoHServers        *[]string `yaml:"dohServers"`
 }
 
 type DNSProxyServer struct {
@@ -43,8 +57,10 @@ type DNSProxyServer struct {
 }
 
 type Netfilter struct {
+	Backend     *string   `yaml:"backend"`
 	IPTables    *IPTables `yaml:"iptables"`
 	IPSet       *IPSet    `yaml:"ipset"`
+	Routing     *Routing  `yaml:"routing"`
 	DisableIPv4 *bool     `yaml:"disableIPv4"`
 	DisableIPv6 *bool     `yaml:"disableIPv6"`
 }
@@ -57,3 +73,9 @@ type IPSet struct {
 	TablePrefix   *string `yaml:"tablePrefix"`
 	AdditionalTTL *uint32 `yaml:"additionalTTL"`
 }
+
+type Routing struct {
+	MarkMask   *uint32 `yaml:"markMask"`
+	TableStart *int    `yaml:"tableStart"`
+	TableEnd   *int    `yaml:"tableEnd"`
+}
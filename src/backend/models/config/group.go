@@ -5,10 +5,35 @@ import (
 )
 
 type Group struct {
-	ID        types.ID `yaml:"id"`
-	Name      string   `yaml:"name"`
-	Color     string   `yaml:"color"`
-	Interface string   `yaml:"interface"`
-	Enable    *bool    `yaml:"enable"` // TODO: Make required after 1.0.0
-	Rules     []Rule   `yaml:"rules"`
+	ID         types.ID  `yaml:"id"`
+	Name       string    `yaml:"name"`
+	Color      string    `yaml:"color"`
+	Kind       string    `yaml:"kind,omitempty"`
+	Interface  string    `yaml:"interface"`
+	Gateway    string    `yaml:"gateway,omitempty"`
+	Failover   []string  `yaml:"failover,omitempty"`
+	Probe      *Probe    `yaml:"probe,omitempty"`
+	Multipath  []Nexthop `yaml:"multipath,omitempty"`
+	KillSwitch bool      `yaml:"killSwitch,omitempty"`
+	RouteLocal bool      `yaml:"routeLocal,omitempty"`
+	Clients    []string  `yaml:"clients,omitempty"`
+	Ports      []string  `yaml:"ports,omitempty"`
+	Enable     *bool     `yaml:"enable"` // TODO: Make required after 1.0.0
+	Priority   int       `yaml:"priority,omitempty"`
+	Mark       uint32    `yaml:"mark,omitempty"`
+	Table      int       `yaml:"table,omitempty"`
+	Rules      []Rule    `yaml:"rules"`
+}
+
+type Nexthop struct {
+	Interface string `yaml:"interface"`
+	Weight    int    `yaml:"weight,omitempty"`
+}
+
+type Probe struct {
+	Type     string `yaml:"type"`
+	Target   string `yaml:"target"`
+	Interval uint32 `yaml:"interval"`
+	Timeout  uint32 `yaml:"timeout"`
+	Fails    uint32 `yaml:"fails"`
 }
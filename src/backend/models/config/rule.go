@@ -5,9 +5,10 @@ import (
 )
 
 type Rule struct {
-	ID     types.ID `yaml:"id"`
-	Name   string   `yaml:"name"`
-	Type   string   `yaml:"type"`
-	Rule   string   `yaml:"rule"`
-	Enable bool     `yaml:"enable"`
+	ID      types.ID `yaml:"id"`
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+	Rule    string   `yaml:"rule"`
+	Enable  bool     `yaml:"enable"`
+	Exclude bool     `yaml:"exclude,omitempty"`
 }
@@ -1,14 +1,80 @@
 package models
 
 import (
+	"slices"
+
 	"magitrickle/api/types"
 )
 
+const (
+	// GroupKindRoute – домены группы направляются в её интерфейс
+	GroupKindRoute = ""
+	// GroupKindBypass – домены группы идут мимо VPN по основной таблице маршрутизации
+	GroupKindBypass = "bypass"
+	// GroupKindSource – весь трафик устройств группы направляется в её интерфейс,
+	// а домены группы становятся исключениями
+	GroupKindSource = "source"
+)
+
 type Group struct {
-	ID        types.ID
-	Name      string
-	Color     string
+	ID         types.ID
+	Name       string
+	Color      string
+	Kind       string
+	Interface  string
+	Gateway    string
+	Failover   []string
+	Probe      Probe
+	Multipath  []Nexthop
+	KillSwitch bool
+	// RouteLocal направляет в группу и трафик самого роутера
+	RouteLocal bool
+	// Clients ограничивает группу устройствами: адреса, подсети, MAC-адреса
+	// и ссылки на именованные списки вида @name. Пустой список – все устройства.
+	Clients []string
+	// Ports ограничивает группу протоколами и портами назначения: tcp/443, udp/8000-8100
+	Ports    []string
+	Enable   bool
+	Priority int
+	// Mark и Table – метка и таблица маршрутизации группы, выделяются один раз и сохраняются в конфиге
+	Mark  uint32
+	Table int
+	Rules []*Rule
+}
+
+type Probe struct {
+	Type     string
+	Target   string
+	Interval uint32
+	Timeout  uint32
+	Fails    uint32
+}
+
+// Nexthop – интерфейс для балансировки с весом от 1 до 256
+type Nexthop struct {
 	Interface string
-	Enable    bool
-	Rules     []*Rule
+	Weight    int
+}
+
+// Interfaces возвращает основной интерфейс и резервные в порядке предпочтения
+func (g *Group) Interfaces() []string {
+	interfaces := make([]string, 0, len(g.Failover)+1)
+	interfaces = append(interfaces, g.Interface)
+	for _, iface := range g.Failover {
+		if iface != "" && iface != g.Interface {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	return interfaces
+}
+
+// Links возвращает все интерфейсы, которые использует группа
+func (g *Group) Links() []string {
+	links := g.Interfaces()
+	for _, nexthop := range g.Multipath {
+		if !slices.Contains(links, nexthop.Interface) {
+			links = append(links, nexthop.Interface)
+		}
+	}
+	return links
 }
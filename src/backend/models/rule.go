@@ -10,17 +10,22 @@ import (
 )
 
 type Rule struct {
-	ID     types.ID
-	Name   string
-	Type   string
-	Rule   string
-	Enable bool
+	ID      types.ID
+	Name    string
+	Type    string
+	Rule    string
+	Enable  bool
+	Exclude bool
 }
 
 func (d *Rule) IsEnabled() bool {
 	return d.Enable
 }
 
+func (d *Rule) IsExclude() bool {
+	return d.Exclude
+}
+
 func (d *Rule) IsMatch(domainName string) bool {
 	switch d.Type {
 	case "wildcard":
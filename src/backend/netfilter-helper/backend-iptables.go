@@ -0,0 +1,856 @@
+package netfilterHelper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// iptablesTables – таблицы, в которых MagiTrickle держит свои цепочки
+var iptablesTables = []string{"filter", "mangle", "nat"}
+
+// iptablesFamily – утилиты одного семейства адресов
+type iptablesFamily struct {
+	// name совпадает с типом из хука netfilter.d
+	name    string
+	ipv6    bool
+	save    string
+	restore string
+	// wait – iptables-restore понимает ключ -w (с версии 1.6.2)
+	wait bool
+}
+
+// IPTablesBackend работает через iptables и ipset ядра.
+//
+// Бэкенд хранит желаемый набор правил целиком. Каждое изменение сверяется с выводом
+// iptables-save и применяется одним вызовом iptables-restore --noflush на семейство,
+// поэтому правила никогда не остаются применёнными наполовину. Изменившиеся цепочки
+// переписываются целиком, остальные правила таблиц не затрагиваются. Изменения внутри
+// пачки (включение группы, запуск, хук netfilter.d) применяются разом при её закрытии.
+type IPTablesBackend struct {
+	ChainPrefix string
+
+	locker     sync.Mutex
+	families   []iptablesFamily
+	links      map[string]LinkSpec
+	dispatcher []LinkSpec
+	remaps     map[string]RemapSpec
+	blocks     map[string]BlockSpec
+
+	// Пока открыта пачка (см. BeginRules), изменения только отмечают семейства,
+	// которые нужно применить при её закрытии. Пустое имя означает все семейства.
+	batchDepth int
+	pending    map[string]struct{}
+
+	run func(stdin, name string, args ...string) ([]byte, error)
+}
+
+func NewIPTablesBackend(chainPrefix string, disableIPv4, disableIPv6 bool) (*IPTablesBackend, error) {
+	b := &IPTablesBackend{
+		ChainPrefix: chainPrefix,
+		links:       make(map[string]LinkSpec),
+		remaps:      make(map[string]RemapSpec),
+		blocks:      make(map[string]BlockSpec),
+		run:         runCommand,
+	}
+
+	if !disableIPv4 {
+		b.families = append(b.families, iptablesFamily{name: "iptables", save: "iptables-save", restore: "iptables-restore"})
+	}
+	if !disableIPv6 {
+		b.families = append(b.families, iptablesFamily{name: "ip6tables", ipv6: true, save: "ip6tables-save", restore: "ip6tables-restore"})
+	}
+	for idx, family := range b.families {
+		for _, tool := range []string{family.save, family.restore} {
+			if _, err := exec.LookPath(tool); err != nil {
+				return nil, fmt.Errorf("%s init fail: %w", family.name, err)
+			}
+		}
+		b.families[idx].wait = b.supportsWait(family)
+	}
+
+	return b, nil
+}
+
+// supportsWait проверяет, понимает ли iptables-restore ключ -w. Старые версии
+// завершаются с ошибкой на неизвестный ключ, пустой скрипт в режиме --test ничего не меняет.
+func (b *IPTablesBackend) supportsWait(family iptablesFamily) bool {
+	_, err := b.run("", family.restore, "-w", "--test")
+	return err == nil
+}
+
+func runCommand(stdin, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func ipsetFamilyName(name string, ipNet net.IPNet) string {
+	if _, bits := ipNet.Mask.Size(); bits == 128 {
+		return name + "_6"
+	}
+	return name + "_4"
+}
+
+func (b *IPTablesBackend) CreateSet(name string) error {
+	err := netlink.IpsetCreate(name+"_4", "hash:net", netlink.IpsetCreateOptions{
+		Timeout: func(i uint32) *uint32 { return &i }(300),
+		Family:  unix.AF_INET,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create ipset: %w", err)
+	}
+
+	err = netlink.IpsetCreate(name+"_6", "hash:net", netlink.IpsetCreateOptions{
+		Timeout: func(i uint32) *uint32 { return &i }(300),
+		Family:  unix.AF_INET6,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create ipset: %w", err)
+	}
+
+	return nil
+}
+
+func (b *IPTablesBackend) DestroySet(name string) error {
+	// Набор нельзя удалить, пока на него ссылаются правила, отложенные в пачке
+	b.locker.Lock()
+	err := b.applyPending()
+	b.locker.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to apply rules: %w", err)
+	}
+
+	var errs []error
+	err = netlink.IpsetDestroy(name + "_4")
+	if err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	err = netlink.IpsetDestroy(name + "_6")
+	if err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	if errs != nil {
+		return fmt.Errorf("failed to destroy ipsets: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (b *IPTablesBackend) AddSetEntry(name string, entry SetEntry) error {
+	ipsetEntry := &netlink.IPSetEntry{
+		IP:      entry.Net.IP,
+		Timeout: entry.Timeout,
+		Replace: true,
+	}
+	if !isHostNet(entry.Net) {
+		ones, _ := entry.Net.Mask.Size()
+		ipsetEntry.CIDR = uint8(ones)
+	}
+	return netlink.IpsetAdd(ipsetFamilyName(name, entry.Net), ipsetEntry)
+}
+
+func (b *IPTablesBackend) DelSetEntry(name string, ipNet net.IPNet) error {
+	ipsetEntry := &netlink.IPSetEntry{IP: ipNet.IP}
+	if !isHostNet(ipNet) {
+		ones, _ := ipNet.Mask.Size()
+		ipsetEntry.CIDR = uint8(ones)
+	}
+	return netlink.IpsetDel(ipsetFamilyName(name, ipNet), ipsetEntry)
+}
+
+func (b *IPTablesBackend) ListSetEntries(name string) ([]SetEntry, error) {
+	var entries []SetEntry
+	for _, family := range []struct {
+		suffix string
+		bits   int
+	}{{"_4", 32}, {"_6", 128}} {
+		list, err := netlink.IpsetList(name + family.suffix)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list.Entries {
+			ones := int(entry.CIDR)
+			if ones == 0 {
+				ones = family.bits
+			}
+			entries = append(entries, SetEntry{
+				Net:     net.IPNet{IP: entry.IP, Mask: net.CIDRMask(ones, family.bits)},
+				Timeout: entry.Timeout,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// iptablesJump – правило встроенной цепочки, передающее пакеты в цепочку MagiTrickle
+type iptablesJump struct {
+	chain string
+	rule  string
+	// insert ставит правило в начало цепочки, а не в конец
+	insert bool
+}
+
+// iptablesRules – правила MagiTrickle одной таблицы в формате iptables-save
+type iptablesRules struct {
+	chains map[string][]string
+	jumps  []iptablesJump
+}
+
+func newIPTablesRules() *iptablesRules {
+	return &iptablesRules{chains: make(map[string][]string)}
+}
+
+func matchSet(set string) string {
+	return "-m set --match-set " + set + "_4 dst"
+}
+
+// macMatch возвращает условие на MAC-адрес отправителя так, как его выводит iptables-save
+func macMatch(mac net.HardwareAddr) string {
+	return "-m mac --mac-source " + strings.ToUpper(mac.String())
+}
+
+// markMatch возвращает условие на метку пакета так, как его выводит iptables-save
+func markMatch(mark, mask uint32) string {
+	if mask == 0xffffffff {
+		return fmt.Sprintf("-m mark --mark 0x%x", mark)
+	}
+	return fmt.Sprintf("-m mark --mark 0x%x/0x%x", mark, mask)
+}
+
+// clientMatches возвращает условия на клиентов группы в цепочке chain. MAC-адрес отправителя
+// виден только до маршрутизации: в POSTROUTING такие клиенты узнаются по метке группы,
+// а в OUTPUT (пакеты самого роутера) их нет.
+func clientMatches(spec LinkSpec, chain string) []string {
+	var matches []string
+	if spec.ClientSet != "" {
+		matches = append(matches, "-m set --match-set "+spec.ClientSet+"_4 src")
+	}
+	if len(spec.ClientMACs) == 0 {
+		return matches
+	}
+	switch chain {
+	case "POSTROUTING":
+		matches = append(matches, markMatch(spec.Mark, spec.markMask()))
+	case "OUTPUT":
+	default:
+		for _, mac := range spec.ClientMACs {
+			matches = append(matches, macMatch(mac))
+		}
+	}
+	return matches
+}
+
+// exemptRules возвращает правила, которые выводят из цепочки устройства-исключения
+func exemptRules(exemptSet, setSuffix string, macs []net.HardwareAddr) []string {
+	rules := []string{}
+	if exemptSet != "" {
+		rules = append(rules, "-m set --match-set "+exemptSet+setSuffix+" src -j RETURN")
+	}
+	for _, mac := range macs {
+		rules = append(rules, macMatch(mac)+" -j RETURN")
+	}
+	return rules
+}
+
+// linkMatches возвращает условия, под которые попадают пакеты группы в цепочке chain,
+// по одному на способ выбора клиентов и фильтр портов
+func linkMatches(spec LinkSpec, chain string) []string {
+	var matches []string
+	clients := clientMatches(spec, chain)
+	switch {
+	case spec.Source:
+		for _, client := range clients {
+			matches = append(matches, client+" -m set ! --match-set "+spec.Set+"_4 dst")
+		}
+	case spec.ClientSet == "" && len(spec.ClientMACs) == 0:
+		matches = []string{matchSet(spec.Set)}
+	default:
+		for _, client := range clients {
+			matches = append(matches, matchSet(spec.Set)+" "+client)
+		}
+	}
+	if len(spec.Ports) == 0 {
+		return matches
+	}
+
+	var portMatches []string
+	for _, match := range matches {
+		for _, ports := range spec.Ports {
+			// iptables-save выводит протокол перед модулями, а модули в порядке указания
+			portMatches = append(portMatches, fmt.Sprintf("-p %s %s -m %s --dport %s", ports.Protocol, match, ports.Protocol, ports.iptablesRange()))
+		}
+	}
+	return portMatches
+}
+
+// acceptRule возвращает разрешающее правило для интерфейса. Если группа ходит через шлюз
+// без указания интерфейса, разрешается любой исходящий интерфейс.
+func acceptRule(ifaceName string) string {
+	if ifaceName == "" {
+		return "-j ACCEPT"
+	}
+	return "-o " + ifaceName + " -j ACCEPT"
+}
+
+// desiredRules собирает правила всех таблиц семейства из текущего состояния.
+// Правила записываются так, как их выводит iptables-save, чтобы их можно было сравнить.
+func (b *IPTablesBackend) desiredRules(family iptablesFamily) map[string]*iptablesRules {
+	tables := make(map[string]*iptablesRules)
+	for _, table := range iptablesTables {
+		tables[table] = newIPTablesRules()
+	}
+	filter, mangle, nat := tables["filter"], tables["mangle"], tables["nat"]
+
+	// TODO: IPv6
+	if !family.ipv6 {
+		for _, spec := range b.links {
+			mangle.chains[spec.Chain] = []string{
+				fmt.Sprintf("-j MARK --set-xmark 0x%x/0x%x", spec.Mark, spec.markMask()),
+				fmt.Sprintf("-j CONNMARK --save-mark --nfmask 0x%x --ctmask 0x%x", spec.markMask(), spec.markMask()),
+			}
+
+			// Группа-исключение уходит через WAN, который уже разрешён и маскарадится системой
+			if spec.Bypass {
+				continue
+			}
+
+			var rules []string
+			for _, ifaceName := range spec.OutInterfaces {
+				rules = append(rules, acceptRule(ifaceName))
+			}
+			if spec.KillSwitch {
+				rules = append(rules, "-j REJECT --reject-with icmp-port-unreachable")
+			}
+			filter.chains[spec.Chain] = rules
+			nat.chains[spec.Chain] = []string{"-j MASQUERADE"}
+			for _, match := range linkMatches(spec, "FORWARD") {
+				filter.jumps = append(filter.jumps, iptablesJump{chain: "FORWARD", rule: match + " -j " + spec.Chain})
+			}
+			for _, match := range linkMatches(spec, "POSTROUTING") {
+				nat.jumps = append(nat.jumps, iptablesJump{chain: "POSTROUTING", rule: match + " -j " + spec.Chain})
+			}
+		}
+
+		// Транзит считается в FORWARD, соединения самого роутера – в OUTPUT и INPUT
+		if countRules := b.countRules(); len(countRules) != 0 {
+			countChainName := b.countChainName()
+			mangle.chains[countChainName] = countRules
+			for _, chain := range []string{"FORWARD", "INPUT", "OUTPUT"} {
+				mangle.jumps = append(mangle.jumps, iptablesJump{chain: chain, rule: "-j " + countChainName})
+			}
+		}
+
+		if len(b.dispatcher) != 0 {
+			chainName := b.dispatcherChainName()
+			rules := []string{}
+			for _, link := range b.dispatcher {
+				if _, ok := b.links[link.Chain]; !ok {
+					continue
+				}
+				for _, match := range linkMatches(link, "PREROUTING") {
+					rules = append(rules, match+" -j "+link.Chain, match+" -j RETURN")
+				}
+			}
+			mangle.chains[chainName] = rules
+			mangle.jumps = append(mangle.jumps, iptablesJump{chain: "PREROUTING", rule: "-j " + chainName})
+
+			// Смена метки в OUTPUT заставляет ядро заново выбрать маршрут для локального пакета
+			var localRules []string
+			for _, link := range b.dispatcher {
+				if _, ok := b.links[link.Chain]; !ok || !link.RouteLocal {
+					continue
+				}
+				for _, match := range linkMatches(link, "OUTPUT") {
+					localRules = append(localRules, match+" -j "+link.Chain, match+" -j RETURN")
+				}
+			}
+			if len(localRules) != 0 {
+				localChainName := b.localDispatcherChainName()
+				mangle.chains[localChainName] = localRules
+				mangle.jumps = append(mangle.jumps, iptablesJump{chain: "OUTPUT", rule: "-j " + localChainName})
+			}
+		}
+	}
+
+	setSuffix := "_4"
+	reject := "-j REJECT --reject-with icmp-port-unreachable"
+	if family.ipv6 {
+		setSuffix = "_6"
+		reject = "-j REJECT --reject-with icmp6-port-unreachable"
+	}
+
+	for _, spec := range b.remaps {
+		rules := []string{}
+		for _, addr := range spec.Addresses {
+			for _, proto := range []string{"tcp", "udp"} {
+				switch {
+				case !family.ipv6 && len(addr) == net.IPv4len:
+					rules = append(rules, fmt.Sprintf("-d %s/32 -p %s -m %s --dport %d -j REDIRECT --to-ports %d", addr, proto, proto, spec.From, spec.To))
+				case family.ipv6 && len(addr) == net.IPv6len:
+					rules = append(rules, fmt.Sprintf("-d %s/128 -p %s -m %s --dport %d -j DNAT --to-destination :%d", addr, proto, proto, spec.From, spec.To))
+				}
+			}
+		}
+		// Перехват идёт после адресов роутера, поэтому устройства-исключения по-прежнему
+		// попадают в прокси, когда обращаются к роутеру, а к своим серверам ходят напрямую
+		if len(spec.Interfaces) != 0 {
+			rules = append(rules, exemptRules(spec.ExemptSet, setSuffix, spec.ExemptMACs)...)
+		}
+		for _, ifaceName := range spec.Interfaces {
+			for _, proto := range []string{"tcp", "udp"} {
+				// REDIRECT подставляет адрес входящего интерфейса, DNAT без адреса оставил бы чужой сервер
+				rules = append(rules, fmt.Sprintf("-i %s -p %s -m %s --dport %d -j REDIRECT --to-ports %d", ifaceName, proto, proto, spec.From, spec.To))
+			}
+		}
+		nat.chains[spec.Chain] = rules
+		nat.jumps = append(nat.jumps, iptablesJump{chain: "PREROUTING", rule: "-j " + spec.Chain, insert: true})
+	}
+
+	for _, spec := range b.blocks {
+		rules := exemptRules(spec.ExemptSet, setSuffix, spec.ExemptMACs)
+		for _, port := range spec.Ports {
+			for _, proto := range []string{"tcp", "udp"} {
+				rules = append(rules, fmt.Sprintf("-p %s -m %s --dport %d %s", proto, proto, port, reject))
+			}
+		}
+		for _, port := range spec.SetPorts {
+			if spec.Set == "" {
+				break
+			}
+			for _, proto := range []string{"tcp", "udp"} {
+				rules = append(rules, fmt.Sprintf("-p %s -m set --match-set %s%s dst -m %s --dport %d %s", proto, spec.Set, setSuffix, proto, port, reject))
+			}
+		}
+		filter.chains[spec.Chain] = rules
+		// Запрет стоит первым, раньше разрешающих правил групп
+		for _, ifaceName := range spec.Interfaces {
+			filter.jumps = append(filter.jumps, iptablesJump{chain: "FORWARD", rule: "-i " + ifaceName + " -j " + spec.Chain, insert: true})
+		}
+	}
+
+	for _, rules := range tables {
+		slices.SortFunc(rules.jumps, func(a, b iptablesJump) int {
+			return strings.Compare(a.chain+" "+a.rule, b.chain+" "+b.rule)
+		})
+	}
+	return tables
+}
+
+// ruleTarget возвращает цель правила (-j или -g)
+func ruleTarget(rule string) string {
+	fields := strings.Fields(rule)
+	for idx := 0; idx < len(fields)-1; idx++ {
+		if fields[idx] == "-j" || fields[idx] == "-g" {
+			return fields[idx+1]
+		}
+	}
+	return ""
+}
+
+// parseIPTablesSave выбирает из вывода iptables-save цепочки MagiTrickle и переходы в них
+func parseIPTablesSave(data []byte, chainPrefix string) map[string]*iptablesRules {
+	tables := make(map[string]*iptablesRules)
+	var current *iptablesRules
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "*"):
+			current = newIPTablesRules()
+			tables[line[1:]] = current
+		case current == nil:
+		case strings.HasPrefix(line, ":"):
+			chain, _, _ := strings.Cut(line[1:], " ")
+			if strings.HasPrefix(chain, chainPrefix) {
+				current.chains[chain] = []string{}
+			}
+		case strings.HasPrefix(line, "-A "):
+			chain, rule, _ := strings.Cut(line[3:], " ")
+			if strings.HasPrefix(chain, chainPrefix) {
+				current.chains[chain] = append(current.chains[chain], rule)
+			} else if strings.HasPrefix(ruleTarget(rule), chainPrefix) {
+				current.jumps = append(current.jumps, iptablesJump{chain: chain, rule: rule})
+			}
+		}
+	}
+	return tables
+}
+
+// restoreScript возвращает скрипт iptables-restore --noflush, приводящий текущие правила
+// к желаемым, или пустую строку, если изменений нет.
+//
+// Объявление существующей цепочки в режиме --noflush очищает её, поэтому изменившиеся
+// цепочки объявляются и заполняются заново, а лишние – очищаются и удаляются.
+func restoreScript(current, desired map[string]*iptablesRules) string {
+	var script strings.Builder
+	for _, table := range iptablesTables {
+		want := desired[table]
+		have := current[table]
+		if have == nil {
+			have = newIPTablesRules()
+		}
+
+		var declare, deleteJumps, rules, addJumps, remove []string
+
+		for _, chain := range sortedKeys(want.chains) {
+			haveRules, exists := have.chains[chain]
+			if exists && slices.Equal(haveRules, want.chains[chain]) {
+				continue
+			}
+			declare = append(declare, ":"+chain+" - [0:0]")
+			for _, rule := range want.chains[chain] {
+				rules = append(rules, "-A "+chain+" "+rule)
+			}
+		}
+		for _, chain := range sortedKeys(have.chains) {
+			if _, ok := want.chains[chain]; ok {
+				continue
+			}
+			declare = append(declare, ":"+chain+" - [0:0]")
+			remove = append(remove, "-X "+chain)
+		}
+
+		// Переходы сравниваются с учётом повторов, лишние копии удаляются
+		wanted := make(map[iptablesJump]int)
+		for _, jump := range want.jumps {
+			wanted[iptablesJump{chain: jump.chain, rule: jump.rule}]++
+		}
+		for _, jump := range have.jumps {
+			if wanted[jump] > 0 {
+				wanted[jump]--
+				continue
+			}
+			deleteJumps = append(deleteJumps, "-D "+jump.chain+" "+jump.rule)
+		}
+		for _, jump := range want.jumps {
+			key := iptablesJump{chain: jump.chain, rule: jump.rule}
+			if wanted[key] == 0 {
+				continue
+			}
+			wanted[key]--
+			if jump.insert {
+				addJumps = append(addJumps, "-I "+jump.chain+" 1 "+jump.rule)
+			} else {
+				addJumps = append(addJumps, "-A "+jump.chain+" "+jump.rule)
+			}
+		}
+
+		if len(declare)+len(deleteJumps)+len(addJumps) == 0 {
+			continue
+		}
+		script.WriteString("*" + table + "\n")
+		for _, lines := range [][]string{declare, deleteJumps, rules, addJumps, remove} {
+			for _, line := range lines {
+				script.WriteString(line + "\n")
+			}
+		}
+		script.WriteString("COMMIT\n")
+	}
+	return script.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// apply сверяет правила семейств с желаемыми и применяет разницу, а внутри пачки
+// откладывает это до её закрытия. Пустой iptType означает все семейства.
+func (b *IPTablesBackend) apply(iptType string) error {
+	if b.batchDepth > 0 {
+		if b.pending == nil {
+			b.pending = make(map[string]struct{})
+		}
+		b.pending[iptType] = struct{}{}
+		return nil
+	}
+	_, err := b.sync(iptType)
+	return err
+}
+
+// applyPending применяет изменения, отложенные в пачке
+func (b *IPTablesBackend) applyPending() error {
+	pending := b.pending
+	b.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	if _, all := pending[""]; all {
+		_, err := b.sync("")
+		return err
+	}
+	var errs []error
+	for _, family := range b.families {
+		if _, ok := pending[family.name]; ok {
+			_, err := b.sync(family.name)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BeginRules открывает пачку: изменения правил запоминаются и применяются
+// одним вызовом iptables-restore на семейство при закрытии последней пачки
+func (b *IPTablesBackend) BeginRules() {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.batchDepth++
+}
+
+// CommitRules закрывает пачку и, если она была последней, применяет отложенные изменения
+func (b *IPTablesBackend) CommitRules() error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	if b.batchDepth > 0 {
+		b.batchDepth--
+	}
+	if b.batchDepth > 0 {
+		return nil
+	}
+	return b.applyPending()
+}
+
+// sync применяет разницу и сообщает, отличались ли правила от желаемых
+func (b *IPTablesBackend) sync(iptType string) (bool, error) {
+	changed := false
+	var errs []error
+	for _, family := range b.families {
+		if iptType != "" && iptType != family.name {
+			continue
+		}
+		out, err := b.run("", family.save)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read rules: %w", err))
+			continue
+		}
+		script := restoreScript(parseIPTablesSave(out, b.ChainPrefix), b.desiredRules(family))
+		if script == "" {
+			continue
+		}
+		changed = true
+		args := []string{"--noflush"}
+		if family.wait {
+			args = append([]string{"-w"}, args...)
+		}
+		if _, err = b.run(script, family.restore, args...); err != nil {
+			errs = append(errs, fmt.Errorf("failed to apply rules: %w", err))
+		}
+	}
+	return changed, errors.Join(errs...)
+}
+
+// InsertLink добавляет правила группы. После сброса правил прошивкой (хук netfilter.d)
+// восстанавливаются все правила семейства, поэтому таблица не учитывается.
+func (b *IPTablesBackend) InsertLink(spec LinkSpec, iptType, table string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.links[spec.Chain] = spec
+	return b.apply(iptType)
+}
+
+func (b *IPTablesBackend) UpdateLink(old, spec LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.links, old.Chain)
+	b.links[spec.Chain] = spec
+	return b.apply("")
+}
+
+func (b *IPTablesBackend) DeleteLink(spec LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.links, spec.Chain)
+	return b.apply("")
+}
+
+func (b *IPTablesBackend) dispatcherChainName() string {
+	return b.ChainPrefix + "ROUTE"
+}
+
+// localDispatcherChainName – цепочка в mangle OUTPUT для групп, маршрутизирующих трафик роутера
+func (b *IPTablesBackend) localDispatcherChainName() string {
+	return b.ChainPrefix + "ROUTE_LOCAL"
+}
+
+// countChainName – цепочка в mangle FORWARD, INPUT и OUTPUT со счётчиками трафика групп
+func (b *IPTablesBackend) countChainName() string {
+	return b.ChainPrefix + "COUNT"
+}
+
+// connmarkMatch возвращает условие на метку соединения так, как его выводит iptables-save
+func connmarkMatch(mark, mask uint32) string {
+	if mask == 0xffffffff {
+		return fmt.Sprintf("-m connmark --mark 0x%x", mark)
+	}
+	return fmt.Sprintf("-m connmark --mark 0x%x/0x%x", mark, mask)
+}
+
+// countRule – правило без цели, которое только считает пакеты одного направления группы
+type countRule struct {
+	chain string
+	reply bool
+}
+
+// countRuleSet возвращает правила подсчёта трафика групп. Группа определяется по метке
+// соединения, поэтому учитываются и ответные пакеты, и группы с любыми условиями.
+func (b *IPTablesBackend) countRuleSet() map[string]countRule {
+	rules := make(map[string]countRule)
+	for chain, spec := range b.links {
+		if spec.Mark == 0 {
+			continue
+		}
+		match := connmarkMatch(spec.Mark, spec.markMask())
+		rules[match+" -m conntrack --ctdir ORIGINAL"] = countRule{chain: chain}
+		rules[match+" -m conntrack --ctdir REPLY"] = countRule{chain: chain, reply: true}
+	}
+	return rules
+}
+
+func (b *IPTablesBackend) countRules() []string {
+	return sortedKeys(b.countRuleSet())
+}
+
+// LinkCounters читает счётчики правил подсчёта из iptables-save -c. Правила пересоздаются
+// при изменении групп, поэтому счётчики могут начаться заново.
+func (b *IPTablesBackend) LinkCounters() (map[string]LinkCounters, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	rules := b.countRuleSet()
+	counters := make(map[string]LinkCounters)
+	for _, family := range b.families {
+		// TODO: IPv6
+		if family.ipv6 {
+			continue
+		}
+		out, err := b.run("", family.save, "-c", "-t", "mangle")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read counters: %w", err)
+		}
+		for rule, value := range parseIPTablesCounters(out, b.countChainName()) {
+			countRule, ok := rules[rule]
+			if !ok {
+				continue
+			}
+			linkCounters := counters[countRule.chain]
+			if countRule.reply {
+				linkCounters.RxPackets += value.packets
+				linkCounters.RxBytes += value.bytes
+			} else {
+				linkCounters.TxPackets += value.packets
+				linkCounters.TxBytes += value.bytes
+			}
+			counters[countRule.chain] = linkCounters
+		}
+	}
+	return counters, nil
+}
+
+type ruleCounter struct {
+	packets uint64
+	bytes   uint64
+}
+
+// parseIPTablesCounters разбирает строки вида "[пакеты:байты] -A цепочка правило"
+func parseIPTablesCounters(data []byte, chain string) map[string]ruleCounter {
+	counters := make(map[string]ruleCounter)
+	prefix := "-A " + chain + " "
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		value, rule, ok := strings.Cut(line[1:], "] ")
+		if !ok || !strings.HasPrefix(rule, prefix) {
+			continue
+		}
+		var counter ruleCounter
+		if _, err := fmt.Sscanf(value, "%d:%d", &counter.packets, &counter.bytes); err != nil {
+			continue
+		}
+		counters[strings.TrimPrefix(rule, prefix)] = counter
+	}
+	return counters
+}
+
+// SyncDispatcher пересобирает цепочку-диспетчер из зарегистрированных связок
+func (b *IPTablesBackend) SyncDispatcher(links []LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.dispatcher = slices.Clone(links)
+	return b.apply("")
+}
+
+func (b *IPTablesBackend) InsertRemap(spec RemapSpec, iptType, table string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.remaps[spec.Chain] = spec
+	return b.apply(iptType)
+}
+
+func (b *IPTablesBackend) DeleteRemap(spec RemapSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.remaps, spec.Chain)
+	return b.apply("")
+}
+
+func (b *IPTablesBackend) InsertBlock(spec BlockSpec, iptType, table string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.blocks[spec.Chain] = spec
+	return b.apply(iptType)
+}
+
+func (b *IPTablesBackend) DeleteBlock(spec BlockSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.blocks, spec.Chain)
+	return b.apply("")
+}
+
+// Reconcile приводит правила всех семейств к желаемым, например после сброса таблиц прошивкой
+func (b *IPTablesBackend) Reconcile() (bool, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	return b.sync("")
+}
+
+// Clean удаляет все цепочки с префиксом MagiTrickle и переходы в них
+func (b *IPTablesBackend) Clean() error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.links = make(map[string]LinkSpec)
+	b.dispatcher = nil
+	b.remaps = make(map[string]RemapSpec)
+	b.blocks = make(map[string]BlockSpec)
+	return b.apply("")
+}
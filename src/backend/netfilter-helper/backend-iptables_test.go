@@ -0,0 +1,298 @@
+package netfilterHelper
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testIPTablesSave = `# Generated by iptables-save
+*mangle
+:PREROUTING ACCEPT [0:0]
+:MT_ROUTE - [0:0]
+:MT_a - [0:0]
+:MT_stale - [0:0]
+-A PREROUTING -j MT_ROUTE
+-A PREROUTING -j MT_ROUTE
+-A PREROUTING -j _NDM_HOTSPOT_PRERT
+-A MT_ROUTE -m set --match-set mt_a_4 dst -j MT_a
+-A MT_ROUTE -m set --match-set mt_a_4 dst -j RETURN
+-A MT_a -j MARK --set-xmark 0x1/0xffffffff
+-A MT_a -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+-A POSTROUTING -o ppp0 -j MASQUERADE
+COMMIT
+`
+
+func newTestIPTables(save string) (*IPTablesBackend, *[]string) {
+	var scripts []string
+	b := &IPTablesBackend{
+		ChainPrefix: "MT_",
+		families:    []iptablesFamily{{name: "iptables", save: "iptables-save", restore: "iptables-restore"}},
+		links:       make(map[string]LinkSpec),
+		remaps:      make(map[string]RemapSpec),
+		blocks:      make(map[string]BlockSpec),
+		run: func(stdin, name string, args ...string) ([]byte, error) {
+			if name == "iptables-save" {
+				return []byte(save), nil
+			}
+			scripts = append(scripts, stdin)
+			return nil, nil
+		},
+	}
+	return b, &scripts
+}
+
+func TestParseIPTablesSave(t *testing.T) {
+	tables := parseIPTablesSave([]byte(testIPTablesSave), "MT_")
+
+	mangle := tables["mangle"]
+	if len(mangle.chains) != 3 || len(mangle.chains["MT_a"]) != 2 || len(mangle.chains["MT_stale"]) != 0 {
+		t.Fatalf("unexpected chains %+v", mangle.chains)
+	}
+	if len(mangle.jumps) != 2 {
+		t.Fatalf("only jumps to own chains should be collected: %+v", mangle.jumps)
+	}
+	if len(tables["nat"].chains) != 0 || len(tables["nat"].jumps) != 0 {
+		t.Fatalf("foreign rules should be ignored: %+v", tables["nat"])
+	}
+}
+
+func TestIPTables_ApplyDiff(t *testing.T) {
+	b, scripts := newTestIPTables(testIPTablesSave)
+	b.links["MT_a"] = LinkSpec{Chain: "MT_a", Set: "mt_a", Mark: 1, OutInterfaces: []string{"nwg0"}}
+	b.dispatcher = []LinkSpec{b.links["MT_a"]}
+
+	if err := b.apply(""); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 1 {
+		t.Fatalf("expected one restore call, got %d", len(*scripts))
+	}
+	script := (*scripts)[0]
+
+	for _, line := range []string{
+		// Дубликат перехода удаляется, лишняя цепочка очищается и удаляется
+		"-D PREROUTING -j MT_ROUTE",
+		":MT_stale - [0:0]",
+		"-X MT_stale",
+		// Недостающие цепочки создаются вместе с переходами
+		":MT_a - [0:0]\n-A MT_a -o nwg0 -j ACCEPT",
+		"-A FORWARD -m set --match-set mt_a_4 dst -j MT_a",
+		"-A MT_a -j MASQUERADE",
+		"-A POSTROUTING -m set --match-set mt_a_4 dst -j MT_a",
+	} {
+		if !strings.Contains(script, line) {
+			t.Errorf("script should contain %q:\n%s", line, script)
+		}
+	}
+	for _, line := range []string{"-A MT_a -j MARK", "-A MT_ROUTE", "_NDM_HOTSPOT_PRERT"} {
+		if strings.Contains(script, line) {
+			t.Errorf("unchanged or foreign rule %q should not be touched:\n%s", line, script)
+		}
+	}
+}
+
+func TestIPTables_Batch(t *testing.T) {
+	b, scripts := newTestIPTables(testIPTablesSave)
+	var calls []string
+	run := b.run
+	b.run = func(stdin, name string, args ...string) ([]byte, error) {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		return run(stdin, name, args...)
+	}
+
+	b.BeginRules()
+	b.BeginRules()
+	spec := LinkSpec{Chain: "MT_a", Set: "mt_a", Mark: 1, OutInterfaces: []string{"nwg0"}}
+	if err := b.InsertLink(spec, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SyncDispatcher([]LinkSpec{spec}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CommitRules(); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("nested batch should not apply rules: %q", calls)
+	}
+
+	if err := b.CommitRules(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(calls, []string{"iptables-save ", "iptables-restore --noflush"}) {
+		t.Fatalf("batch should be applied by one save and restore: %q", calls)
+	}
+	if !strings.Contains((*scripts)[0], "-A FORWARD -m set --match-set mt_a_4 dst -j MT_a") {
+		t.Errorf("batch should contain link rules:\n%s", (*scripts)[0])
+	}
+
+	b.families[0].wait = true
+	if err := b.DeleteLink(spec); err != nil {
+		t.Fatal(err)
+	}
+	if calls[len(calls)-1] != "iptables-restore -w --noflush" {
+		t.Errorf("-w should be passed when supported: %q", calls)
+	}
+}
+
+func TestIPTables_NoChanges(t *testing.T) {
+	b, scripts := newTestIPTables(`*mangle
+:PREROUTING ACCEPT [0:0]
+:MT_DNSOR - [0:0]
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+:MT_DNSOR - [0:0]
+-A PREROUTING -j MT_DNSOR
+-A MT_DNSOR -d 192.168.1.1/32 -p tcp -m tcp --dport 53 -j REDIRECT --to-ports 3553
+-A MT_DNSOR -d 192.168.1.1/32 -p udp -m udp --dport 53 -j REDIRECT --to-ports 3553
+COMMIT
+`)
+	if err := b.InsertRemap(RemapSpec{Chain: "MT_DNSOR", Addresses: []net.IP{net.IPv4(192, 168, 1, 1).To4()}, From: 53, To: 3553}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 1 || strings.Contains((*scripts)[0], "*nat") || !strings.Contains((*scripts)[0], "-X MT_DNSOR") {
+		t.Fatalf("only the stray mangle chain should be removed: %q", *scripts)
+	}
+}
+
+func TestIPTables_RouteLocal(t *testing.T) {
+	b, _ := newTestIPTables("")
+	b.links["MT_a"] = LinkSpec{Chain: "MT_a", Set: "mt_a", Mark: 1, OutInterfaces: []string{"nwg0"}, RouteLocal: true}
+	b.links["MT_b"] = LinkSpec{Chain: "MT_b", Set: "mt_b", Mark: 2, OutInterfaces: []string{"nwg1"}}
+	b.dispatcher = []LinkSpec{b.links["MT_a"], b.links["MT_b"]}
+
+	mangle := b.desiredRules(b.families[0])["mangle"]
+	local := mangle.chains["MT_ROUTE_LOCAL"]
+	if len(local) != 2 || local[0] != "-m set --match-set mt_a_4 dst -j MT_a" {
+		t.Fatalf("only the local group should be in the output dispatcher: %q", local)
+	}
+	if len(mangle.chains["MT_ROUTE"]) != 4 {
+		t.Fatalf("both groups should be in the prerouting dispatcher: %q", mangle.chains["MT_ROUTE"])
+	}
+	if !slices.Contains(mangle.jumps, iptablesJump{chain: "OUTPUT", rule: "-j MT_ROUTE_LOCAL"}) {
+		t.Fatalf("output dispatcher should be hooked into OUTPUT: %+v", mangle.jumps)
+	}
+}
+
+func TestIPTables_DispatcherFallsThrough(t *testing.T) {
+	b, _ := newTestIPTables("")
+	web := LinkSpec{Chain: "MT_web", Set: "mt_web", Mark: 0x10000, Ports: []PortRange{{Protocol: "tcp", From: 443, To: 443}}}
+	global := LinkSpec{Chain: "MT_all", Set: "mt_all", Mark: 0x20000}
+	b.links[web.Chain], b.links[global.Chain] = web, global
+	b.dispatcher = []LinkSpec{web, global}
+
+	// Пакет к другому порту не подходит под RETURN ограниченной группы и доходит до общей
+	rules := b.desiredRules(b.families[0])["mangle"].chains["MT_ROUTE"]
+	want := []string{
+		"-p tcp -m set --match-set mt_web_4 dst -m tcp --dport 443 -j MT_web",
+		"-p tcp -m set --match-set mt_web_4 dst -m tcp --dport 443 -j RETURN",
+		"-m set --match-set mt_all_4 dst -j MT_all",
+		"-m set --match-set mt_all_4 dst -j RETURN",
+	}
+	if !slices.Equal(rules, want) {
+		t.Fatalf("unexpected dispatcher rules: %q", rules)
+	}
+}
+
+func TestIPTables_DNSHijack(t *testing.T) {
+	b, _ := newTestIPTables("")
+	b.remaps["MT_DNSOR"] = RemapSpec{
+		Chain:      "MT_DNSOR",
+		Addresses:  []net.IP{net.IPv4(192, 168, 1, 1).To4()},
+		Interfaces: []string{"br0"},
+		ExemptSet:  "mt_dnsexempt",
+		From:       53,
+		To:         3553,
+	}
+	b.blocks["MT_DNSBLOCK"] = BlockSpec{
+		Chain:      "MT_DNSBLOCK",
+		Interfaces: []string{"br0"},
+		ExemptSet:  "mt_dnsexempt",
+		Ports:      []uint16{853},
+		Set:        "mt_doh",
+		SetPorts:   []uint16{443},
+	}
+
+	tables := b.desiredRules(b.families[0])
+	remap := tables["nat"].chains["MT_DNSOR"]
+	if len(remap) != 5 || remap[2] != "-m set --match-set mt_dnsexempt_4 src -j RETURN" ||
+		remap[3] != "-i br0 -p tcp -m tcp --dport 53 -j REDIRECT --to-ports 3553" {
+		t.Fatalf("exempt clients should only skip the hijack of foreign resolvers: %q", remap)
+	}
+	block := tables["filter"].chains["MT_DNSBLOCK"]
+	if len(block) != 5 || block[1] != "-p tcp -m tcp --dport 853 -j REJECT --reject-with icmp-port-unreachable" ||
+		block[3] != "-p tcp -m set --match-set mt_doh_4 dst -m tcp --dport 443 -j REJECT --reject-with icmp-port-unreachable" {
+		t.Fatalf("unexpected block rules: %q", block)
+	}
+	if !slices.Contains(tables["filter"].jumps, iptablesJump{chain: "FORWARD", rule: "-i br0 -j MT_DNSBLOCK", insert: true}) {
+		t.Fatalf("block should be hooked into FORWARD: %+v", tables["filter"].jumps)
+	}
+}
+
+func TestIPTables_LinkCounters(t *testing.T) {
+	b, _ := newTestIPTables(`*mangle
+:PREROUTING ACCEPT [100:10000]
+:MT_COUNT - [0:0]
+[12:3400] -A FORWARD -j MT_COUNT
+[3:300] -A MT_COUNT -m connmark --mark 0x10000/0xff0000 -m conntrack --ctdir ORIGINAL
+[5:5000] -A MT_COUNT -m connmark --mark 0x10000/0xff0000 -m conntrack --ctdir REPLY
+[4:400] -A MT_COUNT -m connmark --mark 0x20000/0xff0000 -m conntrack --ctdir ORIGINAL
+COMMIT
+`)
+	b.links["MT_a"] = LinkSpec{Chain: "MT_a", Set: "mt_a", Mark: 0x10000, MarkMask: 0xff0000}
+
+	mangle := b.desiredRules(b.families[0])["mangle"]
+	if rules := mangle.chains["MT_COUNT"]; len(rules) != 2 {
+		t.Fatalf("every group should have a rule per direction: %q", rules)
+	}
+	if !slices.Contains(mangle.jumps, iptablesJump{chain: "OUTPUT", rule: "-j MT_COUNT"}) {
+		t.Fatalf("traffic of the router itself should be counted: %+v", mangle.jumps)
+	}
+	ipv6 := iptablesFamily{name: "ip6tables", save: "ip6tables-save", restore: "ip6tables-restore", ipv6: true}
+	if mangle := b.desiredRules(ipv6)["mangle"]; len(mangle.chains["MT_COUNT"]) != 0 || len(mangle.jumps) != 0 {
+		t.Fatalf("IPv6 is not marked by groups and should not be counted: %+v", mangle)
+	}
+	counters, err := b.LinkCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != 1 || counters["MT_a"] != (LinkCounters{TxPackets: 3, TxBytes: 300, RxPackets: 5, RxBytes: 5000}) {
+		t.Errorf("unexpected counters: %+v", counters)
+	}
+}
+
+func TestLinkMatches(t *testing.T) {
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	macs := []net.HardwareAddr{mac}
+	for _, tc := range []struct {
+		spec  LinkSpec
+		chain string
+		want  []string
+	}{
+		{LinkSpec{Set: "mt_a"}, "PREROUTING", []string{"-m set --match-set mt_a_4 dst"}},
+		{LinkSpec{Set: "mt_a", ClientSet: "mt_a_c"}, "PREROUTING", []string{"-m set --match-set mt_a_4 dst -m set --match-set mt_a_c_4 src"}},
+		{LinkSpec{Set: "mt_a", ClientSet: "mt_a_c", Source: true}, "PREROUTING", []string{"-m set --match-set mt_a_c_4 src -m set ! --match-set mt_a_4 dst"}},
+		{LinkSpec{Set: "mt_a", ClientMACs: macs}, "FORWARD", []string{"-m set --match-set mt_a_4 dst -m mac --mac-source AA:BB:CC:DD:EE:FF"}},
+		{LinkSpec{Set: "mt_a", ClientMACs: macs, Mark: 0x10000, MarkMask: 0xff0000}, "POSTROUTING", []string{"-m set --match-set mt_a_4 dst -m mark --mark 0x10000/0xff0000"}},
+		{LinkSpec{Set: "mt_a", ClientMACs: macs}, "OUTPUT", nil},
+		{LinkSpec{Set: "mt_a", ClientSet: "mt_a_c", ClientMACs: macs, Source: true}, "PREROUTING", []string{
+			"-m set --match-set mt_a_c_4 src -m set ! --match-set mt_a_4 dst",
+			"-m mac --mac-source AA:BB:CC:DD:EE:FF -m set ! --match-set mt_a_4 dst",
+		}},
+		{LinkSpec{Set: "mt_a", Ports: []PortRange{{Protocol: "tcp", From: 443, To: 443}, {Protocol: "udp", From: 8000, To: 8100}}}, "PREROUTING", []string{
+			"-p tcp -m set --match-set mt_a_4 dst -m tcp --dport 443",
+			"-p udp -m set --match-set mt_a_4 dst -m udp --dport 8000:8100",
+		}},
+	} {
+		if got := linkMatches(tc.spec, tc.chain); !slices.Equal(got, tc.want) {
+			t.Errorf("linkMatches(%+v, %s) = %q, want %q", tc.spec, tc.chain, got, tc.want)
+		}
+	}
+}
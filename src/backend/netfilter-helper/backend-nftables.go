@@ -0,0 +1,1006 @@
+package netfilterHelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Приоритеты базовых цепочек, аналогичные таблицам iptables
+const (
+	nftPriorityMangle = -150
+	nftPriorityDSTNAT = -101 // раньше стандартного dstnat, как вставка в начало PREROUTING
+	nftPriorityFilter = 0
+	nftPrioritySRCNAT = 100
+)
+
+const nftTableName = "magitrickle"
+
+// NFTablesBackend работает через утилиту nft. Все правила и наборы находятся в одной
+// таблице inet, каждое изменение применяется одной атомарной транзакцией `nft -f -`.
+// Изменения наборов внутри пачки (один ответ DNS, синхронизация групп) объединяются
+// в одну транзакцию, чтобы не запускать nft на каждый адрес.
+//
+// Адреса и подсети хранятся в разных наборах: наборы с интервалами не допускают
+// пересечений, а адрес из DNS может попасть внутрь статической подсети.
+type NFTablesBackend struct {
+	ChainPrefix string
+	Table       string
+	DisableIPv4 bool
+	DisableIPv6 bool
+
+	// Желаемое состояние нужно, чтобы восстановить таблицу, если её удалили извне
+	locker     sync.Mutex
+	sets       map[string]struct{}
+	links      map[string]LinkSpec
+	dispatcher []LinkSpec
+	remaps     map[string]RemapSpec
+	blocks     map[string]BlockSpec
+
+	// Изменения наборов, накопленные в открытых пачках (см. BeginSetEntries)
+	batchLocker sync.Mutex
+	batchDepth  int
+	batch       []string
+
+	// Изменения правил, отложенные до закрытия пачки (см. BeginRules)
+	rulesDepth   int
+	pendingRules []string
+
+	run func(stdin string, args ...string) ([]byte, error)
+}
+
+func NewNFTablesBackend(chainPrefix string, disableIPv4, disableIPv6 bool) (*NFTablesBackend, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, fmt.Errorf("nft init fail: %w", err)
+	}
+	return &NFTablesBackend{
+		ChainPrefix: chainPrefix,
+		Table:       nftTableName,
+		DisableIPv4: disableIPv4,
+		DisableIPv6: disableIPv6,
+		sets:        make(map[string]struct{}),
+		links:       make(map[string]LinkSpec),
+		remaps:      make(map[string]RemapSpec),
+		blocks:      make(map[string]BlockSpec),
+		run:         runNFT,
+	}, nil
+}
+
+func runNFT(stdin string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("nft", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("nft %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// apply выполняет команды одной транзакцией, таблица создаётся при необходимости
+func (b *NFTablesBackend) apply(commands ...string) error {
+	script := "add table inet " + b.Table + "\n" + strings.Join(commands, "\n") + "\n"
+	_, err := b.run(script, "-f", "-")
+	return err
+}
+
+func (b *NFTablesBackend) object(name string) string {
+	return "inet " + b.Table + " " + name
+}
+
+// applyRules применяет изменения правил, а внутри пачки откладывает их до её закрытия
+func (b *NFTablesBackend) applyRules(commands ...string) error {
+	if b.rulesDepth > 0 {
+		b.pendingRules = append(b.pendingRules, commands...)
+		return nil
+	}
+	return b.apply(commands...)
+}
+
+// applyPendingRules применяет изменения правил, отложенные в пачке
+func (b *NFTablesBackend) applyPendingRules() error {
+	commands := b.pendingRules
+	b.pendingRules = nil
+	if len(commands) == 0 {
+		return nil
+	}
+	return b.apply(commands...)
+}
+
+// BeginRules открывает пачку: изменения правил копятся и применяются
+// одной транзакцией при закрытии последней пачки
+func (b *NFTablesBackend) BeginRules() {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.rulesDepth++
+}
+
+// CommitRules закрывает пачку и, если она была последней, применяет отложенные изменения
+func (b *NFTablesBackend) CommitRules() error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	if b.rulesDepth > 0 {
+		b.rulesDepth--
+	}
+	if b.rulesDepth > 0 {
+		return nil
+	}
+	return b.applyPendingRules()
+}
+
+// ensureChain создаёт пустую обычную или базовую (если задан hook) цепочку
+func (b *NFTablesBackend) ensureChain(name, hook string) []string {
+	chain := "add chain " + b.object(name)
+	if hook != "" {
+		chain += " { " + hook + "; policy accept; }"
+	}
+	return []string{chain, "flush chain " + b.object(name)}
+}
+
+// dropChain удаляет цепочку, даже если её не было
+func (b *NFTablesBackend) dropChain(name string) []string {
+	return []string{
+		"add chain " + b.object(name),
+		"flush chain " + b.object(name),
+		"delete chain " + b.object(name),
+	}
+}
+
+type nftSet struct {
+	suffix string
+	family string
+	flags  string
+	bits   int
+}
+
+var nftSets = []nftSet{
+	{suffix: "_4", family: "ipv4_addr", flags: "timeout", bits: 32},
+	{suffix: "_6", family: "ipv6_addr", flags: "timeout", bits: 128},
+	{suffix: "_4n", family: "ipv4_addr", flags: "interval", bits: 32},
+	{suffix: "_6n", family: "ipv6_addr", flags: "interval", bits: 128},
+}
+
+func (s nftSet) definition() string {
+	return fmt.Sprintf("{ type %s; flags %s; }", s.family, s.flags)
+}
+
+// setFor возвращает набор для записи: адреса и подсети каждого семейства хранятся раздельно
+func setFor(name string, ipNet net.IPNet) (string, nftSet) {
+	_, bits := ipNet.Mask.Size()
+	for _, set := range nftSets {
+		if set.bits != bits || (set.flags == "interval") == isHostNet(ipNet) {
+			continue
+		}
+		return name + set.suffix, set
+	}
+	return name + nftSets[0].suffix, nftSets[0]
+}
+
+func nftElement(ipNet net.IPNet) string {
+	if isHostNet(ipNet) {
+		return ipNet.IP.String()
+	}
+	return ipNet.String()
+}
+
+func (b *NFTablesBackend) setCommands(name string) []string {
+	commands := make([]string, 0, len(nftSets))
+	for _, set := range nftSets {
+		commands = append(commands, "add set "+b.object(name+set.suffix)+" "+set.definition())
+	}
+	return commands
+}
+
+func (b *NFTablesBackend) CreateSet(name string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	if err := b.apply(b.setCommands(name)...); err != nil {
+		return fmt.Errorf("failed to create set: %w", err)
+	}
+	b.sets[name] = struct{}{}
+	return nil
+}
+
+func (b *NFTablesBackend) DestroySet(name string) error {
+	if err := b.flushSetEntries(); err != nil {
+		return err
+	}
+
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	// Набор нельзя удалить, пока на него ссылаются правила, отложенные в пачке
+	if err := b.applyPendingRules(); err != nil {
+		return fmt.Errorf("failed to apply rules: %w", err)
+	}
+
+	delete(b.sets, name)
+	commands := make([]string, 0, len(nftSets)*2)
+	for _, set := range nftSets {
+		commands = append(commands,
+			"add set "+b.object(name+set.suffix)+" "+set.definition(),
+			"delete set "+b.object(name+set.suffix),
+		)
+	}
+	if err := b.apply(commands...); err != nil {
+		return fmt.Errorf("failed to destroy sets: %w", err)
+	}
+	return nil
+}
+
+// BeginSetEntries открывает пачку: изменения наборов не применяются сразу,
+// а копятся до CommitSetEntries. Пачки могут быть открыты одновременно
+// из разных горутин, например при обработке нескольких ответов DNS.
+func (b *NFTablesBackend) BeginSetEntries() {
+	b.batchLocker.Lock()
+	defer b.batchLocker.Unlock()
+	b.batchDepth++
+}
+
+// CommitSetEntries закрывает пачку и применяет все накопленные изменения,
+// в том числе из ещё открытых пачек: к возврату изменения вызывающего
+// должны быть уже в наборах.
+func (b *NFTablesBackend) CommitSetEntries() error {
+	b.batchLocker.Lock()
+	defer b.batchLocker.Unlock()
+	if b.batchDepth > 0 {
+		b.batchDepth--
+	}
+	return b.applyBatch()
+}
+
+// flushSetEntries применяет накопленные изменения, не закрывая пачку. Вызывается
+// перед операциями, результат которых зависит от содержимого наборов.
+func (b *NFTablesBackend) flushSetEntries() error {
+	b.batchLocker.Lock()
+	defer b.batchLocker.Unlock()
+	return b.applyBatch()
+}
+
+func (b *NFTablesBackend) applyBatch() error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	commands := b.batch
+	b.batch = nil
+	if err := b.apply(commands...); err != nil {
+		return fmt.Errorf("failed to apply set entries: %w", err)
+	}
+	return nil
+}
+
+// applySetEntry применяет изменение набора сразу или откладывает его до конца пачки
+func (b *NFTablesBackend) applySetEntry(commands ...string) error {
+	b.batchLocker.Lock()
+	defer b.batchLocker.Unlock()
+	if b.batchDepth > 0 {
+		b.batch = append(b.batch, commands...)
+		return nil
+	}
+	return b.apply(commands...)
+}
+
+func (b *NFTablesBackend) AddSetEntry(name string, entry SetEntry) error {
+	setName, set := setFor(name, entry.Net)
+	element := nftElement(entry.Net)
+	if set.flags == "interval" {
+		return b.applySetEntry(fmt.Sprintf("add element %s { %s }", b.object(setName), element))
+	}
+
+	// add не обновляет таймаут существующей записи, поэтому запись пересоздаётся
+	// в той же транзакции
+	withTimeout := element
+	if entry.Timeout != nil && *entry.Timeout != 0 {
+		withTimeout = fmt.Sprintf("%s timeout %ds", element, *entry.Timeout)
+	}
+	return b.applySetEntry(
+		fmt.Sprintf("add element %s { %s }", b.object(setName), element),
+		fmt.Sprintf("delete element %s { %s }", b.object(setName), element),
+		fmt.Sprintf("add element %s { %s }", b.object(setName), withTimeout),
+	)
+}
+
+func (b *NFTablesBackend) DelSetEntry(name string, ipNet net.IPNet) error {
+	setName, set := setFor(name, ipNet)
+	element := nftElement(ipNet)
+	if set.flags == "interval" {
+		return b.applySetEntry(fmt.Sprintf("delete element %s { %s }", b.object(setName), element))
+	}
+	return b.applySetEntry(
+		fmt.Sprintf("add element %s { %s }", b.object(setName), element),
+		fmt.Sprintf("delete element %s { %s }", b.object(setName), element),
+	)
+}
+
+func (b *NFTablesBackend) ListSetEntries(name string) ([]SetEntry, error) {
+	if err := b.flushSetEntries(); err != nil {
+		return nil, err
+	}
+	var entries []SetEntry
+	for _, set := range nftSets {
+		out, err := b.run("", "-j", "list", "set", "inet", b.Table, name+set.suffix)
+		if err != nil {
+			return nil, err
+		}
+		setEntries, err := parseNFTSet(out, set.bits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse set %s: %w", name+set.suffix, err)
+		}
+		entries = append(entries, setEntries...)
+	}
+	return entries, nil
+}
+
+type nftJSONElem struct {
+	Val     json.RawMessage `json:"val"`
+	Expires *uint32         `json:"expires"`
+}
+
+type nftJSONPrefix struct {
+	Addr string `json:"addr"`
+	Len  int    `json:"len"`
+}
+
+type nftJSONValue struct {
+	Elem   *nftJSONElem   `json:"elem"`
+	Prefix *nftJSONPrefix `json:"prefix"`
+}
+
+// parseNFTSet разбирает вывод `nft -j list set`
+func parseNFTSet(data []byte, bits int) ([]SetEntry, error) {
+	var out struct {
+		Nftables []struct {
+			Set *struct {
+				Elem []json.RawMessage `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+
+	var entries []SetEntry
+	for _, object := range out.Nftables {
+		if object.Set == nil {
+			continue
+		}
+		for _, raw := range object.Set.Elem {
+			var timeout *uint32
+			var elem nftJSONValue
+			if err := json.Unmarshal(raw, &elem); err == nil && elem.Elem != nil {
+				timeout = elem.Elem.Expires
+				raw = elem.Elem.Val
+			}
+			ipNet, ok := parseNFTValue(raw, bits)
+			if !ok {
+				continue
+			}
+			entries = append(entries, SetEntry{Net: ipNet, Timeout: timeout})
+		}
+	}
+	return entries, nil
+}
+
+func parseNFTValue(raw json.RawMessage, bits int) (net.IPNet, bool) {
+	var addr string
+	if err := json.Unmarshal(raw, &addr); err == nil {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return net.IPNet{}, false
+		}
+		if bits == 32 {
+			ip = ip.To4()
+		}
+		return hostNet(ip), true
+	}
+
+	var value nftJSONValue
+	if err := json.Unmarshal(raw, &value); err != nil || value.Prefix == nil {
+		// Диапазоны не создаются MagiTrickle и пропускаются
+		return net.IPNet{}, false
+	}
+	ip := net.ParseIP(value.Prefix.Addr)
+	if ip == nil {
+		return net.IPNet{}, false
+	}
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(value.Prefix.Len, bits)}, true
+}
+
+func (b *NFTablesBackend) linkChains(spec LinkSpec) (mark, forward, nat string) {
+	return spec.Chain, spec.Chain + "_FWD", spec.Chain + "_NAT"
+}
+
+func (b *NFTablesBackend) linkCommands(spec LinkSpec) []string {
+	markChain, forwardChain, natChain := b.linkChains(spec)
+
+	commands := b.ensureChain(markChain, "")
+	// Биты вне маски принадлежат прошивке и другим пакетам, их нужно сохранить
+	keep := ^spec.markMask()
+	commands = append(commands, fmt.Sprintf("add rule %s meta mark set meta mark and 0x%x or 0x%x ct mark set ct mark and 0x%x or 0x%x",
+		b.object(markChain), keep, spec.Mark, keep, spec.Mark))
+
+	// Группа-исключение уходит через WAN, который уже разрешён и маскарадится системой
+	if spec.Bypass {
+		return commands
+	}
+
+	commands = append(commands, b.ensureChain(forwardChain, "")...)
+	for _, ifaceName := range spec.OutInterfaces {
+		if ifaceName == "" {
+			commands = append(commands, "add rule "+b.object(forwardChain)+" accept")
+		} else {
+			commands = append(commands, fmt.Sprintf("add rule %s oifname %q accept", b.object(forwardChain), ifaceName))
+		}
+	}
+	if spec.KillSwitch {
+		commands = append(commands, "add rule "+b.object(forwardChain)+" reject")
+	}
+
+	commands = append(commands, b.ensureChain(natChain, "")...)
+	commands = append(commands, "add rule "+b.object(natChain)+" masquerade")
+	return commands
+}
+
+// InsertLink пересобирает цепочки группы. Хук netfilter.d вызывается после перезагрузки
+// iptables прошивкой и таблицу nftables не затрагивает.
+func (b *NFTablesBackend) InsertLink(spec LinkSpec, iptType, table string) error {
+	if iptType != "" {
+		return nil
+	}
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.links[spec.Chain] = spec
+	return b.applyRules(b.linkCommands(spec)...)
+}
+
+func (b *NFTablesBackend) UpdateLink(old, spec LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.links, old.Chain)
+	b.links[spec.Chain] = spec
+	return b.applyRules(b.linkCommands(spec)...)
+}
+
+func (b *NFTablesBackend) DeleteLink(spec LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.links, spec.Chain)
+	markChain, forwardChain, natChain := b.linkChains(spec)
+	var commands []string
+	for _, chain := range []string{markChain, forwardChain, natChain} {
+		commands = append(commands, b.dropChain(chain)...)
+	}
+	return b.applyRules(commands...)
+}
+
+// SyncDispatcher пересобирает базовые цепочки, которые направляют пакеты в цепочки групп
+// в порядке приоритета. Цепочки групп создаются пустыми, если их ещё нет, поэтому
+// транзакция не зависит от порядка включения групп.
+func (b *NFTablesBackend) SyncDispatcher(links []LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.dispatcher = slices.Clone(links)
+	return b.applyRules(b.dispatcherCommands(links)...)
+}
+
+func (b *NFTablesBackend) dispatcherCommands(links []LinkSpec) []string {
+	routeChain := b.ChainPrefix + "ROUTE"
+	localChain := b.ChainPrefix + "ROUTE_LOCAL"
+	forwardChain := b.ChainPrefix + "FORWARD"
+	postroutingChain := b.ChainPrefix + "POSTROUTING"
+	countChain := b.countChainName()
+
+	if len(links) == 0 {
+		var commands []string
+		for _, chain := range []string{routeChain, localChain, forwardChain, postroutingChain} {
+			commands = append(commands, b.dropChain(chain)...)
+		}
+		return append(commands, b.dropCountChains()...)
+	}
+
+	var commands []string
+	commands = append(commands, b.ensureChain(routeChain, fmt.Sprintf("type filter hook prerouting priority %d", nftPriorityMangle))...)
+	commands = append(commands, b.ensureChain(forwardChain, fmt.Sprintf("type filter hook forward priority %d", nftPriorityFilter))...)
+	commands = append(commands, b.ensureChain(postroutingChain, fmt.Sprintf("type nat hook postrouting priority %d", nftPrioritySRCNAT))...)
+	// Цепочка типа route заставляет ядро заново выбрать маршрут, если метка локального пакета изменилась
+	if slices.ContainsFunc(links, func(link LinkSpec) bool { return link.RouteLocal }) && !b.DisableIPv4 {
+		commands = append(commands, b.ensureChain(localChain, fmt.Sprintf("type route hook output priority %d", nftPriorityMangle))...)
+	} else {
+		commands = append(commands, b.dropChain(localChain)...)
+	}
+
+	if b.DisableIPv4 {
+		return append(commands, b.dropCountChains()...)
+	}
+
+	// Группа определяется по метке соединения, поэтому учитываются и ответные пакеты.
+	// Комментарий связывает счётчик с группой при чтении. Правила лежат в обычной цепочке,
+	// в которую переходят транзит и соединения самого роутера.
+	commands = append(commands, b.ensureChain(countChain, "")...)
+	for _, link := range links {
+		if link.Mark == 0 {
+			continue
+		}
+		// TODO: IPv6
+		for _, direction := range []string{"original", "reply"} {
+			commands = append(commands, fmt.Sprintf("add rule %s meta nfproto ipv4 ct mark and 0x%x == 0x%x ct direction %s counter comment %q",
+				b.object(countChain), link.markMask(), link.Mark, direction, link.Chain+" "+direction))
+		}
+	}
+	for _, hook := range nftCountHooks {
+		hookChain := countChain + "_" + strings.ToUpper(hook)
+		commands = append(commands, b.ensureChain(hookChain, fmt.Sprintf("type filter hook %s priority %d", hook, nftPriorityMangle))...)
+		commands = append(commands, fmt.Sprintf("add rule %s jump %s", b.object(hookChain), countChain))
+	}
+
+	for _, link := range links {
+		markChain, linkForwardChain, linkNATChain := b.linkChains(link)
+		commands = append(commands, "add chain "+b.object(markChain))
+		if !link.Bypass {
+			commands = append(commands, "add chain "+b.object(linkForwardChain), "add chain "+b.object(linkNATChain))
+		}
+		// TODO: IPv6
+		for _, match := range nftLinkMatches(link, "prerouting") {
+			commands = append(commands,
+				fmt.Sprintf("add rule %s %s jump %s", b.object(routeChain), match, markChain),
+				fmt.Sprintf("add rule %s %s return", b.object(routeChain), match),
+			)
+		}
+		if link.RouteLocal {
+			for _, match := range nftLinkMatches(link, "output") {
+				commands = append(commands,
+					fmt.Sprintf("add rule %s %s jump %s", b.object(localChain), match, markChain),
+					fmt.Sprintf("add rule %s %s return", b.object(localChain), match),
+				)
+			}
+		}
+		if link.Bypass {
+			continue
+		}
+		for _, match := range nftLinkMatches(link, "forward") {
+			commands = append(commands, fmt.Sprintf("add rule %s %s jump %s", b.object(forwardChain), match, linkForwardChain))
+		}
+		for _, match := range nftLinkMatches(link, "postrouting") {
+			commands = append(commands, fmt.Sprintf("add rule %s %s jump %s", b.object(postroutingChain), match, linkNATChain))
+		}
+	}
+	return commands
+}
+
+// nftClientMatches возвращает условия на клиентов группы в хуке hook. MAC-адрес отправителя
+// виден только до маршрутизации: в postrouting такие клиенты узнаются по метке группы,
+// а в output (пакеты самого роутера) их нет.
+func nftClientMatches(link LinkSpec, hook string) []string {
+	var matches []string
+	if link.ClientSet != "" {
+		matches = append(matches, "ip saddr @"+link.ClientSet+"_4", "ip saddr @"+link.ClientSet+"_4n")
+	}
+	if len(link.ClientMACs) == 0 {
+		return matches
+	}
+	switch hook {
+	case "postrouting":
+		matches = append(matches, fmt.Sprintf("meta mark and 0x%x == 0x%x", link.markMask(), link.Mark))
+	case "output":
+	default:
+		for _, mac := range link.ClientMACs {
+			matches = append(matches, "ether saddr "+mac.String())
+		}
+	}
+	return matches
+}
+
+// nftLinkMatches возвращает условия, под которые попадают пакеты группы в хуке hook. Адреса
+// и подсети лежат в разных наборах, поэтому на каждую пару наборов нужно отдельное условие.
+func nftLinkMatches(link LinkSpec, hook string) []string {
+	var matches []string
+	clients := nftClientMatches(link, hook)
+	if link.Source {
+		for _, client := range clients {
+			matches = append(matches, fmt.Sprintf("%s ip daddr != @%s_4 ip daddr != @%s_4n", client, link.Set, link.Set))
+		}
+	} else {
+		for _, set := range []string{link.Set + "_4", link.Set + "_4n"} {
+			match := fmt.Sprintf("ip daddr @%s", set)
+			if link.ClientSet == "" && len(link.ClientMACs) == 0 {
+				matches = append(matches, match)
+				continue
+			}
+			for _, client := range clients {
+				matches = append(matches, fmt.Sprintf("%s %s", match, client))
+			}
+		}
+	}
+	if len(link.Ports) == 0 {
+		return matches
+	}
+
+	var portMatches []string
+	for _, match := range matches {
+		for _, ports := range link.Ports {
+			portMatches = append(portMatches, fmt.Sprintf("%s %s dport %s", match, ports.Protocol, ports.nftablesRange()))
+		}
+	}
+	return portMatches
+}
+
+// nftCountHooks – хуки, из которых пакеты попадают в цепочку счётчиков: транзит,
+// а также исходящие и ответные пакеты соединений самого роутера
+var nftCountHooks = []string{"forward", "input", "output"}
+
+func (b *NFTablesBackend) countChainName() string {
+	return b.ChainPrefix + "COUNT"
+}
+
+// dropCountChains удаляет цепочки хуков раньше цепочки счётчиков, в которую они переходят
+func (b *NFTablesBackend) dropCountChains() []string {
+	var commands []string
+	for _, hook := range nftCountHooks {
+		commands = append(commands, b.dropChain(b.countChainName()+"_"+strings.ToUpper(hook))...)
+	}
+	return append(commands, b.dropChain(b.countChainName())...)
+}
+
+// LinkCounters читает счётчики правил подсчёта. Цепочка пересобирается вместе с диспетчером,
+// поэтому счётчики могут начаться заново.
+func (b *NFTablesBackend) LinkCounters() (map[string]LinkCounters, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	counters := make(map[string]LinkCounters)
+	if len(b.dispatcher) == 0 || b.DisableIPv4 {
+		return counters, nil
+	}
+	out, err := b.run("", "-j", "list", "chain", "inet", b.Table, b.countChainName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read counters: %w", err)
+	}
+	return parseNFTCounters(out)
+}
+
+// parseNFTCounters собирает счётчики из вывода `nft -j list chain` по комментариям правил
+func parseNFTCounters(data []byte) (map[string]LinkCounters, error) {
+	var out struct {
+		Nftables []struct {
+			Rule *struct {
+				Comment string `json:"comment"`
+				Expr    []struct {
+					Counter *struct {
+						Packets uint64 `json:"packets"`
+						Bytes   uint64 `json:"bytes"`
+					} `json:"counter"`
+				} `json:"expr"`
+			} `json:"rule"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to parse counters: %w", err)
+	}
+
+	counters := make(map[string]LinkCounters)
+	for _, object := range out.Nftables {
+		if object.Rule == nil {
+			continue
+		}
+		chain, direction, ok := strings.Cut(object.Rule.Comment, " ")
+		if !ok {
+			continue
+		}
+		for _, expr := range object.Rule.Expr {
+			if expr.Counter == nil {
+				continue
+			}
+			linkCounters := counters[chain]
+			switch direction {
+			case "original":
+				linkCounters.TxPackets += expr.Counter.Packets
+				linkCounters.TxBytes += expr.Counter.Bytes
+			case "reply":
+				linkCounters.RxPackets += expr.Counter.Packets
+				linkCounters.RxBytes += expr.Counter.Bytes
+			}
+			counters[chain] = linkCounters
+		}
+	}
+	return counters, nil
+}
+
+func (b *NFTablesBackend) InsertRemap(spec RemapSpec, iptType, table string) error {
+	if iptType != "" {
+		return nil
+	}
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.remaps[spec.Chain] = spec
+	return b.applyRules(b.remapCommands(spec)...)
+}
+
+func (b *NFTablesBackend) remapCommands(spec RemapSpec) []string {
+	commands := b.ensureChain(spec.Chain, fmt.Sprintf("type nat hook prerouting priority %d", nftPriorityDSTNAT))
+	for _, addr := range spec.Addresses {
+		var match string
+		switch {
+		case len(addr) == net.IPv4len && !b.DisableIPv4:
+			match = "ip daddr " + addr.String()
+		case len(addr) == net.IPv6len && !b.DisableIPv6:
+			match = "ip6 daddr " + addr.String()
+		default:
+			continue
+		}
+		for _, proto := range []string{"tcp", "udp"} {
+			commands = append(commands, fmt.Sprintf("add rule %s %s %s dport %d redirect to :%d", b.object(spec.Chain), match, proto, spec.From, spec.To))
+		}
+	}
+	if len(spec.Interfaces) == 0 {
+		return commands
+	}
+
+	// Перехват идёт после адресов роутера, поэтому устройства-исключения по-прежнему
+	// попадают в прокси, когда обращаются к роутеру, а к своим серверам ходят напрямую
+	for _, match := range b.nftExemptMatches(spec.ExemptSet, spec.ExemptMACs) {
+		commands = append(commands, fmt.Sprintf("add rule %s %s return", b.object(spec.Chain), match))
+	}
+	for _, ifaceName := range spec.Interfaces {
+		for _, family := range b.nftFamilyMatches() {
+			for _, proto := range []string{"tcp", "udp"} {
+				commands = append(commands, fmt.Sprintf("add rule %s iifname %q %s%s dport %d redirect to :%d", b.object(spec.Chain), ifaceName, family, proto, spec.From, spec.To))
+			}
+		}
+	}
+	return commands
+}
+
+// nftFamilyMatches возвращает условия на семейство адресов. Если включены оба семейства,
+// правило подходит для любого пакета и условие не нужно.
+func (b *NFTablesBackend) nftFamilyMatches() []string {
+	switch {
+	case b.DisableIPv4 && b.DisableIPv6:
+		return nil
+	case b.DisableIPv6:
+		return []string{"meta nfproto ipv4 "}
+	case b.DisableIPv4:
+		return []string{"meta nfproto ipv6 "}
+	}
+	return []string{""}
+}
+
+// nftSourceMatches возвращает условия на адрес источника из набора, по одному на часть набора
+func (b *NFTablesBackend) nftSourceMatches(set string) []string {
+	var matches []string
+	if !b.DisableIPv4 {
+		matches = append(matches, "ip saddr @"+set+"_4", "ip saddr @"+set+"_4n")
+	}
+	if !b.DisableIPv6 {
+		matches = append(matches, "ip6 saddr @"+set+"_6", "ip6 saddr @"+set+"_6n")
+	}
+	return matches
+}
+
+// nftExemptMatches возвращает условия на устройства-исключения из набора и по MAC-адресам
+func (b *NFTablesBackend) nftExemptMatches(exemptSet string, macs []net.HardwareAddr) []string {
+	var matches []string
+	if exemptSet != "" {
+		matches = b.nftSourceMatches(exemptSet)
+	}
+	for _, mac := range macs {
+		matches = append(matches, "ether saddr "+mac.String())
+	}
+	return matches
+}
+
+func (b *NFTablesBackend) DeleteRemap(spec RemapSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.remaps, spec.Chain)
+	return b.applyRules(b.dropChain(spec.Chain)...)
+}
+
+func (b *NFTablesBackend) InsertBlock(spec BlockSpec, iptType, table string) error {
+	if iptType != "" {
+		return nil
+	}
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.blocks[spec.Chain] = spec
+	return b.applyRules(b.blockCommands(spec)...)
+}
+
+// blockCommands собирает базовую цепочку запрета. Accept в цепочках групп завершает
+// только их собственную базовую цепочку, поэтому запрет действует независимо от групп.
+func (b *NFTablesBackend) blockCommands(spec BlockSpec) []string {
+	commands := b.ensureChain(spec.Chain, fmt.Sprintf("type filter hook forward priority %d", nftPriorityFilter))
+	chain := b.object(spec.Chain)
+	for _, ifaceName := range spec.Interfaces {
+		match := fmt.Sprintf("iifname %q", ifaceName)
+		for _, source := range b.nftExemptMatches(spec.ExemptSet, spec.ExemptMACs) {
+			commands = append(commands, fmt.Sprintf("add rule %s %s %s return", chain, match, source))
+		}
+		for _, family := range b.nftFamilyMatches() {
+			for _, port := range spec.Ports {
+				for _, proto := range []string{"tcp", "udp"} {
+					commands = append(commands, fmt.Sprintf("add rule %s %s %s%s dport %d reject", chain, match, family, proto, port))
+				}
+			}
+		}
+		var destinations []string
+		if spec.Set == "" {
+			continue
+		}
+		if !b.DisableIPv4 {
+			destinations = append(destinations, "ip daddr @"+spec.Set+"_4", "ip daddr @"+spec.Set+"_4n")
+		}
+		if !b.DisableIPv6 {
+			destinations = append(destinations, "ip6 daddr @"+spec.Set+"_6", "ip6 daddr @"+spec.Set+"_6n")
+		}
+		for _, destination := range destinations {
+			for _, port := range spec.SetPorts {
+				for _, proto := range []string{"tcp", "udp"} {
+					commands = append(commands, fmt.Sprintf("add rule %s %s %s %s dport %d reject", chain, match, destination, proto, port))
+				}
+			}
+		}
+	}
+	return commands
+}
+
+func (b *NFTablesBackend) DeleteBlock(spec BlockSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.blocks, spec.Chain)
+	return b.applyRules(b.dropChain(spec.Chain)...)
+}
+
+// stateCommands собирает команды, создающие всё желаемое состояние с нуля
+func (b *NFTablesBackend) stateCommands() []string {
+	var commands []string
+	for _, name := range sortedKeys(b.sets) {
+		commands = append(commands, b.setCommands(name)...)
+	}
+	for _, chain := range sortedKeys(b.links) {
+		commands = append(commands, b.linkCommands(b.links[chain])...)
+	}
+	if len(b.dispatcher) != 0 {
+		commands = append(commands, b.dispatcherCommands(b.dispatcher)...)
+	}
+	for _, chain := range sortedKeys(b.remaps) {
+		commands = append(commands, b.remapCommands(b.remaps[chain])...)
+	}
+	for _, chain := range sortedKeys(b.blocks) {
+		commands = append(commands, b.blockCommands(b.blocks[chain])...)
+	}
+	return commands
+}
+
+// nftObjects – цепочки таблицы с числом правил и наборы
+type nftObjects struct {
+	chains map[string]int
+	sets   map[string]struct{}
+}
+
+// expectedObjects вычисляет, какие цепочки и наборы оставят команды в пустой таблице
+func (b *NFTablesBackend) expectedObjects(commands []string) nftObjects {
+	objects := nftObjects{chains: make(map[string]int), sets: make(map[string]struct{})}
+	for _, command := range commands {
+		fields := strings.Fields(command)
+		if len(fields) < 5 || fields[2] != "inet" || fields[3] != b.Table {
+			continue
+		}
+		name := fields[4]
+		switch fields[0] + " " + fields[1] {
+		case "add chain":
+			objects.chains[name] += 0
+		case "flush chain":
+			objects.chains[name] = 0
+		case "delete chain":
+			delete(objects.chains, name)
+		case "add rule":
+			objects.chains[name]++
+		case "add set":
+			objects.sets[name] = struct{}{}
+		}
+	}
+	return objects
+}
+
+// parseNFTTable разбирает вывод `nft -j list table`
+func parseNFTTable(data []byte) (nftObjects, error) {
+	var out struct {
+		Nftables []struct {
+			Chain *struct {
+				Name string `json:"name"`
+			} `json:"chain"`
+			Rule *struct {
+				Chain string `json:"chain"`
+			} `json:"rule"`
+			Set *struct {
+				Name string `json:"name"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nftObjects{}, err
+	}
+
+	objects := nftObjects{chains: make(map[string]int), sets: make(map[string]struct{})}
+	for _, object := range out.Nftables {
+		switch {
+		case object.Chain != nil:
+			objects.chains[object.Chain.Name] += 0
+		case object.Rule != nil:
+			objects.chains[object.Rule.Chain]++
+		case object.Set != nil:
+			objects.sets[object.Set.Name] = struct{}{}
+		}
+	}
+	return objects, nil
+}
+
+// Reconcile проверяет, что таблица содержит все цепочки с ожидаемым числом правил и все
+// наборы. Если таблицу удалили или изменили, она пересобирается одной транзакцией.
+func (b *NFTablesBackend) Reconcile() (bool, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	commands := b.stateCommands()
+	expected := b.expectedObjects(commands)
+
+	out, err := b.run("", "-j", "list", "table", "inet", b.Table)
+	if err == nil {
+		current, parseErr := parseNFTTable(out)
+		if parseErr != nil {
+			return false, fmt.Errorf("failed to parse table: %w", parseErr)
+		}
+		drift := false
+		for chain, rules := range expected.chains {
+			if count, ok := current.chains[chain]; !ok || count != rules {
+				drift = true
+			}
+		}
+		for set := range expected.sets {
+			if _, ok := current.sets[set]; !ok {
+				drift = true
+			}
+		}
+		if !drift {
+			return false, nil
+		}
+	}
+
+	// Таблицы нет или она изменена: пересоздаём всё, существующие записи наборов сохраняются
+	if err := b.apply(commands...); err != nil {
+		return true, fmt.Errorf("failed to restore table: %w", err)
+	}
+	return true, nil
+}
+
+// Clean удаляет таблицу MagiTrickle целиком вместе с наборами
+func (b *NFTablesBackend) Clean() error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.sets = make(map[string]struct{})
+	b.links = make(map[string]LinkSpec)
+	b.dispatcher = nil
+	b.remaps = make(map[string]RemapSpec)
+	b.blocks = make(map[string]BlockSpec)
+	b.pendingRules = nil
+	return b.apply("delete table inet " + b.Table)
+}
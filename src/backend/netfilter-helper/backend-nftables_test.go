@@ -0,0 +1,272 @@
+package netfilterHelper
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newTestNFTables(t *testing.T) (*NFTablesBackend, *[]string) {
+	var scripts []string
+	return &NFTablesBackend{
+		ChainPrefix: "MT_",
+		Table:       nftTableName,
+		run: func(stdin string, args ...string) ([]byte, error) {
+			scripts = append(scripts, stdin)
+			return nil, nil
+		},
+	}, &scripts
+}
+
+func TestNFTables_AddSetEntry(t *testing.T) {
+	b, scripts := newTestNFTables(t)
+	timeout := uint32(300)
+
+	if err := b.AddSetEntry("mt_g", SetEntry{Net: hostNet(net.IPv4(1, 2, 3, 4).To4()), Timeout: &timeout}); err != nil {
+		t.Fatal(err)
+	}
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	if err := b.AddSetEntry("mt_g", SetEntry{Net: *ipNet}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains((*scripts)[0], "add element inet magitrickle mt_g_4 { 1.2.3.4 timeout 300s }") {
+		t.Errorf("address should go to the timeout set:\n%s", (*scripts)[0])
+	}
+	if !strings.Contains((*scripts)[1], "add element inet magitrickle mt_g_4n { 10.0.0.0/8 }") {
+		t.Errorf("network should go to the interval set:\n%s", (*scripts)[1])
+	}
+}
+
+func TestNFTables_BatchSetEntries(t *testing.T) {
+	b, scripts := newTestNFTables(t)
+	timeout := uint32(300)
+
+	b.BeginSetEntries()
+	b.BeginSetEntries()
+	for _, ip := range []net.IP{{1, 1, 1, 1}, {2, 2, 2, 2}} {
+		if err := b.AddSetEntry("mt_g", SetEntry{Net: hostNet(ip), Timeout: &timeout}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.DelSetEntry("mt_g", hostNet(net.IP{3, 3, 3, 3})); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 0 {
+		t.Fatalf("entries should wait for the end of the batch: %q", *scripts)
+	}
+
+	// Закрытие любой пачки применяет всё накопленное одной транзакцией
+	if err := b.CommitSetEntries(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 1 {
+		t.Fatalf("batch should be applied by one nft call, got %d", len(*scripts))
+	}
+	for _, element := range []string{"1.1.1.1 timeout 300s", "2.2.2.2 timeout 300s", "delete element inet magitrickle mt_g_4 { 3.3.3.3 }"} {
+		if !strings.Contains((*scripts)[0], element) {
+			t.Errorf("batch should contain %q:\n%s", element, (*scripts)[0])
+		}
+	}
+
+	// Список набора читается уже с накопленными изменениями
+	if err := b.AddSetEntry("mt_g", SetEntry{Net: hostNet(net.IP{4, 4, 4, 4})}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 1 {
+		t.Fatal("entry in an open batch should not be applied immediately")
+	}
+	_, _ = b.ListSetEntries("mt_g")
+	if !strings.Contains((*scripts)[1], "4.4.4.4") {
+		t.Errorf("pending entries should be applied before listing:\n%s", (*scripts)[1])
+	}
+
+	if err := b.CommitSetEntries(); err != nil {
+		t.Fatal(err)
+	}
+	calls := len(*scripts)
+	if err := b.AddSetEntry("mt_g", SetEntry{Net: hostNet(net.IP{5, 5, 5, 5})}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != calls+1 {
+		t.Error("entry outside of a batch should be applied immediately")
+	}
+}
+
+func TestNFTables_BatchRules(t *testing.T) {
+	b, scripts := newTestNFTables(t)
+	b.links = make(map[string]LinkSpec)
+	b.sets = make(map[string]struct{})
+
+	b.BeginRules()
+	spec := LinkSpec{Chain: "MT_A", Set: "mt_a", Mark: 0x1}
+	if err := b.InsertLink(spec, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SyncDispatcher([]LinkSpec{spec}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 0 {
+		t.Fatalf("rules should wait for the end of the batch: %q", *scripts)
+	}
+	if err := b.CommitRules(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 1 || !strings.Contains((*scripts)[0], "jump MT_A") {
+		t.Fatalf("batch should be applied by one nft call: %q", *scripts)
+	}
+
+	// Набор удаляется только после правил, которые на него ссылаются
+	b.BeginRules()
+	if err := b.DeleteLink(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DestroySet("mt_a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 3 || !strings.Contains((*scripts)[1], "delete chain inet magitrickle MT_A") {
+		t.Fatalf("pending rules should be applied before the set is destroyed: %q", *scripts)
+	}
+	if err := b.CommitRules(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 3 {
+		t.Errorf("nothing should be left to apply: %q", *scripts)
+	}
+}
+
+func TestNFTables_SyncDispatcher(t *testing.T) {
+	b, scripts := newTestNFTables(t)
+
+	err := b.SyncDispatcher([]LinkSpec{
+		{Chain: "MT_A", Set: "mt_a", Mark: 0x1},
+		{Chain: "MT_B", Set: "mt_b", Mark: 0x2, Bypass: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := (*scripts)[0]
+	first := strings.Index(script, "ip daddr @mt_a_4 jump MT_A")
+	second := strings.Index(script, "ip daddr @mt_b_4 jump MT_B")
+	if first == -1 || second == -1 || first > second {
+		t.Fatalf("links should be dispatched in order:\n%s", script)
+	}
+	if strings.Contains(script, "MT_B_FWD") {
+		t.Errorf("bypass link should not have forward rules:\n%s", script)
+	}
+}
+
+func TestParseNFTSet(t *testing.T) {
+	data := []byte(`{"nftables": [{"metainfo": {"json_schema_version": 1}}, {"set": {"family": "inet", "name": "mt_g_4", "table": "magitrickle", "type": "ipv4_addr", "flags": ["timeout"], "elem": [
+		"1.1.1.1",
+		{"elem": {"val": "2.2.2.2", "timeout": 300, "expires": 120}},
+		{"prefix": {"addr": "10.0.0.0", "len": 8}},
+		{"range": ["3.3.3.1", "3.3.3.5"]}
+	]}}]}`)
+
+	entries, err := parseNFTSet(data, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", entries)
+	}
+	if entries[0].Net.String() != "1.1.1.1/32" || entries[0].Timeout != nil {
+		t.Errorf("unexpected permanent entry %+v", entries[0])
+	}
+	if entries[1].Net.String() != "2.2.2.2/32" || entries[1].Timeout == nil || *entries[1].Timeout != 120 {
+		t.Errorf("unexpected timeout entry %+v", entries[1])
+	}
+	if entries[2].Net.String() != "10.0.0.0/8" {
+		t.Errorf("unexpected network entry %+v", entries[2])
+	}
+}
+
+func TestNFTables_Reconcile(t *testing.T) {
+	var scripts []string
+	listing := ""
+	b := &NFTablesBackend{
+		ChainPrefix: "MT_",
+		Table:       nftTableName,
+		sets:        make(map[string]struct{}),
+		links:       make(map[string]LinkSpec),
+		remaps:      make(map[string]RemapSpec),
+		blocks:      make(map[string]BlockSpec),
+		run: func(stdin string, args ...string) ([]byte, error) {
+			if len(args) > 1 && args[1] == "list" {
+				if listing == "" {
+					return nil, errors.New("no such table")
+				}
+				return []byte(listing), nil
+			}
+			scripts = append(scripts, stdin)
+			return nil, nil
+		},
+	}
+	spec := LinkSpec{Chain: "MT_A", Set: "mt_a", Mark: 1, OutInterfaces: []string{"nwg0"}, Bypass: true}
+	b.sets["mt_a"] = struct{}{}
+	b.links[spec.Chain] = spec
+	b.dispatcher = []LinkSpec{spec}
+
+	repaired, err := b.Reconcile()
+	if err != nil || !repaired || len(scripts) != 1 {
+		t.Fatalf("missing table should be restored: %v %v %d", repaired, err, len(scripts))
+	}
+	if !strings.Contains(scripts[0], "add set inet magitrickle mt_a_4 ") || !strings.Contains(scripts[0], "ip daddr @mt_a_4 jump MT_A") ||
+		!strings.Contains(scripts[0], "add rule inet magitrickle MT_COUNT_OUTPUT jump MT_COUNT") ||
+		!strings.Contains(scripts[0], "add rule inet magitrickle MT_COUNT meta nfproto ipv4 ct mark") {
+		t.Errorf("restore should recreate sets and chains:\n%s", scripts[0])
+	}
+
+	listing = `{"nftables": [
+		{"set": {"name": "mt_a_4"}}, {"set": {"name": "mt_a_6"}}, {"set": {"name": "mt_a_4n"}}, {"set": {"name": "mt_a_6n"}},
+		{"chain": {"name": "MT_A"}}, {"rule": {"chain": "MT_A"}},
+		{"chain": {"name": "MT_ROUTE"}}, {"rule": {"chain": "MT_ROUTE"}}, {"rule": {"chain": "MT_ROUTE"}}, {"rule": {"chain": "MT_ROUTE"}}, {"rule": {"chain": "MT_ROUTE"}},
+		{"chain": {"name": "MT_FORWARD"}}, {"chain": {"name": "MT_POSTROUTING"}},
+		{"chain": {"name": "MT_COUNT"}}, {"rule": {"chain": "MT_COUNT"}}, {"rule": {"chain": "MT_COUNT"}},
+		{"chain": {"name": "MT_COUNT_FORWARD"}}, {"rule": {"chain": "MT_COUNT_FORWARD"}},
+		{"chain": {"name": "MT_COUNT_INPUT"}}, {"rule": {"chain": "MT_COUNT_INPUT"}},
+		{"chain": {"name": "MT_COUNT_OUTPUT"}}, {"rule": {"chain": "MT_COUNT_OUTPUT"}}
+	]}`
+	repaired, err = b.Reconcile()
+	if err != nil || repaired || len(scripts) != 1 {
+		t.Fatalf("intact table should not be touched: %v %v %d", repaired, err, len(scripts))
+	}
+}
+
+func TestLinkMatches_ClientSet(t *testing.T) {
+	matches := nftLinkMatches(LinkSpec{Set: "mt_a", ClientSet: "mt_a_c"}, "prerouting")
+	if len(matches) != 4 || matches[1] != "ip daddr @mt_a_4 ip saddr @mt_a_c_4n" {
+		t.Fatalf("every pair of destination and client sets should be matched: %q", matches)
+	}
+
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	link := LinkSpec{Set: "mt_a", ClientMACs: []net.HardwareAddr{mac}, Mark: 0x10000, MarkMask: 0xff0000}
+	if matches := nftLinkMatches(link, "forward"); len(matches) != 2 || matches[0] != "ip daddr @mt_a_4 ether saddr aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("MAC clients should be matched by source address: %q", matches)
+	}
+	if matches := nftLinkMatches(link, "postrouting"); len(matches) != 2 || matches[1] != "ip daddr @mt_a_4n meta mark and 0xff0000 == 0x10000" {
+		t.Fatalf("MAC clients should be matched by the group mark after routing: %q", matches)
+	}
+	if matches := nftLinkMatches(link, "output"); len(matches) != 0 {
+		t.Fatalf("MAC clients should not match local traffic: %q", matches)
+	}
+}
+
+func TestParseNFTCounters(t *testing.T) {
+	data := []byte(`{"nftables": [
+		{"metainfo": {"version": "1.0.9"}},
+		{"chain": {"name": "MT_COUNT"}},
+		{"rule": {"chain": "MT_COUNT", "comment": "MT_A original", "expr": [{"match": {}}, {"counter": {"packets": 3, "bytes": 300}}]}},
+		{"rule": {"chain": "MT_COUNT", "comment": "MT_A reply", "expr": [{"counter": {"packets": 5, "bytes": 5000}}]}}
+	]}`)
+	counters, err := parseNFTCounters(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters["MT_A"] != (LinkCounters{TxPackets: 3, TxBytes: 300, RxPackets: 5, RxBytes: 5000}) {
+		t.Errorf("unexpected counters: %+v", counters["MT_A"])
+	}
+}
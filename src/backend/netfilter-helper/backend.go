@@ -0,0 +1,175 @@
+package netfilterHelper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	BackendIPTables = "iptables"
+	BackendNFTables = "nftables"
+)
+
+var ErrUnknownBackend = errors.New("unknown netfilter backend")
+
+// LinkSpec описывает правила, которые связывают набор адресов группы с её маршрутом
+type LinkSpec struct {
+	// Chain – имя цепочки группы, от него строятся имена остальных цепочек
+	Chain string
+	// Set – имя набора адресов без суффикса семейства
+	Set  string
+	Mark uint32
+	// MarkMask – биты метки, которые принадлежат MagiTrickle. Ноль означает всю метку.
+	MarkMask uint32
+	// OutInterfaces – интерфейсы, через которые разрешено уходить трафику группы.
+	// Пустое имя разрешает любой интерфейс.
+	OutInterfaces []string
+	KillSwitch    bool
+	Bypass        bool
+	// RouteLocal маркирует и пакеты, созданные самим роутером (mangle OUTPUT)
+	RouteLocal bool
+	// ClientSet – набор адресов клиентов, к которым применяется группа (сверяется с
+	// адресом отправителя). Пустое имя и пустой ClientMACs означают всех клиентов.
+	ClientSet string
+	// ClientMACs – клиенты, которые сверяются по MAC-адресу отправителя
+	ClientMACs []net.HardwareAddr
+	// Source – группа по источнику: в неё попадает весь трафик клиентов из ClientSet
+	// и ClientMACs, а набор Set содержит адреса-исключения
+	Source bool
+	// Ports ограничивает группу протоколами и портами назначения. Пустой список – весь трафик.
+	Ports []PortRange
+}
+
+// PortRange – протокол (tcp или udp) и диапазон портов назначения
+type PortRange struct {
+	Protocol string
+	From     uint16
+	To       uint16
+}
+
+func (p PortRange) iptablesRange() string {
+	if p.From == p.To {
+		return strconv.Itoa(int(p.From))
+	}
+	return fmt.Sprintf("%d:%d", p.From, p.To)
+}
+
+func (p PortRange) nftablesRange() string {
+	if p.From == p.To {
+		return strconv.Itoa(int(p.From))
+	}
+	return fmt.Sprintf("%d-%d", p.From, p.To)
+}
+
+// RemapSpec описывает перенаправление порта для адресов роутера
+type RemapSpec struct {
+	Chain     string
+	Addresses []net.IP
+	// Interfaces перехватывает порт для любых адресов назначения, если пакет пришёл с этих интерфейсов
+	Interfaces []string
+	// ExemptSet и ExemptMACs – устройства, к которым перехват не применяется
+	ExemptSet  string
+	ExemptMACs []net.HardwareAddr
+	From       uint16
+	To         uint16
+}
+
+// BlockSpec описывает запрет TCP и UDP портов для пакетов, пришедших с интерфейсов
+type BlockSpec struct {
+	Chain      string
+	Interfaces []string
+	// ExemptSet и ExemptMACs – устройства, к которым запрет не применяется
+	ExemptSet  string
+	ExemptMACs []net.HardwareAddr
+	// Ports запрещаются для любых адресов назначения
+	Ports []uint16
+	// SetPorts запрещаются только для адресов из набора Set
+	Set      string
+	SetPorts []uint16
+}
+
+// LinkCounters – счётчики соединений группы: пакеты в сторону адресов группы (Tx)
+// и ответные пакеты (Rx)
+type LinkCounters struct {
+	TxPackets uint64
+	TxBytes   uint64
+	RxPackets uint64
+	RxBytes   uint64
+}
+
+// SetEntry – запись набора: адрес или подсеть и оставшееся время жизни (nil – бессрочно)
+type SetEntry struct {
+	Net     net.IPNet
+	Timeout *uint32
+}
+
+// Backend – реализация правил netfilter и наборов адресов.
+// Параметры iptType и table ограничивают восстановление правил после их сброса прошивкой
+// (хук netfilter.d), пустые значения означают все семейства и таблицы.
+type Backend interface {
+	CreateSet(name string) error
+	DestroySet(name string) error
+	AddSetEntry(name string, entry SetEntry) error
+	DelSetEntry(name string, ipNet net.IPNet) error
+	ListSetEntries(name string) ([]SetEntry, error)
+
+	InsertLink(spec LinkSpec, iptType, table string) error
+	UpdateLink(old, spec LinkSpec) error
+	DeleteLink(spec LinkSpec) error
+	// SyncDispatcher пересобирает общую цепочку маркировки из связок в порядке приоритета
+	SyncDispatcher(links []LinkSpec) error
+
+	InsertRemap(spec RemapSpec, iptType, table string) error
+	DeleteRemap(spec RemapSpec) error
+
+	InsertBlock(spec BlockSpec, iptType, table string) error
+	DeleteBlock(spec BlockSpec) error
+
+	// LinkCounters возвращает счётчики трафика связок по именам их цепочек
+	LinkCounters() (map[string]LinkCounters, error)
+
+	// Reconcile восстанавливает правила, изменённые или удалённые извне,
+	// и сообщает, было ли что-то исправлено
+	Reconcile() (bool, error)
+
+	// Clean удаляет правила, оставшиеся от прошлого запуска
+	Clean() error
+}
+
+// SetEntryBatcher – бэкенд, которому выгоднее применять изменения наборов пачкой.
+// Пока открыта хотя бы одна пачка, AddSetEntry и DelSetEntry только запоминают
+// изменения, а CommitSetEntries применяет всё накопленное одной транзакцией.
+type SetEntryBatcher interface {
+	BeginSetEntries()
+	CommitSetEntries() error
+}
+
+// RuleBatcher – бэкенд, который может отложить применение правил. Между BeginRules
+// и CommitRules изменения только запоминаются, закрытие последней пачки применяет
+// их разом, а не по вызову на каждое изменение.
+type RuleBatcher interface {
+	BeginRules()
+	CommitRules() error
+}
+
+// markMask возвращает маску метки, ноль означает всю метку
+func (s LinkSpec) markMask() uint32 {
+	if s.MarkMask == 0 {
+		return 0xffffffff
+	}
+	return s.MarkMask
+}
+
+func hostNet(addr net.IP) net.IPNet {
+	if len(addr) == net.IPv4len {
+		return net.IPNet{IP: addr, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}
+}
+
+func isHostNet(ipNet net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	return ones == bits
+}
@@ -0,0 +1,76 @@
+package netfilterHelper
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// conntrackDstFilter выбирает соединения, адрес назначения которых попадает в одну из подсетей.
+// Один фильтр на все подсети позволяет обойти таблицу conntrack за один проход.
+type conntrackDstFilter struct {
+	nets []net.IPNet
+}
+
+func (f conntrackDstFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	for _, ipNet := range f.nets {
+		if ipNet.Contains(flow.Forward.DstIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// FlushConntrack удаляет записи conntrack соединений к заданным адресам и подсетям.
+// Новые пакеты этих соединений заново пройдут маркировку и маршрутизацию,
+// поэтому изменение маршрута применяется без переподключения приложений.
+func (nh *NetfilterHelper) FlushConntrack(nets []net.IPNet) (uint, error) {
+	var nets4, nets6 []net.IPNet
+	for _, ipNet := range nets {
+		if ipNet.IP.To4() != nil {
+			nets4 = append(nets4, ipNet)
+		} else {
+			nets6 = append(nets6, ipNet)
+		}
+	}
+
+	var deleted uint
+	for _, family := range []struct {
+		family netlink.InetFamily
+		nets   []net.IPNet
+	}{{unix.AF_INET, nets4}, {unix.AF_INET6, nets6}} {
+		if len(family.nets) == 0 {
+			continue
+		}
+		count, err := nh.netlink.ConntrackDeleteFilters(netlink.ConntrackTable, family.family, conntrackDstFilter{nets: family.nets})
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete conntrack entries: %w", err)
+		}
+		deleted += count
+	}
+	return deleted, nil
+}
+
+// ConntrackFlows возвращает соединения IPv4, метка которых в битах mask равна mark.
+// Группы помечают только IPv4, поэтому соединения IPv6 не запрашиваются.
+// Счётчики байт в соединениях заполнены, только если включён nf_conntrack_acct.
+func (nh *NetfilterHelper) ConntrackFlows(mark, mask uint32) ([]*netlink.ConntrackFlow, error) {
+	flows, err := nh.netlink.ConntrackTableList(netlink.ConntrackTable, unix.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conntrack entries: %w", err)
+	}
+	matched := flows[:0]
+	for _, flow := range flows {
+		if flow.Mark&mask == mark {
+			matched = append(matched, flow)
+		}
+	}
+	return matched, nil
+}
+
+// LinkCounters возвращает счётчики трафика групп по именам их цепочек
+func (nh *NetfilterHelper) LinkCounters() (map[string]LinkCounters, error) {
+	return nh.backend.LinkCounters()
+}
@@ -0,0 +1,295 @@
+// Package fake содержит реализации бэкенда netfilter и netlink в памяти для тестов
+package fake
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+
+	netfilterHelper "magitrickle/netfilter-helper"
+)
+
+// ErrNotFound возвращается при обращении к несуществующему набору
+var ErrNotFound = errors.New("not found")
+
+// Backend хранит наборы и правила в памяти вместо ядра
+type Backend struct {
+	locker sync.Mutex
+
+	sets       map[string]map[string]netfilterHelper.SetEntry
+	links      map[string]netfilterHelper.LinkSpec
+	dispatcher []netfilterHelper.LinkSpec
+	remaps     map[string]netfilterHelper.RemapSpec
+	blocks     map[string]netfilterHelper.BlockSpec
+	counters   map[string]netfilterHelper.LinkCounters
+	flushed    bool
+}
+
+var _ netfilterHelper.Backend = (*Backend)(nil)
+
+func NewBackend() *Backend {
+	return &Backend{
+		sets:   make(map[string]map[string]netfilterHelper.SetEntry),
+		links:  make(map[string]netfilterHelper.LinkSpec),
+		remaps: make(map[string]netfilterHelper.RemapSpec),
+		blocks: make(map[string]netfilterHelper.BlockSpec),
+	}
+}
+
+func (b *Backend) CreateSet(name string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	if _, ok := b.sets[name]; !ok {
+		b.sets[name] = make(map[string]netfilterHelper.SetEntry)
+	}
+	return nil
+}
+
+func (b *Backend) DestroySet(name string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.sets, name)
+	return nil
+}
+
+func (b *Backend) AddSetEntry(name string, entry netfilterHelper.SetEntry) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	set, ok := b.sets[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if entry.Timeout != nil {
+		timeout := *entry.Timeout
+		entry.Timeout = &timeout
+	}
+	set[entry.Net.String()] = entry
+	return nil
+}
+
+func (b *Backend) DelSetEntry(name string, ipNet net.IPNet) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	set, ok := b.sets[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(set, ipNet.String())
+	return nil
+}
+
+func (b *Backend) ListSetEntries(name string) ([]netfilterHelper.SetEntry, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	set, ok := b.sets[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	entries := make([]netfilterHelper.SetEntry, 0, len(set))
+	for _, entry := range set {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (b *Backend) InsertLink(spec netfilterHelper.LinkSpec, iptType, table string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.links[spec.Chain] = spec
+	return nil
+}
+
+func (b *Backend) UpdateLink(old, spec netfilterHelper.LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.links, old.Chain)
+	b.links[spec.Chain] = spec
+	return nil
+}
+
+func (b *Backend) DeleteLink(spec netfilterHelper.LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.links, spec.Chain)
+	return nil
+}
+
+func (b *Backend) SyncDispatcher(links []netfilterHelper.LinkSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.dispatcher = append([]netfilterHelper.LinkSpec(nil), links...)
+	return nil
+}
+
+func (b *Backend) InsertRemap(spec netfilterHelper.RemapSpec, iptType, table string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.remaps[spec.Chain] = spec
+	return nil
+}
+
+func (b *Backend) DeleteRemap(spec netfilterHelper.RemapSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.remaps, spec.Chain)
+	return nil
+}
+
+func (b *Backend) InsertBlock(spec netfilterHelper.BlockSpec, iptType, table string) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.blocks[spec.Chain] = spec
+	return nil
+}
+
+func (b *Backend) DeleteBlock(spec netfilterHelper.BlockSpec) error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	delete(b.blocks, spec.Chain)
+	return nil
+}
+
+func (b *Backend) LinkCounters() (map[string]netfilterHelper.LinkCounters, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	counters := make(map[string]netfilterHelper.LinkCounters, len(b.counters))
+	for chain, linkCounters := range b.counters {
+		counters[chain] = linkCounters
+	}
+	return counters, nil
+}
+
+func (b *Backend) Reconcile() (bool, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	flushed := b.flushed
+	b.flushed = false
+	return flushed, nil
+}
+
+func (b *Backend) Clean() error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.sets = make(map[string]map[string]netfilterHelper.SetEntry)
+	b.links = make(map[string]netfilterHelper.LinkSpec)
+	b.dispatcher = nil
+	b.remaps = make(map[string]netfilterHelper.RemapSpec)
+	b.blocks = make(map[string]netfilterHelper.BlockSpec)
+	return nil
+}
+
+// Flush имитирует сброс правил прошивкой: связки и диспетчер пропадают до Reconcile
+func (b *Backend) Flush() {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.flushed = true
+}
+
+// Entries возвращает записи набора в порядке сортировки адресов
+func (b *Backend) Entries(name string) []netfilterHelper.SetEntry {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	keys := make([]string, 0, len(b.sets[name]))
+	for key := range b.sets[name] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]netfilterHelper.SetEntry, len(keys))
+	for idx, key := range keys {
+		entries[idx] = b.sets[name][key]
+	}
+	return entries
+}
+
+// HasSet сообщает, создан ли набор
+func (b *Backend) HasSet(name string) bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	_, ok := b.sets[name]
+	return ok
+}
+
+// Contains сообщает, есть ли в наборе запись, покрывающая адрес
+func (b *Backend) Contains(name string, addr net.IP) bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	for _, entry := range b.sets[name] {
+		if entry.Net.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Link возвращает правила группы по имени её цепочки
+func (b *Backend) Link(chain string) (netfilterHelper.LinkSpec, bool) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	if b.flushed {
+		return netfilterHelper.LinkSpec{}, false
+	}
+	spec, ok := b.links[chain]
+	return spec, ok
+}
+
+// Dispatcher возвращает связки в порядке, в котором их проверяет диспетчер
+func (b *Backend) Dispatcher() []netfilterHelper.LinkSpec {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	if b.flushed {
+		return nil
+	}
+	return append([]netfilterHelper.LinkSpec(nil), b.dispatcher...)
+}
+
+// Remap возвращает перенаправление порта по имени цепочки
+func (b *Backend) Remap(chain string) (netfilterHelper.RemapSpec, bool) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	spec, ok := b.remaps[chain]
+	return spec, ok
+}
+
+// Block возвращает запрет портов по имени цепочки
+func (b *Backend) Block(chain string) (netfilterHelper.BlockSpec, bool) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	spec, ok := b.blocks[chain]
+	return spec, ok
+}
+
+// SetLinkCounters задаёт счётчики трафика связки, как если бы их насчитало ядро
+func (b *Backend) SetLinkCounters(chain string, counters netfilterHelper.LinkCounters) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	if b.counters == nil {
+		b.counters = make(map[string]netfilterHelper.LinkCounters)
+	}
+	b.counters[chain] = counters
+}
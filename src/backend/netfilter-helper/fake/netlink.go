@@ -0,0 +1,518 @@
+package fake
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+
+	netfilterHelper "magitrickle/netfilter-helper"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Netlink хранит интерфейсы, правила и маршруты в памяти и рассылает события подписчикам
+type Netlink struct {
+	locker sync.Mutex
+
+	links     []netlink.Link
+	lastIndex int
+	addrs     map[string][]netlink.Addr
+	rules     []netlink.Rule
+	routes    []netlink.Route
+	flows     []*netlink.ConntrackFlow
+	linkSubs  []chan<- netlink.LinkUpdate
+	neighSubs []chan<- netlink.NeighUpdate
+	routeSubs []chan<- netlink.RouteUpdate
+	addrSubs  []chan<- netlink.AddrUpdate
+}
+
+var _ netfilterHelper.Netlink = (*Netlink)(nil)
+
+func NewNetlink() *Netlink {
+	return &Netlink{
+		addrs: make(map[string][]netlink.Addr),
+	}
+}
+
+// AddLink добавляет интерфейс с заданным состоянием и адресами
+func (n *Netlink) AddLink(name string, up bool, addrs ...*net.IPNet) netlink.Link {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	// Индексы не переиспользуются, как и в ядре: пересозданный интерфейс получает новый
+	n.lastIndex++
+	attrs.Index = n.lastIndex
+	if up {
+		attrs.Flags = net.FlagUp
+	}
+	link := &netlink.Dummy{LinkAttrs: attrs}
+	n.links = append(n.links, link)
+	for _, addr := range addrs {
+		n.addrs[name] = append(n.addrs[name], netlink.Addr{IPNet: addr})
+	}
+	return link
+}
+
+// SetLinkUp меняет состояние интерфейса и сообщает об этом подписчикам, как это делает ядро
+func (n *Netlink) SetLinkUp(name string, up bool) error {
+	n.locker.Lock()
+	var link *netlink.Dummy
+	for _, l := range n.links {
+		if l.Attrs().Name == name {
+			link = l.(*netlink.Dummy)
+		}
+	}
+	if link == nil {
+		n.locker.Unlock()
+		return fmt.Errorf("%w: %s", netfilterHelper.ErrLinkNotFound, name)
+	}
+	if up {
+		link.Flags |= net.FlagUp
+	} else {
+		link.Flags &^= net.FlagUp
+	}
+	copied := *link
+	subs := append([]chan<- netlink.LinkUpdate(nil), n.linkSubs...)
+	n.locker.Unlock()
+
+	event := netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: &copied}
+	event.Change = unix.IFF_UP
+	for _, ch := range subs {
+		ch <- event
+	}
+	return nil
+}
+
+// DelLink удаляет интерфейс вместе с его адресами и маршрутами и сообщает об этом подписчикам
+func (n *Netlink) DelLink(name string) error {
+	n.locker.Lock()
+	idx := slices.IndexFunc(n.links, func(link netlink.Link) bool { return link.Attrs().Name == name })
+	if idx < 0 {
+		n.locker.Unlock()
+		return fmt.Errorf("%w: %s", netfilterHelper.ErrLinkNotFound, name)
+	}
+	link := n.links[idx]
+	n.links = slices.Delete(n.links, idx, idx+1)
+	delete(n.addrs, name)
+	n.routes = slices.DeleteFunc(n.routes, func(route netlink.Route) bool {
+		return route.LinkIndex == link.Attrs().Index
+	})
+	subs := append([]chan<- netlink.LinkUpdate(nil), n.linkSubs...)
+	n.locker.Unlock()
+
+	event := netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_DELLINK}, Link: link}
+	for _, ch := range subs {
+		ch <- event
+	}
+	return nil
+}
+
+// RenameLink переименовывает интерфейс, индекс и маршруты сохраняются
+func (n *Netlink) RenameLink(name, newName string) error {
+	n.locker.Lock()
+	idx := slices.IndexFunc(n.links, func(link netlink.Link) bool { return link.Attrs().Name == name })
+	if idx < 0 {
+		n.locker.Unlock()
+		return fmt.Errorf("%w: %s", netfilterHelper.ErrLinkNotFound, name)
+	}
+	link := n.links[idx].(*netlink.Dummy)
+	link.Name = newName
+	n.addrs[newName] = n.addrs[name]
+	delete(n.addrs, name)
+	copied := *link
+	subs := append([]chan<- netlink.LinkUpdate(nil), n.linkSubs...)
+	n.locker.Unlock()
+
+	event := netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: &copied}
+	for _, ch := range subs {
+		ch <- event
+	}
+	return nil
+}
+
+// SendNeigh рассылает подписчикам событие таблицы соседей
+func (n *Netlink) SendNeigh(event netlink.NeighUpdate) {
+	n.locker.Lock()
+	subs := append([]chan<- netlink.NeighUpdate(nil), n.neighSubs...)
+	n.locker.Unlock()
+
+	for _, ch := range subs {
+		ch <- event
+	}
+}
+
+// AddAddr добавляет адрес интерфейсу и рассылает подписчикам событие
+func (n *Netlink) AddAddr(name string, addr *net.IPNet) {
+	n.locker.Lock()
+	index := 0
+	for _, link := range n.links {
+		if link.Attrs().Name == name {
+			index = link.Attrs().Index
+		}
+	}
+	n.addrs[name] = append(n.addrs[name], netlink.Addr{IPNet: addr})
+	subs := append([]chan<- netlink.AddrUpdate(nil), n.addrSubs...)
+	n.locker.Unlock()
+
+	event := netlink.AddrUpdate{LinkAddress: *addr, LinkIndex: index, NewAddr: true}
+	for _, ch := range subs {
+		ch <- event
+	}
+}
+
+func (n *Netlink) LinkByName(name string) (netlink.Link, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	for _, link := range n.links {
+		if link.Attrs().Name == name {
+			copied := *link.(*netlink.Dummy)
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", netfilterHelper.ErrLinkNotFound, name)
+}
+
+func (n *Netlink) LinkByIndex(index int) (netlink.Link, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	for _, link := range n.links {
+		if link.Attrs().Index == index {
+			copied := *link.(*netlink.Dummy)
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: index %d", netfilterHelper.ErrLinkNotFound, index)
+}
+
+func (n *Netlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	return append([]netlink.Addr(nil), n.addrs[link.Attrs().Name]...), nil
+}
+
+// sameRule сравнивает правило с образцом так же, как ядро: приоритет учитывается,
+// только если он задан в образце
+func sameRule(rule, pattern *netlink.Rule) bool {
+	if pattern.Priority >= 0 && rule.Priority != pattern.Priority {
+		return false
+	}
+	return rule.Mark == pattern.Mark && rule.Table == pattern.Table && ruleMask(rule) == ruleMask(pattern)
+}
+
+func ruleMask(rule *netlink.Rule) uint32 {
+	if rule.Mask == nil {
+		return 0xffffffff
+	}
+	return *rule.Mask
+}
+
+// defaultRulePriority выбирает приоритет правилу без приоритета, как ядро: на единицу
+// меньше первого правила после local. Правило main (32766) в фейке не хранится.
+func (n *Netlink) defaultRulePriority() int {
+	priority := 32766
+	for _, rule := range n.rules {
+		if rule.Priority > 0 && rule.Priority < priority {
+			priority = rule.Priority
+		}
+	}
+	return priority - 1
+}
+
+func (n *Netlink) RuleAdd(rule *netlink.Rule) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	added := *rule
+	if added.Priority < 0 {
+		added.Priority = n.defaultRulePriority()
+	}
+	for idx := range n.rules {
+		if sameRule(&n.rules[idx], &added) {
+			return syscall.EEXIST
+		}
+	}
+	n.rules = append(n.rules, added)
+	return nil
+}
+
+func (n *Netlink) RuleDel(rule *netlink.Rule) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	for idx := range n.rules {
+		if sameRule(&n.rules[idx], rule) {
+			n.rules = append(n.rules[:idx], n.rules[idx+1:]...)
+			return nil
+		}
+	}
+	return syscall.ENOENT
+}
+
+func (n *Netlink) RuleList(family int) ([]netlink.Rule, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	return append([]netlink.Rule(nil), n.rules...), nil
+}
+
+// sameRoute сравнивает маршруты по ключу ядра: таблица, назначение и метрика
+func sameRoute(a, b *netlink.Route) bool {
+	return a.Table == b.Table && a.Priority == b.Priority && a.Dst.String() == b.Dst.String()
+}
+
+func (n *Netlink) RouteAdd(route *netlink.Route) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	for idx := range n.routes {
+		if sameRoute(&n.routes[idx], route) {
+			return syscall.EEXIST
+		}
+	}
+	n.routes = append(n.routes, *route)
+	return nil
+}
+
+func (n *Netlink) RouteReplace(route *netlink.Route) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	for idx := range n.routes {
+		if sameRoute(&n.routes[idx], route) {
+			n.routes[idx] = *route
+			return nil
+		}
+	}
+	n.routes = append(n.routes, *route)
+	return nil
+}
+
+func (n *Netlink) RouteDel(route *netlink.Route) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	for idx := range n.routes {
+		if sameRoute(&n.routes[idx], route) {
+			n.routes = append(n.routes[:idx], n.routes[idx+1:]...)
+			return nil
+		}
+	}
+	return syscall.ESRCH
+}
+
+func (n *Netlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	var routes []netlink.Route
+	for _, route := range n.routes {
+		if filterMask&netlink.RT_FILTER_TABLE != 0 && filter.Table != 0 && route.Table != filter.Table {
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// RouteGetWithOptions выбирает маршрут, как ядро: правила по возрастанию приоритета
+// (учитывается только метка), затем самый длинный префикс в таблице правила или в main
+func (n *Netlink) RouteGetWithOptions(destination net.IP, options *netlink.RouteGetOptions) ([]netlink.Route, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	var mark uint32
+	if options != nil {
+		mark = options.Mark
+	}
+	rules := slices.Clone(n.rules)
+	slices.SortStableFunc(rules, func(a, b netlink.Rule) int { return a.Priority - b.Priority })
+	var tables []int
+	for _, rule := range rules {
+		mask := ^uint32(0)
+		if rule.Mask != nil {
+			mask = *rule.Mask
+		}
+		if rule.Mark != 0 && mark&mask != rule.Mark {
+			continue
+		}
+		tables = append(tables, rule.Table)
+	}
+	tables = append(tables, unix.RT_TABLE_MAIN)
+
+	for _, table := range tables {
+		var best *netlink.Route
+		for idx := range n.routes {
+			route := &n.routes[idx]
+			routeTable := route.Table
+			if routeTable == 0 {
+				routeTable = unix.RT_TABLE_MAIN
+			}
+			if routeTable != table || (route.Dst != nil && !route.Dst.Contains(destination)) {
+				continue
+			}
+			if best == nil || prefixLen(route.Dst) > prefixLen(best.Dst) {
+				best = route
+			}
+		}
+		if best != nil {
+			route := *best
+			route.Dst = &net.IPNet{IP: destination, Mask: net.CIDRMask(len(destination)*8, len(destination)*8)}
+			return []netlink.Route{route}, nil
+		}
+	}
+	return nil, syscall.ENETUNREACH
+}
+
+func prefixLen(ipNet *net.IPNet) int {
+	if ipNet == nil {
+		return 0
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
+
+func (n *Netlink) ConntrackTableList(table netlink.ConntrackTableType, family netlink.InetFamily) ([]*netlink.ConntrackFlow, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	var flows []*netlink.ConntrackFlow
+	for _, flow := range n.flows {
+		if int(flow.FamilyType) == int(family) {
+			copied := *flow
+			flows = append(flows, &copied)
+		}
+	}
+	return flows, nil
+}
+
+func (n *Netlink) ConntrackDeleteFilters(table netlink.ConntrackTableType, family netlink.InetFamily, filters ...netlink.CustomConntrackFilter) (uint, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	var deleted uint
+	n.flows = slices.DeleteFunc(n.flows, func(flow *netlink.ConntrackFlow) bool {
+		if int(flow.FamilyType) != int(family) {
+			return false
+		}
+		for _, filter := range filters {
+			if filter.MatchConntrackFlow(flow) {
+				deleted++
+				return true
+			}
+		}
+		return false
+	})
+	return deleted, nil
+}
+
+// subscribe добавляет подписчика и убирает его после закрытия done
+func subscribe[T any](n *Netlink, subs *[]chan<- T, ch chan<- T, done <-chan struct{}) {
+	*subs = append(*subs, ch)
+	go func() {
+		<-done
+		n.locker.Lock()
+		defer n.locker.Unlock()
+		for idx, sub := range *subs {
+			if sub == ch {
+				*subs = append((*subs)[:idx], (*subs)[idx+1:]...)
+				break
+			}
+		}
+	}()
+}
+
+func (n *Netlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	subscribe(n, &n.linkSubs, ch, done)
+	return nil
+}
+
+func (n *Netlink) NeighSubscribe(ch chan<- netlink.NeighUpdate, done <-chan struct{}) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	subscribe(n, &n.neighSubs, ch, done)
+	return nil
+}
+
+func (n *Netlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	subscribe(n, &n.routeSubs, ch, done)
+	return nil
+}
+
+func (n *Netlink) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	subscribe(n, &n.addrSubs, ch, done)
+	return nil
+}
+
+// AddConntrack добавляет соединение IPv4 от src к dst в таблицу conntrack
+func (n *Netlink) AddConntrack(src, dst net.IP) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	n.flows = append(n.flows, &netlink.ConntrackFlow{
+		FamilyType: unix.AF_INET,
+		Forward:    netlink.IPTuple{SrcIP: src, DstIP: dst, Protocol: unix.IPPROTO_TCP},
+	})
+}
+
+// AddFlow добавляет соединение с меткой и счётчиками в таблицу conntrack
+func (n *Netlink) AddFlow(flow *netlink.ConntrackFlow) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	if flow.FamilyType == 0 {
+		flow.FamilyType = unix.AF_INET
+	}
+	n.flows = append(n.flows, flow)
+}
+
+// Conntrack возвращает адреса назначения оставшихся соединений
+func (n *Netlink) Conntrack() []net.IP {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	var dsts []net.IP
+	for _, flow := range n.flows {
+		dsts = append(dsts, flow.Forward.DstIP)
+	}
+	return dsts
+}
+
+// Rules возвращает текущие правила маршрутизации
+func (n *Netlink) Rules() []netlink.Rule {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	return append([]netlink.Rule(nil), n.rules...)
+}
+
+// Routes возвращает маршруты таблицы
+func (n *Netlink) Routes(table int) []netlink.Route {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	var routes []netlink.Route
+	for _, route := range n.routes {
+		if route.Table == table {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
@@ -1,183 +1,138 @@
 package netfilterHelper
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"slices"
 	"sync"
 	"sync/atomic"
 
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/rs/zerolog/log"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
 )
 
+// killSwitchMetric – метрика запасного маршрута unreachable. Он ниже по приоритету любого
+// обычного маршрута группы и срабатывает, только когда тот пропал вместе с интерфейсом.
+const killSwitchMetric = 4096
+
+// bypassRulePriority – приоритет правила для групп-исключений. Он выше правил VPN-клиентов
+// (wg-quick и подобных), поэтому помеченный трафик уходит мимо туннеля.
+const bypassRulePriority = 1000
+
+var ErrNoMarkAndTable = errors.New("mark and routing table are not assigned")
+
+// Nexthop – интерфейс маршрута с балансировкой и его вес
+type Nexthop struct {
+	IfaceName string
+	Weight    int
+}
+
 type IPSetToLink struct {
 	enabled atomic.Bool
 	locker  sync.Mutex
 
 	chainName string
 	ifaceName string
+	nexthops  []Nexthop
+	gateway   net.IP
 	ipset     *IPSet
 	nh        *NetfilterHelper
+	priority  int
 	mark      uint32
+	markMask  uint32
 	table     int
 	ip4Rule   *netlink.Rule
 	ip4Route  *netlink.Route
+
+	bypass           bool
+	killSwitch       bool
+	routeLocal       bool
+	clientSet        *IPSet
+	clientMACs       []net.HardwareAddr
+	source           bool
+	ports            []PortRange
+	ip4KillSwitch    *netlink.Route
+	gatewayReachable bool
 }
 
-func (r *IPSetToLink) insertIPTablesRules(ipt *iptables.IPTables, table string) error {
-	if ipt == nil {
-		return nil
+// spec возвращает правила netfilter группы в текущем состоянии
+func (r *IPSetToLink) spec() LinkSpec {
+	var clientSet string
+	if r.clientSet != nil {
+		clientSet = r.clientSet.ipsetName
+	}
+	return LinkSpec{
+		Chain:         r.chainName,
+		Set:           r.ipset.ipsetName,
+		Mark:          r.mark,
+		MarkMask:      r.markMask,
+		OutInterfaces: r.outInterfaces(),
+		KillSwitch:    r.killSwitch,
+		Bypass:        r.bypass,
+		RouteLocal:    r.routeLocal,
+		ClientSet:     clientSet,
+		ClientMACs:    r.clientMACs,
+		Source:        r.source,
+		Ports:         r.ports,
 	}
+}
 
-	if table == "" || table == "filter" {
-		if ipt.Proto() == iptables.ProtocolIPv4 {
-			err := ipt.NewChain("filter", r.chainName)
-			if err != nil {
-				// If not "AlreadyExists"
-				if eerr, eok := err.(*iptables.Error); !(eok && eerr.ExitStatus() == 1) {
-					return fmt.Errorf("failed to create chain: %w", err)
-				}
-			}
-
-			err = ipt.AppendUnique("filter", r.chainName, "-o", r.ifaceName, "-j", "ACCEPT")
-			if err != nil {
-				return fmt.Errorf("failed to fix protect for IPv4: %w", err)
-			}
-
-			err = ipt.AppendUnique("filter", "FORWARD", "-m", "set", "--match-set", r.ipset.ipsetName+"_4", "dst", "-j", r.chainName)
-			if err != nil {
-				return fmt.Errorf("failed to append rule to PREROUTING: %w", err)
-			}
-		}
-		// TODO: IPv6
+// insertRules добавляет правила группы и встраивает её в диспетчер
+func (r *IPSetToLink) insertRules(iptType, table string) error {
+	spec := r.spec()
+	err := r.nh.backend.InsertLink(spec, iptType, table)
+	if err != nil {
+		return err
 	}
-
+	r.nh.registerLink(r, r.priority, spec)
 	if table == "" || table == "mangle" {
-		if ipt.Proto() == iptables.ProtocolIPv4 {
-			err := ipt.NewChain("mangle", r.chainName)
-			if err != nil {
-				// If not "AlreadyExists"
-				if eerr, eok := err.(*iptables.Error); !(eok && eerr.ExitStatus() == 1) {
-					return fmt.Errorf("failed to create chain: %w", err)
-				}
-			}
-
-			for _, iptablesArgs := range [][]string{
-				{"-j", "MARK", "--set-mark", strconv.Itoa(int(r.mark))},
-				{"-j", "CONNMARK", "--save-mark"},
-			} {
-				err = ipt.AppendUnique("mangle", r.chainName, iptablesArgs...)
-				if err != nil {
-					return fmt.Errorf("failed to append rule: %w", err)
-				}
-			}
-
-			err = ipt.AppendUnique("mangle", "PREROUTING", "-m", "set", "--match-set", r.ipset.ipsetName+"_4", "dst", "-j", r.chainName)
-			if err != nil {
-				return fmt.Errorf("failed to append rule to PREROUTING: %w", err)
-			}
-		}
-		// TODO: IPv6
+		return r.nh.syncDispatcher()
 	}
-
-	if table == "" || table == "nat" {
-		if ipt.Proto() == iptables.ProtocolIPv4 {
-			err := ipt.NewChain("nat", r.chainName)
-			if err != nil {
-				// If not "AlreadyExists"
-				if eerr, eok := err.(*iptables.Error); !(eok && eerr.ExitStatus() == 1) {
-					return fmt.Errorf("failed to create chain: %w", err)
-				}
-			}
-
-			err = ipt.AppendUnique("nat", r.chainName, "-j", "MASQUERADE")
-			if err != nil {
-				return fmt.Errorf("failed to create rule: %w", err)
-			}
-
-			err = ipt.AppendUnique("nat", "POSTROUTING", "-m", "set", "--match-set", r.ipset.ipsetName+"_4", "dst", "-j", r.chainName)
-			if err != nil {
-				return fmt.Errorf("failed to append rule to POSTROUTING: %w", err)
-			}
-		}
-		// TODO: IPv6
-	}
-
 	return nil
 }
 
-func (r *IPSetToLink) deleteIPTablesRules(ipt *iptables.IPTables) error {
-	if ipt == nil {
-		return nil
-	}
+// deleteRules убирает группу из диспетчера и удаляет её правила
+func (r *IPSetToLink) deleteRules() error {
+	r.nh.unregisterLink(r)
 	var errs []error
+	errs = append(errs, r.nh.syncDispatcher())
+	errs = append(errs, r.nh.backend.DeleteLink(r.spec()))
+	return errors.Join(errs...)
+}
 
-	iptErr := new(*iptables.Error)
-
-	if ipt.Proto() == iptables.ProtocolIPv4 {
-		err := ipt.ClearChain("filter", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to clear chain: %w", err))
-		}
-
-		err = ipt.DeleteIfExists("filter", "FORWARD", "-m", "set", "--match-set", r.ipset.ipsetName+"_4", "dst", "-j", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to unlinking chain: %w", err))
-		}
-
-		err = ipt.DeleteChain("filter", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to delete chain: %w", err))
-		}
-	}
-
-	if ipt.Proto() == iptables.ProtocolIPv4 {
-		err := ipt.ClearChain("mangle", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to clear chain: %w", err))
-		}
-
-		err = ipt.DeleteIfExists("mangle", "PREROUTING", "-m", "set", "--match-set", r.ipset.ipsetName+"_4", "dst", "-j", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to unlinking chain: %w", err))
-		}
-
-		err = ipt.DeleteChain("mangle", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to delete chain: %w", err))
-		}
-	}
-
-	if ipt.Proto() == iptables.ProtocolIPv4 {
-		err := ipt.ClearChain("nat", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to clear chain: %w", err))
-		}
-
-		err = ipt.DeleteIfExists("nat", "POSTROUTING", "-m", "set", "--match-set", r.ipset.ipsetName+"_4", "dst", "-j", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to unlinking chain: %w", err))
-		}
-
-		err = ipt.DeleteChain("nat", r.chainName)
-		if err != nil && !(errors.As(err, iptErr) && (*iptErr).ExitStatus() == 2) {
-			errs = append(errs, fmt.Errorf("failed to delete chain: %w", err))
-		}
-	}
+// updateRules применяет изменения правил группы, old – правила до изменения
+func (r *IPSetToLink) updateRules(old LinkSpec) error {
+	spec := r.spec()
+	err := r.nh.backend.UpdateLink(old, spec)
+	r.nh.registerLink(r, r.priority, spec)
+	return err
+}
 
-	return errors.Join(errs...)
+// usesMainTable сообщает, что группа-исключение маршрутизируется по основной таблице
+func (r *IPSetToLink) usesMainTable() bool {
+	return r.bypass && r.ifaceName == "" && r.gateway == nil && len(r.nexthops) == 0
 }
 
 func (r *IPSetToLink) insertIPRule() error {
 	rule := netlink.NewRule()
 	rule.Mark = r.mark
+	if r.markMask != 0 {
+		mask := r.markMask
+		rule.Mask = &mask
+	}
 	rule.Table = r.table
-	_ = netlink.RuleDel(rule)
-	err := netlink.RuleAdd(rule)
+	if r.bypass {
+		rule.Priority = bypassRulePriority
+	}
+	if r.usesMainTable() {
+		rule.Table = unix.RT_TABLE_MAIN
+	}
+	_ = r.nh.netlink.RuleDel(rule)
+	err := r.nh.netlink.RuleAdd(rule)
 	if err != nil {
 		return fmt.Errorf("error while mapping marked packages to table: %w", err)
 	}
@@ -190,7 +145,7 @@ func (r *IPSetToLink) deleteIPRule() error {
 		return nil
 	}
 
-	err := netlink.RuleDel(r.ip4Rule)
+	err := r.nh.netlink.RuleDel(r.ip4Rule)
 	if err != nil {
 		return fmt.Errorf("error while deleting rule: %w", err)
 	}
@@ -198,26 +153,91 @@ func (r *IPSetToLink) deleteIPRule() error {
 	return nil
 }
 
-func (r *IPSetToLink) insertIPRoute() error {
-	iface, err := netlink.LinkByName(r.ifaceName)
-	if err != nil {
-		if errors.As(err, &netlink.LinkNotFoundError{}) {
-			log.Warn().Str("iface", r.ifaceName).Msg("interface not found, it can be catched later")
-			return nil
+// outInterfaces возвращает интерфейсы, через которые уходит трафик группы
+func (r *IPSetToLink) outInterfaces() []string {
+	if len(r.nexthops) == 0 {
+		return []string{r.ifaceName}
+	}
+	ifaceNames := make([]string, len(r.nexthops))
+	for idx, nexthop := range r.nexthops {
+		ifaceNames[idx] = nexthop.IfaceName
+	}
+	return ifaceNames
+}
+
+// defaultRoute собирает маршрут по умолчанию для таблицы группы.
+// Возвращает nil, если ни один интерфейс сейчас недоступен.
+func (r *IPSetToLink) defaultRoute() (*netlink.Route, error) {
+	route := &netlink.Route{
+		Table: r.table,
+		Dst:   &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+	}
+
+	if len(r.nexthops) == 0 && r.gateway != nil {
+		route.Gw = r.gateway
+		if r.ifaceName == "" {
+			// Интерфейс к шлюзу ядро найдёт само по основной таблице
+			return route, nil
+		}
+	}
+
+	if len(r.nexthops) == 0 {
+		iface, err := r.nh.netlink.LinkByName(r.ifaceName)
+		if err != nil {
+			if errors.Is(err, ErrLinkNotFound) {
+				log.Warn().Str("iface", r.ifaceName).Msg("interface not found, it can be catched later")
+				return nil, nil
+			}
+			return nil, fmt.Errorf("error while getting interface: %w", err)
 		}
-		return fmt.Errorf("error while getting interface: %w", err)
+		if iface.Attrs().Flags&net.FlagUp == 0 {
+			log.Warn().Str("iface", r.ifaceName).Msg("interface is down")
+			return nil, nil
+		}
+		route.LinkIndex = iface.Attrs().Index
+		return route, nil
 	}
-	if iface.Attrs().Flags&net.FlagUp == 0 {
-		log.Warn().Str("iface", r.ifaceName).Msg("interface is down")
+
+	// ECMP: ядро выбирает путь по хэшу потока, поэтому соединения не перескакивают между интерфейсами
+	for _, nexthop := range r.nexthops {
+		iface, err := r.nh.netlink.LinkByName(nexthop.IfaceName)
+		if err != nil {
+			if errors.Is(err, ErrLinkNotFound) {
+				log.Warn().Str("iface", nexthop.IfaceName).Msg("interface not found, skipping nexthop")
+				continue
+			}
+			return nil, fmt.Errorf("error while getting interface: %w", err)
+		}
+		if iface.Attrs().Flags&net.FlagUp == 0 {
+			log.Warn().Str("iface", nexthop.IfaceName).Msg("interface is down, skipping nexthop")
+			continue
+		}
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: iface.Attrs().Index,
+			Hops:      nexthop.Weight - 1,
+		})
+	}
+	if len(route.MultiPath) == 0 {
+		log.Warn().Msg("all nexthops are unavailable")
+		return nil, nil
+	}
+	return route, nil
+}
+
+func (r *IPSetToLink) insertIPRoute() error {
+	if r.usesMainTable() {
 		return nil
 	}
+	if len(r.nexthops) != 0 || r.gateway != nil {
+		// Набор путей или шлюз могли измениться, добавление не обновит существующий маршрут
+		return r.replaceIPRoute()
+	}
 
-	route := &netlink.Route{
-		LinkIndex: iface.Attrs().Index,
-		Table:     r.table,
-		Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+	route, err := r.defaultRoute()
+	if err != nil || route == nil {
+		return err
 	}
-	err = netlink.RouteAdd(route)
+	err = r.nh.netlink.RouteAdd(route)
 	if err != nil {
 		// TODO: Нормально отлавливать ошибку
 		if err.Error() == "file exists" {
@@ -231,54 +251,71 @@ func (r *IPSetToLink) insertIPRoute() error {
 	return nil
 }
 
-func (r *IPSetToLink) deleteIPRoute() error {
-	if r.ip4Route == nil {
+// replaceIPRoute атомарно заменяет маршрут по умолчанию в таблице группы на текущие интерфейсы
+func (r *IPSetToLink) replaceIPRoute() error {
+	if r.usesMainTable() {
 		return nil
 	}
-
-	err := netlink.RouteDel(r.ip4Route)
+	route, err := r.defaultRoute()
 	if err != nil {
-		return fmt.Errorf("error while deleting route: %w", err)
+		return err
 	}
-	r.ip4Route = nil
+	if route == nil {
+		return r.deleteIPRoute()
+	}
+	err = r.nh.netlink.RouteReplace(route)
+	if err != nil {
+		return fmt.Errorf("error while replacing route: %w", err)
+	}
+	r.ip4Route = route
 	return nil
 }
 
-func (r *IPSetToLink) getUnusedMarkAndTable() (mark uint32, table int, err error) {
-	// Find unused mark and table
-	markMap := make(map[uint32]struct{})
-	tableMap := map[int]struct{}{0: {}, 253: {}, 254: {}, 255: {}}
+// insertKillSwitchRoute добавляет в таблицу группы запасной маршрут unreachable, чтобы
+// при пропаже интерфейса помеченные пакеты не уходили по основной таблице
+func (r *IPSetToLink) insertKillSwitchRoute() error {
+	if !r.killSwitch || r.usesMainTable() {
+		return nil
+	}
 
-	rules, err := netlink.RuleList(nl.FAMILY_ALL)
+	route := &netlink.Route{
+		Table:    r.table,
+		Dst:      &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Type:     unix.RTN_UNREACHABLE,
+		Priority: killSwitchMetric,
+	}
+	err := r.nh.netlink.RouteReplace(route)
 	if err != nil {
-		return 0, 0, fmt.Errorf("error while getting rules: %w", err)
+		return fmt.Errorf("error while adding kill switch route: %w", err)
 	}
-	for _, rule := range rules {
-		markMap[rule.Mark] = struct{}{}
-		tableMap[rule.Table] = struct{}{}
+	r.ip4KillSwitch = route
+	return nil
+}
+
+func (r *IPSetToLink) deleteKillSwitchRoute() error {
+	if r.ip4KillSwitch == nil {
+		return nil
 	}
 
-	routes, err := netlink.RouteListFiltered(nl.FAMILY_ALL, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+	err := r.nh.netlink.RouteDel(r.ip4KillSwitch)
 	if err != nil {
-		return 0, 0, fmt.Errorf("error while getting routes: %w", err)
-	}
-	for _, route := range routes {
-		tableMap[route.Table] = struct{}{}
+		return fmt.Errorf("error while deleting kill switch route: %w", err)
 	}
+	r.ip4KillSwitch = nil
+	return nil
+}
 
-	for table = 0; table < 0x7ffffffe; table++ {
-		if _, exists := tableMap[table]; !exists {
-			break
-		}
+func (r *IPSetToLink) deleteIPRoute() error {
+	if r.ip4Route == nil {
+		return nil
 	}
 
-	for mark = 0; mark < 0xfffffffe; mark++ {
-		if _, exists := markMap[mark]; !exists {
-			break
-		}
+	err := r.nh.netlink.RouteDel(r.ip4Route)
+	if err != nil {
+		return fmt.Errorf("error while deleting route: %w", err)
 	}
-
-	return mark, table, nil
+	r.ip4Route = nil
+	return nil
 }
 
 func (r *IPSetToLink) enable() error {
@@ -286,38 +323,31 @@ func (r *IPSetToLink) enable() error {
 		return nil
 	}
 
-	var err error
-	r.mark, r.table, err = r.getUnusedMarkAndTable()
-	if err != nil {
-		return err
+	if r.mark == 0 || r.table == 0 {
+		return ErrNoMarkAndTable
 	}
 
-	err = r.deleteIPTablesRules(r.nh.IPTables4)
+	err := r.deleteRules()
 	if err != nil {
 		return err
 	}
 
-	err = r.insertIPTablesRules(r.nh.IPTables4, "")
+	err = r.insertRules("", "")
 	if err != nil {
 		return err
 	}
 
-	err = r.deleteIPTablesRules(r.nh.IPTables6)
-	if err != nil {
-		return err
-	}
-
-	err = r.insertIPTablesRules(r.nh.IPTables6, "")
+	err = r.insertIPRule()
 	if err != nil {
 		return err
 	}
 
-	err = r.insertIPRule()
+	err = r.insertIPRoute()
 	if err != nil {
 		return err
 	}
 
-	err = r.insertIPRoute()
+	err = r.insertKillSwitchRoute()
 	if err != nil {
 		return err
 	}
@@ -347,9 +377,9 @@ func (r *IPSetToLink) disable() error {
 
 	var errs []error
 	errs = append(errs, r.deleteIPRoute())
+	errs = append(errs, r.deleteKillSwitchRoute())
 	errs = append(errs, r.deleteIPRule())
-	errs = append(errs, r.deleteIPTablesRules(r.nh.IPTables4))
-	errs = append(errs, r.deleteIPTablesRules(r.nh.IPTables6))
+	errs = append(errs, r.deleteRules())
 	return errors.Join(errs...)
 }
 
@@ -370,12 +400,271 @@ func (r *IPSetToLink) ClearIfDisabled() error {
 
 	var errs []error
 	errs = append(errs, r.deleteIPRoute())
+	errs = append(errs, r.deleteKillSwitchRoute())
 	errs = append(errs, r.deleteIPRule())
-	errs = append(errs, r.deleteIPTablesRules(r.nh.IPTables4))
-	errs = append(errs, r.deleteIPTablesRules(r.nh.IPTables6))
+	errs = append(errs, r.deleteRules())
 	return errors.Join(errs...)
 }
 
+// SetMarkAndTable задаёт метку группы, маску её бит и таблицу маршрутизации
+func (r *IPSetToLink) SetMarkAndTable(mark, markMask uint32, table int) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.mark == mark && r.markMask == markMask && r.table == table {
+		return nil
+	}
+
+	if !r.enabled.Load() {
+		r.mark, r.markMask, r.table = mark, markMask, table
+		return nil
+	}
+
+	// Меняются правило маршрутизации, маршруты и маркировка, проще пересоздать всё
+	var errs []error
+	errs = append(errs, r.disable())
+	r.mark, r.markMask, r.table = mark, markMask, table
+	errs = append(errs, r.enable())
+	return errors.Join(errs...)
+}
+
+// SetPriority задаёт место группы в цепочке-диспетчере (меньше – раньше)
+func (r *IPSetToLink) SetPriority(priority int) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.priority == priority {
+		return nil
+	}
+	r.priority = priority
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	r.nh.registerLink(r, priority, r.spec())
+	return r.nh.syncDispatcher()
+}
+
+// SetInterface переключает группу на другой интерфейс: меняет разрешающее правило
+// в filter и заменяет маршрут по умолчанию в таблице группы
+func (r *IPSetToLink) SetInterface(ifaceName string) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.ifaceName == ifaceName {
+		return nil
+	}
+	old := r.spec()
+	r.ifaceName = ifaceName
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	var errs []error
+	errs = append(errs, r.updateRules(old))
+	errs = append(errs, r.replaceIPRoute())
+	return errors.Join(errs...)
+}
+
+// SetNexthops включает балансировку между интерфейсами. Пустой список возвращает
+// маршрут через один интерфейс.
+func (r *IPSetToLink) SetNexthops(nexthops []Nexthop) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	old := r.spec()
+	r.nexthops = nexthops
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	var errs []error
+	errs = append(errs, r.updateRules(old))
+	errs = append(errs, r.replaceIPRoute())
+	return errors.Join(errs...)
+}
+
+// SetBypass делает группу исключением: её трафик идёт мимо VPN по основной таблице
+// (или через заданный интерфейс/шлюз) с приоритетным правилом маршрутизации
+func (r *IPSetToLink) SetBypass(bypass bool) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.bypass == bypass {
+		return nil
+	}
+
+	if !r.enabled.Load() {
+		r.bypass = bypass
+		return nil
+	}
+
+	// Меняются правило маршрутизации и набор цепочек, проще пересоздать всё
+	var errs []error
+	errs = append(errs, r.disable())
+	r.bypass = bypass
+	errs = append(errs, r.enable())
+	return errors.Join(errs...)
+}
+
+// SetKillSwitch включает блокировку трафика группы, пока её интерфейс недоступен
+func (r *IPSetToLink) SetKillSwitch(killSwitch bool) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.killSwitch == killSwitch {
+		return nil
+	}
+	old := r.spec()
+	r.killSwitch = killSwitch
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	var errs []error
+	errs = append(errs, r.updateRules(old))
+	if killSwitch {
+		errs = append(errs, r.insertKillSwitchRoute())
+	} else {
+		errs = append(errs, r.deleteKillSwitchRoute())
+	}
+	return errors.Join(errs...)
+}
+
+// SetRouteLocal включает маршрутизацию через группу трафика самого роутера
+// (opkg, curl, сервисы Entware). Адрес отправителя исправляет маскарадинг группы.
+func (r *IPSetToLink) SetRouteLocal(routeLocal bool) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.routeLocal == routeLocal {
+		return nil
+	}
+	old := r.spec()
+	r.routeLocal = routeLocal
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	var errs []error
+	errs = append(errs, r.updateRules(old))
+	errs = append(errs, r.nh.syncDispatcher())
+	return errors.Join(errs...)
+}
+
+// SetClients ограничивает группу клиентами из набора и клиентами с заданными MAC-адресами.
+// Без набора и MAC-адресов группа действует для всех.
+func (r *IPSetToLink) SetClients(clientSet *IPSet, macs []net.HardwareAddr) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.clientSet == clientSet && slices.EqualFunc(r.clientMACs, macs, func(a, b net.HardwareAddr) bool { return bytes.Equal(a, b) }) {
+		return nil
+	}
+	old := r.spec()
+	r.clientSet = clientSet
+	r.clientMACs = macs
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	var errs []error
+	errs = append(errs, r.updateRules(old))
+	errs = append(errs, r.nh.syncDispatcher())
+	return errors.Join(errs...)
+}
+
+// SetSource переключает группу на выбор трафика по источнику: весь трафик клиентов группы
+// уходит в её интерфейс, а адреса из ipset становятся исключениями
+func (r *IPSetToLink) SetSource(source bool) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.source == source {
+		return nil
+	}
+	old := r.spec()
+	r.source = source
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	var errs []error
+	errs = append(errs, r.updateRules(old))
+	errs = append(errs, r.nh.syncDispatcher())
+	return errors.Join(errs...)
+}
+
+// SetPorts ограничивает группу протоколами и портами назначения, пустой список – весь трафик
+func (r *IPSetToLink) SetPorts(ports []PortRange) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if slices.Equal(r.ports, ports) {
+		return nil
+	}
+	old := r.spec()
+	r.ports = ports
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	var errs []error
+	errs = append(errs, r.updateRules(old))
+	errs = append(errs, r.nh.syncDispatcher())
+	return errors.Join(errs...)
+}
+
+// SetGateway задаёт шлюз для маршрута по умолчанию группы, nil – маршрут только через интерфейс
+func (r *IPSetToLink) SetGateway(gateway net.IP) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if r.gateway.Equal(gateway) {
+		return nil
+	}
+	r.gateway = gateway
+	r.gatewayReachable = true
+
+	if !r.enabled.Load() {
+		return nil
+	}
+	return r.replaceIPRoute()
+}
+
+// NeighUpdateHook следит за доступностью шлюза по таблице соседей и переустанавливает
+// маршрут, когда шлюз снова становится доступен
+func (r *IPSetToLink) NeighUpdateHook(event netlink.NeighUpdate) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if !r.enabled.Load() || r.gateway == nil || !event.IP.Equal(r.gateway) {
+		return nil
+	}
+
+	reachable := event.Type == unix.RTM_NEWNEIGH &&
+		event.State&(netlink.NUD_REACHABLE|netlink.NUD_STALE|netlink.NUD_DELAY|netlink.NUD_PROBE|netlink.NUD_PERMANENT|netlink.NUD_NOARP) != 0
+	unreachable := event.Type == unix.RTM_DELNEIGH || event.State&netlink.NUD_FAILED != 0
+	switch {
+	case reachable && !r.gatewayReachable:
+		r.gatewayReachable = true
+		log.Info().Str("gateway", r.gateway.String()).Msg("gateway is reachable again")
+		return r.replaceIPRoute()
+	case unreachable && r.gatewayReachable:
+		r.gatewayReachable = false
+		log.Warn().Str("gateway", r.gateway.String()).Msg("gateway is unreachable")
+	}
+	return nil
+}
+
 func (r *IPSetToLink) NetfilterDHook(iptType, table string) error {
 	r.locker.Lock()
 	defer r.locker.Unlock()
@@ -384,40 +673,162 @@ func (r *IPSetToLink) NetfilterDHook(iptType, table string) error {
 		return nil
 	}
 
-	if iptType == "" || iptType == "iptables" {
-		err := r.insertIPTablesRules(r.nh.IPTables4, table)
-		if err != nil {
-			return err
-		}
+	return r.insertRules(iptType, table)
+}
+
+// LinkUpdateHook поддерживает маршрут группы при включении и выключении интерфейса,
+// его удалении, пересоздании с новым индексом и переименовании
+func (r *IPSetToLink) LinkUpdateHook(event netlink.LinkUpdate) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if !r.enabled.Load() {
+		return nil
 	}
-	if iptType == "" || iptType == "ip6tables" {
-		err := r.insertIPTablesRules(r.nh.IPTables6, table)
+
+	attrs := event.Link.Attrs()
+	used := slices.Contains(r.outInterfaces(), attrs.Name)
+	routed := slices.Contains(routeLinks(r.ip4Route), attrs.Index)
+	if !used && !routed {
+		return nil
+	}
+
+	if routed && (event.Header.Type == unix.RTM_DELLINK || attrs.Flags&net.FlagUp == 0) {
+		// Маршруты через удалённый или выключенный интерфейс ядро удаляет само
+		r.ip4Route = nil
+	}
+
+	if used && r.ip4Route != nil && event.Header.Type == unix.RTM_NEWLINK {
+		route, err := r.defaultRoute()
 		if err != nil {
 			return err
 		}
+		// Событие не меняет маршрут, например изменился MTU
+		if route != nil && slices.Equal(routeLinks(route), routeLinks(r.ip4Route)) {
+			return nil
+		}
 	}
 
-	return nil
+	// Маршрут строится заново по именам интерфейсов: пересозданный интерфейс получит
+	// новый индекс, а переименованный перестанет использоваться
+	return r.replaceIPRoute()
 }
 
-func (r *IPSetToLink) LinkUpdateHook(event netlink.LinkUpdate) error {
+// ChainName возвращает имя цепочки связки, по нему выдаются счётчики трафика
+func (r *IPSetToLink) ChainName() string {
+	return r.chainName
+}
+
+// RouteLinks возвращает индексы интерфейсов, через которые сейчас проложен маршрут группы
+func (r *IPSetToLink) RouteLinks() []int {
 	r.locker.Lock()
 	defer r.locker.Unlock()
 
-	if !r.enabled.Load() || event.Change != 1 || event.Link.Attrs().Name != r.ifaceName {
+	return routeLinks(r.ip4Route)
+}
+
+// routeLinks возвращает индексы интерфейсов маршрута
+func routeLinks(route *netlink.Route) []int {
+	if route == nil {
 		return nil
 	}
+	if len(route.MultiPath) == 0 {
+		if route.LinkIndex == 0 {
+			return nil
+		}
+		return []int{route.LinkIndex}
+	}
+	links := make([]int, len(route.MultiPath))
+	for idx, nexthop := range route.MultiPath {
+		links[idx] = nexthop.LinkIndex
+	}
+	return links
+}
+
+// Reconcile проверяет правило маршрутизации и маршруты группы и восстанавливает удалённые
+// извне. Возвращает список исправленного.
+func (r *IPSetToLink) Reconcile() ([]string, error) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
 
+	if !r.enabled.Load() {
+		return nil, nil
+	}
+
+	var repaired []string
 	var errs []error
-	errs = append(errs, r.insertIPRoute())
-	return errors.Join(errs...)
+
+	if r.ip4Rule != nil {
+		rules, err := r.nh.netlink.RuleList(nl.FAMILY_V4)
+		if err != nil {
+			return nil, fmt.Errorf("error while getting rules: %w", err)
+		}
+		// Правилу без приоритета его назначает ядро, поэтому приоритет сравнивается, только если задан
+		if !slices.ContainsFunc(rules, func(rule netlink.Rule) bool {
+			return rule.Mark == r.ip4Rule.Mark && ruleMaskEqual(rule.Mask, r.ip4Rule.Mask) && rule.Table == r.ip4Rule.Table &&
+				(r.ip4Rule.Priority < 0 || rule.Priority == r.ip4Rule.Priority)
+		}) {
+			repaired = append(repaired, "ip rule")
+			errs = append(errs, r.insertIPRule())
+		}
+	}
+
+	if !r.usesMainTable() {
+		routes, err := r.nh.netlink.RouteListFiltered(nl.FAMILY_V4, &netlink.Route{Table: r.table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, fmt.Errorf("error while getting routes: %w", err)
+		}
+		hasRoute := func(priority int) bool {
+			return slices.ContainsFunc(routes, func(route netlink.Route) bool {
+				return route.Table == r.table && route.Priority == priority && isDefaultDst(route.Dst)
+			})
+		}
+
+		// Маршрута нет и при недоступном интерфейсе, тогда восстанавливать нечего
+		route, err := r.defaultRoute()
+		if err != nil {
+			errs = append(errs, err)
+		} else if route != nil && !hasRoute(0) {
+			repaired = append(repaired, "route")
+			errs = append(errs, r.replaceIPRoute())
+		}
+
+		if r.ip4KillSwitch != nil && !hasRoute(killSwitchMetric) {
+			repaired = append(repaired, "kill switch route")
+			errs = append(errs, r.insertKillSwitchRoute())
+		}
+	}
+
+	return repaired, errors.Join(errs...)
 }
 
-func (nh *NetfilterHelper) IPSetToLink(name string, ifaceName string, ipset *IPSet) *IPSetToLink {
+// ruleMaskEqual сравнивает маски правил, отсутствующая маска – все биты
+func ruleMaskEqual(a, b *uint32) bool {
+	maskValue := func(mask *uint32) uint32 {
+		if mask == nil {
+			return 0xffffffff
+		}
+		return *mask
+	}
+	return maskValue(a) == maskValue(b)
+}
+
+func isDefaultDst(dst *net.IPNet) bool {
+	if dst == nil {
+		return true
+	}
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+func (nh *NetfilterHelper) IPSetToLink(name string, ifaceName string, ipset *IPSet, priority int) *IPSetToLink {
 	return &IPSetToLink{
 		nh:        nh,
 		chainName: nh.ChainPrefix + name,
 		ifaceName: ifaceName,
 		ipset:     ipset,
+		priority:  priority,
+
+		gatewayReachable: true,
 	}
 }
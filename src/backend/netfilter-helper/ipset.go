@@ -1,15 +1,10 @@
 package netfilterHelper
 
 import (
-	"errors"
 	"fmt"
 	"net"
-	"os"
 	"sync"
 	"sync/atomic"
-
-	"github.com/vishvananda/netlink"
-	"golang.org/x/sys/unix"
 )
 
 type IPSet struct {
@@ -17,6 +12,7 @@ type IPSet struct {
 	locker  sync.Mutex
 
 	ipsetName string
+	nh        *NetfilterHelper
 }
 
 func (r *IPSet) AddIP(addr net.IP, timeout *uint32) error {
@@ -27,21 +23,10 @@ func (r *IPSet) AddIP(addr net.IP, timeout *uint32) error {
 		return nil
 	}
 
-	var err error
-
-	if len(addr) == net.IPv4len {
-		err = netlink.IpsetAdd(r.ipsetName+"_4", &netlink.IPSetEntry{
-			IP:      addr,
-			Timeout: timeout,
-			Replace: true,
-		})
-	} else if len(addr) == net.IPv6len {
-		err = netlink.IpsetAdd(r.ipsetName+"_6", &netlink.IPSetEntry{
-			IP:      addr,
-			Timeout: timeout,
-			Replace: true,
-		})
+	if len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+		return nil
 	}
+	err := r.nh.backend.AddSetEntry(r.ipsetName, SetEntry{Net: hostNet(addr), Timeout: timeout})
 	if err != nil {
 		return fmt.Errorf("failed to add address: %w", err)
 	}
@@ -57,17 +42,10 @@ func (r *IPSet) DelIP(addr net.IP) error {
 		return nil
 	}
 
-	var err error
-
-	if len(addr) == net.IPv4len {
-		err = netlink.IpsetDel(r.ipsetName+"_4", &netlink.IPSetEntry{
-			IP: addr,
-		})
-	} else if len(addr) == net.IPv6len {
-		err = netlink.IpsetDel(r.ipsetName+"_6", &netlink.IPSetEntry{
-			IP: addr,
-		})
+	if len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+		return nil
 	}
+	err := r.nh.backend.DelSetEntry(r.ipsetName, hostNet(addr))
 	if err != nil {
 		return fmt.Errorf("failed to delete address: %w", err)
 	}
@@ -83,61 +61,77 @@ func (r *IPSet) ListIPs() (map[string]*uint32, error) {
 		return nil, nil
 	}
 
-	addresses := make(map[string]*uint32)
-
-	list, err := netlink.IpsetList(r.ipsetName + "_4")
+	entries, err := r.nh.backend.ListSetEntries(r.ipsetName)
 	if err != nil {
 		return nil, err
 	}
-	for _, entry := range list.Entries {
-		addresses[string(entry.IP)] = entry.Timeout
-	}
 
-	list, err = netlink.IpsetList(r.ipsetName + "_6")
-	if err != nil {
-		return nil, err
-	}
-	for _, entry := range list.Entries {
-		addresses[string(entry.IP)] = entry.Timeout
+	addresses := make(map[string]*uint32)
+	for _, entry := range entries {
+		if !isHostNet(entry.Net) {
+			continue
+		}
+		addresses[string(entry.Net.IP)] = entry.Timeout
 	}
 
 	return addresses, nil
 }
 
-func (r *IPSet) ipsetCreate() error {
-	err := netlink.IpsetCreate(r.ipsetName+"_4", "hash:net", netlink.IpsetCreateOptions{
-		Timeout: func(i uint32) *uint32 { return &i }(300),
-		Family:  unix.AF_INET,
-	})
+func (r *IPSet) AddNet(ipNet net.IPNet, timeout *uint32) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	err := r.nh.backend.AddSetEntry(r.ipsetName, SetEntry{Net: ipNet, Timeout: timeout})
 	if err != nil {
-		return fmt.Errorf("failed to create ipset: %w", err)
+		return fmt.Errorf("failed to add network: %w", err)
+	}
+
+	return nil
+}
+
+func (r *IPSet) DelNet(ipNet net.IPNet) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if !r.enabled.Load() {
+		return nil
 	}
 
-	err = netlink.IpsetCreate(r.ipsetName+"_6", "hash:net", netlink.IpsetCreateOptions{
-		Timeout: func(i uint32) *uint32 { return &i }(300),
-		Family:  unix.AF_INET6,
-	})
+	err := r.nh.backend.DelSetEntry(r.ipsetName, ipNet)
 	if err != nil {
-		return fmt.Errorf("failed to create ipset: %w", err)
+		return fmt.Errorf("failed to delete network: %w", err)
 	}
 
 	return nil
 }
 
-func (r *IPSet) ipsetDestroy() error {
-	var errs []error
-	err := netlink.IpsetDestroy(r.ipsetName + "_4")
-	if err != nil && !os.IsNotExist(err) {
-		errs = append(errs, err)
+// ListNets returns the subnet entries (not single addresses) keyed by CIDR notation
+func (r *IPSet) ListNets() (map[string]net.IPNet, error) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if !r.enabled.Load() {
+		return nil, nil
 	}
-	err = netlink.IpsetDestroy(r.ipsetName + "_6")
-	if err != nil && !os.IsNotExist(err) {
-		errs = append(errs, err)
+
+	entries, err := r.nh.backend.ListSetEntries(r.ipsetName)
+	if err != nil {
+		return nil, err
 	}
-	if errs != nil {
-		return fmt.Errorf("failed to destroy ipsets: %w", errors.Join(errs...))
+
+	nets := make(map[string]net.IPNet)
+	for _, entry := range entries {
+		if isHostNet(entry.Net) {
+			continue
+		}
+		nets[entry.Net.String()] = entry.Net
 	}
-	return nil
+
+	return nets, nil
 }
 
 func (r *IPSet) enable() error {
@@ -145,12 +139,12 @@ func (r *IPSet) enable() error {
 		return nil
 	}
 
-	err := r.ipsetDestroy()
+	err := r.nh.backend.DestroySet(r.ipsetName)
 	if err != nil {
 		return err
 	}
 
-	err = r.ipsetCreate()
+	err = r.nh.backend.CreateSet(r.ipsetName)
 	if err != nil {
 		return err
 	}
@@ -176,7 +170,7 @@ func (r *IPSet) disable() error {
 	}
 	defer r.enabled.Store(false)
 
-	return r.ipsetDestroy()
+	return r.nh.backend.DestroySet(r.ipsetName)
 }
 
 func (r *IPSet) Disable() error {
@@ -189,5 +183,6 @@ func (r *IPSet) Disable() error {
 func (nh *NetfilterHelper) IPSet(name string) *IPSet {
 	return &IPSet{
 		ipsetName: nh.IpsetPrefix + name,
+		nh:        nh,
 	}
 }
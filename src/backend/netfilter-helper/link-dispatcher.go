@@ -0,0 +1,60 @@
+package netfilterHelper
+
+import (
+	"sort"
+)
+
+// Все группы маркируются из одной цепочки-диспетчера в mangle PREROUTING.
+// Группы в ней идут по приоритету, и после первой совпавшей группы диспетчер
+// возвращается, поэтому пакет получает метку только одной группы. Группы-исключения
+// всегда стоят в начале, чтобы их адреса не забирали другие группы.
+
+type registeredLink struct {
+	priority int
+	spec     LinkSpec
+}
+
+// registerLink добавляет связку в диспетчер или обновляет её приоритет и правила
+func (nh *NetfilterHelper) registerLink(r *IPSetToLink, priority int, spec LinkSpec) {
+	nh.linksLocker.Lock()
+	defer nh.linksLocker.Unlock()
+	nh.links[r] = registeredLink{priority: priority, spec: spec}
+}
+
+func (nh *NetfilterHelper) unregisterLink(r *IPSetToLink) {
+	nh.linksLocker.Lock()
+	defer nh.linksLocker.Unlock()
+	delete(nh.links, r)
+}
+
+// orderedLinks возвращает правила зарегистрированных связок: сначала группы-исключения,
+// затем остальные, внутри каждой части – в порядке приоритета
+func (nh *NetfilterHelper) orderedLinks() []LinkSpec {
+	nh.linksLocker.Lock()
+	defer nh.linksLocker.Unlock()
+
+	links := make([]registeredLink, 0, len(nh.links))
+	for _, link := range nh.links {
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].spec.Bypass != links[j].spec.Bypass {
+			return links[i].spec.Bypass
+		}
+		if links[i].priority != links[j].priority {
+			return links[i].priority < links[j].priority
+		}
+		return links[i].spec.Chain < links[j].spec.Chain
+	})
+
+	specs := make([]LinkSpec, len(links))
+	for idx, link := range links {
+		specs[idx] = link.spec
+	}
+	return specs
+}
+
+// syncDispatcher пересобирает цепочку-диспетчер из зарегистрированных связок
+func (nh *NetfilterHelper) syncDispatcher() error {
+	return nh.backend.SyncDispatcher(nh.orderedLinks())
+}
@@ -1,39 +1,97 @@
 package netfilterHelper
 
 import (
+	"errors"
 	"fmt"
-	"github.com/coreos/go-iptables/iptables"
+	"sync"
 )
 
 type NetfilterHelper struct {
 	ChainPrefix string
 	IpsetPrefix string
-	IPTables4   *iptables.IPTables
-	IPTables6   *iptables.IPTables
+
+	backend Backend
+	netlink Netlink
+
+	linksLocker sync.Mutex
+	links       map[*IPSetToLink]registeredLink
 }
 
-func New(chainPrefix, ipsetPrefix string, disableIPv4, disableIPv6 bool) (*NetfilterHelper, error) {
+func New(backend, chainPrefix, ipsetPrefix string, disableIPv4, disableIPv6 bool) (*NetfilterHelper, error) {
+	var b Backend
 	var err error
-	var ipt4, ipt6 *iptables.IPTables
-
-	if !disableIPv4 {
-		ipt4, err = iptables.New(iptables.IPFamily(iptables.ProtocolIPv4))
-		if err != nil {
-			return nil, fmt.Errorf("iptables init fail: %w", err)
-		}
+	switch backend {
+	case "", BackendIPTables:
+		b, err = NewIPTablesBackend(chainPrefix, disableIPv4, disableIPv6)
+	case BackendNFTables:
+		b, err = NewNFTablesBackend(chainPrefix, disableIPv4, disableIPv6)
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
 	}
-
-	if !disableIPv6 {
-		ipt6, err = iptables.New(iptables.IPFamily(iptables.ProtocolIPv6))
-		if err != nil {
-			return nil, fmt.Errorf("ip6tables init fail: %w", err)
-		}
+	if err != nil {
+		return nil, err
 	}
 
+	return NewWithBackend(b, KernelNetlink, chainPrefix, ipsetPrefix), nil
+}
+
+// NewWithBackend создаёт хелпер с заданными реализациями правил и netlink
+func NewWithBackend(backend Backend, nl Netlink, chainPrefix, ipsetPrefix string) *NetfilterHelper {
 	return &NetfilterHelper{
 		ChainPrefix: chainPrefix,
 		IpsetPrefix: ipsetPrefix,
-		IPTables4:   ipt4,
-		IPTables6:   ipt6,
-	}, nil
+		backend:     backend,
+		netlink:     nl,
+		links:       make(map[*IPSetToLink]registeredLink),
+	}
+}
+
+// Backend возвращает используемую реализацию правил
+func (nh *NetfilterHelper) Backend() Backend {
+	return nh.backend
+}
+
+// Netlink возвращает используемую реализацию netlink
+func (nh *NetfilterHelper) Netlink() Netlink {
+	return nh.netlink
+}
+
+// BatchSetEntries выполняет fn и применяет сделанные в ней изменения наборов
+// одной транзакцией, если бэкенд это поддерживает
+func (nh *NetfilterHelper) BatchSetEntries(fn func()) (err error) {
+	batcher, ok := nh.backend.(SetEntryBatcher)
+	if !ok {
+		fn()
+		return nil
+	}
+	batcher.BeginSetEntries()
+	defer func() {
+		err = batcher.CommitSetEntries()
+	}()
+	fn()
+	return nil
+}
+
+// BatchRules выполняет fn и применяет сделанные в ней изменения правил разом,
+// если бэкенд это поддерживает. Вложенные пачки применяются с внешней.
+func (nh *NetfilterHelper) BatchRules(fn func() error) (err error) {
+	batcher, ok := nh.backend.(RuleBatcher)
+	if !ok {
+		return fn()
+	}
+	batcher.BeginRules()
+	defer func() {
+		err = errors.Join(err, batcher.CommitRules())
+	}()
+	return fn()
+}
+
+// Clean удаляет правила, оставшиеся от прошлого запуска
+func (nh *NetfilterHelper) Clean() error {
+	return nh.backend.Clean()
+}
+
+// Reconcile восстанавливает правила netfilter, изменённые извне
+func (nh *NetfilterHelper) Reconcile() (bool, error) {
+	return nh.backend.Reconcile()
 }
@@ -0,0 +1,119 @@
+package netfilterHelper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ErrLinkNotFound возвращается LinkByName, если интерфейса нет
+var ErrLinkNotFound = errors.New("link not found")
+
+// Netlink – вызовы netlink, через которые MagiTrickle работает с интерфейсами, правилами
+// и маршрутами. Интерфейс позволяет подменить ядро в тестах.
+type Netlink interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RuleList(family int) ([]netlink.Rule, error)
+
+	RouteAdd(route *netlink.Route) error
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RouteGetWithOptions(destination net.IP, options *netlink.RouteGetOptions) ([]netlink.Route, error)
+
+	ConntrackTableList(table netlink.ConntrackTableType, family netlink.InetFamily) ([]*netlink.ConntrackFlow, error)
+	ConntrackDeleteFilters(table netlink.ConntrackTableType, family netlink.InetFamily, filters ...netlink.CustomConntrackFilter) (uint, error)
+
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+	NeighSubscribe(ch chan<- netlink.NeighUpdate, done <-chan struct{}) error
+	RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error
+	AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error
+}
+
+// KernelNetlink – реализация Netlink поверх сокета netlink ядра
+var KernelNetlink Netlink = kernelNetlink{}
+
+type kernelNetlink struct{}
+
+func (kernelNetlink) LinkByName(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if errors.As(err, &netlink.LinkNotFoundError{}) {
+		return nil, fmt.Errorf("%w: %w", ErrLinkNotFound, err)
+	}
+	return link, err
+}
+
+func (kernelNetlink) LinkByIndex(index int) (netlink.Link, error) {
+	link, err := netlink.LinkByIndex(index)
+	if errors.As(err, &netlink.LinkNotFoundError{}) {
+		return nil, fmt.Errorf("%w: %w", ErrLinkNotFound, err)
+	}
+	return link, err
+}
+
+func (kernelNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (kernelNetlink) RuleAdd(rule *netlink.Rule) error {
+	return netlink.RuleAdd(rule)
+}
+
+func (kernelNetlink) RuleDel(rule *netlink.Rule) error {
+	return netlink.RuleDel(rule)
+}
+
+func (kernelNetlink) RuleList(family int) ([]netlink.Rule, error) {
+	return netlink.RuleList(family)
+}
+
+func (kernelNetlink) RouteAdd(route *netlink.Route) error {
+	return netlink.RouteAdd(route)
+}
+
+func (kernelNetlink) RouteReplace(route *netlink.Route) error {
+	return netlink.RouteReplace(route)
+}
+
+func (kernelNetlink) RouteDel(route *netlink.Route) error {
+	return netlink.RouteDel(route)
+}
+
+func (kernelNetlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	return netlink.RouteListFiltered(family, filter, filterMask)
+}
+
+func (kernelNetlink) RouteGetWithOptions(destination net.IP, options *netlink.RouteGetOptions) ([]netlink.Route, error) {
+	return netlink.RouteGetWithOptions(destination, options)
+}
+
+func (kernelNetlink) ConntrackTableList(table netlink.ConntrackTableType, family netlink.InetFamily) ([]*netlink.ConntrackFlow, error) {
+	return netlink.ConntrackTableList(table, family)
+}
+
+func (kernelNetlink) ConntrackDeleteFilters(table netlink.ConntrackTableType, family netlink.InetFamily, filters ...netlink.CustomConntrackFilter) (uint, error) {
+	return netlink.ConntrackDeleteFilters(table, family, filters...)
+}
+
+func (kernelNetlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	return netlink.LinkSubscribe(ch, done)
+}
+
+func (kernelNetlink) NeighSubscribe(ch chan<- netlink.NeighUpdate, done <-chan struct{}) error {
+	return netlink.NeighSubscribe(ch, done)
+}
+
+func (kernelNetlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	return netlink.RouteSubscribe(ch, done)
+}
+
+func (kernelNetlink) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	return netlink.AddrSubscribe(ch, done)
+}
@@ -0,0 +1,111 @@
+package netfilterHelper
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// PortBlock запрещает пересылку на порты TCP и UDP для пакетов, пришедших с интерфейсов
+type PortBlock struct {
+	enabled atomic.Bool
+	locker  sync.Mutex
+
+	chainName  string
+	interfaces []string
+	exemptSet  *IPSet
+	exemptMACs []net.HardwareAddr
+	ports      []uint16
+	set        *IPSet
+	setPorts   []uint16
+	nh         *NetfilterHelper
+}
+
+func (r *PortBlock) spec() BlockSpec {
+	spec := BlockSpec{
+		Chain:      r.chainName,
+		Interfaces: r.interfaces,
+		Ports:      r.ports,
+		ExemptMACs: r.exemptMACs,
+	}
+	if r.exemptSet != nil {
+		spec.ExemptSet = r.exemptSet.ipsetName
+	}
+	if r.set != nil {
+		spec.Set = r.set.ipsetName
+		spec.SetPorts = r.setPorts
+	}
+	return spec
+}
+
+func (r *PortBlock) enable() error {
+	if !r.enabled.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	err := r.nh.backend.DeleteBlock(r.spec())
+	if err != nil {
+		return err
+	}
+
+	err = r.nh.backend.InsertBlock(r.spec(), "", "")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *PortBlock) Enable() error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	err := r.enable()
+	if err != nil {
+		r.disable()
+	}
+
+	return err
+}
+
+func (r *PortBlock) disable() error {
+	if !r.enabled.Load() {
+		return nil
+	}
+	defer r.enabled.Store(false)
+
+	return r.nh.backend.DeleteBlock(r.spec())
+}
+
+func (r *PortBlock) Disable() error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	return r.disable()
+}
+
+func (r *PortBlock) NetfilterDHook(iptType, table string) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	return r.nh.backend.InsertBlock(r.spec(), iptType, table)
+}
+
+// PortBlock создаёт запрет портов ports для любых адресов и портов setPorts для адресов из set.
+// Устройства из exemptSet (может быть nil) и с MAC-адресами из exemptMACs под запрет не попадают.
+func (nh *NetfilterHelper) PortBlock(name string, interfaces []string, exemptSet *IPSet, exemptMACs []net.HardwareAddr, ports []uint16, set *IPSet, setPorts []uint16) *PortBlock {
+	return &PortBlock{
+		nh:         nh,
+		chainName:  nh.ChainPrefix + name,
+		interfaces: interfaces,
+		exemptSet:  exemptSet,
+		exemptMACs: exemptMACs,
+		ports:      ports,
+		set:        set,
+		setPorts:   setPorts,
+	}
+}
@@ -1,14 +1,10 @@
 package netfilterHelper
 
 import (
-	"errors"
-	"fmt"
 	"net"
-	"strconv"
 	"sync"
 	"sync/atomic"
 
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
 )
 
@@ -16,85 +12,34 @@ type PortRemap struct {
 	enabled atomic.Bool
 	locker  sync.Mutex
 
-	chainName string
-	addresses []netlink.Addr
-	from      uint16
-	to        uint16
-	nh        *NetfilterHelper
+	chainName  string
+	addresses  []netlink.Addr
+	interfaces []string
+	exemptSet  *IPSet
+	exemptMACs []net.HardwareAddr
+	from       uint16
+	to         uint16
+	nh         *NetfilterHelper
 }
 
-func (r *PortRemap) insertIPTablesRules(ipt *iptables.IPTables, table string) error {
-	if ipt == nil {
-		return nil
-	}
-	if table == "" || table == "nat" {
-		err := ipt.NewChain("nat", r.chainName)
-		if err != nil {
-			// If not "AlreadyExists"
-			if eerr, eok := err.(*iptables.Error); !(eok && eerr.ExitStatus() == 1) {
-				return fmt.Errorf("failed to create chain: %w", err)
-			}
-		}
-
-		for _, addr := range r.addresses {
-			if !((ipt.Proto() == iptables.ProtocolIPv4 && len(addr.IP) == net.IPv4len) || (ipt.Proto() == iptables.ProtocolIPv6 && len(addr.IP) == net.IPv6len)) {
-				continue
-			}
-
-			if ipt.Proto() != iptables.ProtocolIPv6 {
-				for _, iptablesArgs := range [][]string{
-					{"-p", "tcp", "-d", addr.IP.String(), "--dport", fmt.Sprintf("%d", r.from), "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", r.to)},
-					{"-p", "udp", "-d", addr.IP.String(), "--dport", fmt.Sprintf("%d", r.from), "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", r.to)},
-				} {
-					err = ipt.AppendUnique("nat", r.chainName, iptablesArgs...)
-					if err != nil {
-						return fmt.Errorf("failed to append rule: %w", err)
-					}
-				}
-			} else {
-				for _, iptablesArgs := range [][]string{
-					{"-p", "tcp", "-d", addr.IP.String(), "--dport", strconv.Itoa(int(r.from)), "-j", "DNAT", "--to-destination", fmt.Sprintf(":%d", r.to)},
-					{"-p", "udp", "-d", addr.IP.String(), "--dport", strconv.Itoa(int(r.from)), "-j", "DNAT", "--to-destination", fmt.Sprintf(":%d", r.to)},
-				} {
-					err = ipt.AppendUnique("nat", r.chainName, iptablesArgs...)
-					if err != nil {
-						return fmt.Errorf("failed to append rule: %w", err)
-					}
-				}
-			}
-		}
-
-		err = ipt.InsertUnique("nat", "PREROUTING", 1, "-j", r.chainName)
-		if err != nil {
-			return fmt.Errorf("failed to linking chain: %w", err)
-		}
-	}
-
-	return nil
-}
-
-func (r *PortRemap) deleteIPTablesRules(ipt *iptables.IPTables) error {
-	if ipt == nil {
-		return nil
-	}
-	var errs []error
-
-	err := ipt.ClearChain("nat", r.chainName)
-	if err != nil {
-		errs = append(errs, fmt.Errorf("failed to clear chain: %w", err))
+func (r *PortRemap) spec() RemapSpec {
+	spec := RemapSpec{
+		Chain:     r.chainName,
+		Addresses: make([]net.IP, len(r.addresses)),
+		From:      r.from,
+		To:        r.to,
 	}
-
-	err = ipt.DeleteIfExists("nat", "PREROUTING", "-j", r.chainName)
-	if err != nil {
-		errs = append(errs, fmt.Errorf("failed to unlinking chain: %w", err))
+	for idx, addr := range r.addresses {
+		spec.Addresses[idx] = addr.IP
 	}
-
-	err = ipt.DeleteChain("nat", r.chainName)
-	if err != nil {
-		errs = append(errs, fmt.Errorf("failed to delete chain: %w", err))
+	if len(r.interfaces) != 0 {
+		spec.Interfaces = r.interfaces
+		if r.exemptSet != nil {
+			spec.ExemptSet = r.exemptSet.ipsetName
+		}
+		spec.ExemptMACs = r.exemptMACs
 	}
-
-	return errors.Join(errs...)
+	return spec
 }
 
 func (r *PortRemap) enable() error {
@@ -102,22 +47,12 @@ func (r *PortRemap) enable() error {
 		return nil
 	}
 
-	err := r.deleteIPTablesRules(r.nh.IPTables4)
-	if err != nil {
-		return err
-	}
-
-	err = r.insertIPTablesRules(r.nh.IPTables4, "")
-	if err != nil {
-		return err
-	}
-
-	err = r.deleteIPTablesRules(r.nh.IPTables6)
+	err := r.nh.backend.DeleteRemap(r.spec())
 	if err != nil {
 		return err
 	}
 
-	err = r.insertIPTablesRules(r.nh.IPTables6, "")
+	err = r.nh.backend.InsertRemap(r.spec(), "", "")
 	if err != nil {
 		return err
 	}
@@ -143,10 +78,7 @@ func (r *PortRemap) disable() error {
 	}
 	defer r.enabled.Store(false)
 
-	var errs []error
-	errs = append(errs, r.deleteIPTablesRules(r.nh.IPTables4))
-	errs = append(errs, r.deleteIPTablesRules(r.nh.IPTables6))
-	return errors.Join(errs...)
+	return r.nh.backend.DeleteRemap(r.spec())
 }
 
 func (r *PortRemap) Disable() error {
@@ -156,28 +88,70 @@ func (r *PortRemap) Disable() error {
 	return r.disable()
 }
 
-func (r *PortRemap) NetfilterDHook(iptType, table string) error {
+// SetAddresses меняет адреса роутера, для которых перенаправляется порт
+func (r *PortRemap) SetAddresses(addresses []netlink.Addr) error {
 	r.locker.Lock()
 	defer r.locker.Unlock()
 
+	if sameAddresses(r.addresses, addresses) {
+		return nil
+	}
+	r.addresses = addresses
+
 	if !r.enabled.Load() {
 		return nil
 	}
 
-	if iptType == "" || iptType == "iptables" {
-		err := r.insertIPTablesRules(r.nh.IPTables4, table)
-		if err != nil {
-			return err
-		}
+	return r.nh.backend.InsertRemap(r.spec(), "", "")
+}
+
+// sameAddresses сравнивает адреса без учёта порядка
+func sameAddresses(a, b []netlink.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, addr := range a {
+		seen[addr.IP.String()]++
 	}
-	if iptType == "" || iptType == "ip6tables" {
-		err := r.insertIPTablesRules(r.nh.IPTables6, table)
-		if err != nil {
-			return err
+	for _, addr := range b {
+		seen[addr.IP.String()]--
+	}
+	for _, count := range seen {
+		if count != 0 {
+			return false
 		}
 	}
+	return true
+}
 
-	return nil
+// SetHijack перенаправляет порт для любых адресов назначения, если пакет пришёл с интерфейсов.
+// Устройства из exemptSet (может быть nil) и с MAC-адресами из exemptMACs перехвату не подлежат.
+// Пустой список интерфейсов оставляет перенаправление только для адресов роутера.
+func (r *PortRemap) SetHijack(interfaces []string, exemptSet *IPSet, exemptMACs []net.HardwareAddr) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	r.interfaces = interfaces
+	r.exemptSet = exemptSet
+	r.exemptMACs = exemptMACs
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	return r.nh.backend.InsertRemap(r.spec(), "", "")
+}
+
+func (r *PortRemap) NetfilterDHook(iptType, table string) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if !r.enabled.Load() {
+		return nil
+	}
+
+	return r.nh.backend.InsertRemap(r.spec(), iptType, table)
 }
 
 func (nh *NetfilterHelper) PortRemap(name string, from, to uint16, addr []netlink.Addr) *PortRemap {
@@ -0,0 +1,113 @@
+package records
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	EntryTypeA     = "A"
+	EntryTypeCName = "CNAME"
+	EntryTypePTR   = "PTR"
+)
+
+// Entry is a snapshot of a cached name
+type Entry struct {
+	Name     string
+	Type     string
+	ARecords []ARecord
+	CName    *CNameRecord
+	PTR      *PTRRecord
+}
+
+type entryKey struct {
+	name      string
+	entryType string
+}
+
+// ListEntries returns a page of cached names sorted by name and the number of names
+// matching the filter. Empty search and entryType match everything.
+func (r *Records) ListEntries(search, entryType string, offset, limit int) ([]Entry, int) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.cleanupRecords()
+	r.cleanupPTRRecords()
+
+	search = strings.ToLower(search)
+	matches := func(name, nameType string) bool {
+		if entryType != "" && entryType != nameType {
+			return false
+		}
+		return search == "" || strings.Contains(strings.ToLower(name), search)
+	}
+
+	var keys []entryKey
+	for name, record := range r.records {
+		nameType := EntryTypeA
+		if _, ok := record.(*CNameRecord); ok {
+			nameType = EntryTypeCName
+		}
+		if matches(name, nameType) {
+			keys = append(keys, entryKey{name: name, entryType: nameType})
+		}
+	}
+	for name := range r.ptrCache {
+		if matches(name, EntryTypePTR) {
+			keys = append(keys, entryKey{name: name, entryType: EntryTypePTR})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].entryType < keys[j].entryType
+	})
+
+	total := len(keys)
+	if offset > total {
+		offset = total
+	}
+	if limit <= 0 || offset+limit > total {
+		limit = total - offset
+	}
+
+	entries := make([]Entry, 0, limit)
+	for _, key := range keys[offset : offset+limit] {
+		entry := Entry{Name: key.name, Type: key.entryType}
+		switch key.entryType {
+		case EntryTypePTR:
+			ptr := *r.ptrCache[key.name]
+			entry.PTR = &ptr
+		case EntryTypeCName:
+			cname := *r.records[key.name].(*CNameRecord)
+			entry.CName = &cname
+		default:
+			for _, aRecord := range r.records[key.name].([]*ARecord) {
+				entry.ARecords = append(entry.ARecords, *aRecord)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total
+}
+
+// Delete removes every record of the name and reports whether there was any
+func (r *Records) Delete(name string) bool {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	_, found := r.records[name]
+	_, foundPTR := r.ptrCache[name]
+	delete(r.records, name)
+	delete(r.ptrCache, name)
+	return found || foundPTR
+}
+
+// Flush removes all records
+func (r *Records) Flush() {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	r.records = make(map[string]interface{})
+	r.ptrCache = make(map[string]*PTRRecord)
+}
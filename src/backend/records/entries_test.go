@@ -0,0 +1,43 @@
+package records
+
+import "testing"
+
+func TestListEntries(t *testing.T) {
+	r := New()
+	r.AddARecord("b.example.com", []byte{1, 2, 3, 4}, 60)
+	r.AddCNameRecord("a.example.com", "b.example.com", 60)
+	r.AddARecord("other.net", []byte{5, 6, 7, 8}, 60)
+	r.AddPTRRecord("4.3.2.1.in-addr.arpa", "b.example.com", 60)
+
+	entries, total := r.ListEntries("EXAMPLE", "", 1, 10)
+	if total != 2 || len(entries) != 1 || entries[0].Name != "b.example.com" || len(entries[0].ARecords) != 1 {
+		t.Fatalf("unexpected page: %d %+v", total, entries)
+	}
+	entries, total = r.ListEntries("", EntryTypeCName, 0, 0)
+	if total != 1 || entries[0].CName == nil || entries[0].CName.Alias != "b.example.com" {
+		t.Fatalf("unexpected cname entries: %d %+v", total, entries)
+	}
+	entries, total = r.ListEntries("", "", 10, 10)
+	if total != 4 || len(entries) != 0 {
+		t.Fatalf("page past the end should be empty: %d %+v", total, entries)
+	}
+}
+
+func TestDeleteAndFlush(t *testing.T) {
+	r := New()
+	r.AddARecord("example.com", []byte{1, 2, 3, 4}, 60)
+	r.AddARecord("example.org", []byte{5, 6, 7, 8}, 60)
+	r.AddPTRRecord("4.3.2.1.in-addr.arpa", "example.com", 60)
+
+	if !r.Delete("example.com") || r.Delete("example.com") {
+		t.Fatal("name should be deleted once")
+	}
+	if r.GetARecords("example.com") != nil || r.GetARecords("example.org") == nil {
+		t.Fatal("only the deleted name should be gone")
+	}
+
+	r.Flush()
+	if _, total := r.ListEntries("", "", 0, 0); total != 0 {
+		t.Fatalf("flush should remove everything: %d", total)
+	}
+}
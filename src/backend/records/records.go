@@ -13,6 +13,16 @@ type ARecord struct {
 	Deadline time.Time
 }
 
+// TTL returns the remaining lifetime of the record in seconds. It is never zero,
+// because a zero timeout makes an ipset entry permanent.
+func (a *ARecord) TTL(now time.Time) uint32 {
+	ttl := a.Deadline.Sub(now).Seconds()
+	if ttl < 1 {
+		return 1
+	}
+	return uint32(ttl)
+}
+
 type CNameRecord struct {
 	Alias    string
 	Deadline time.Time
@@ -30,7 +40,14 @@ type Records struct {
 	ptrCache map[string]*PTRRecord
 }
 
+// normalizeName lowercases a domain name: DNS names are case-insensitive and
+// resolvers may randomize the case of queries
+func normalizeName(domainName string) string {
+	return strings.ToLower(domainName)
+}
+
 func (r *Records) AddCNameRecord(domainName, alias string, ttl uint32) {
+	domainName, alias = normalizeName(domainName), normalizeName(alias)
 	if domainName == alias {
 		return
 	}
@@ -44,6 +61,7 @@ func (r *Records) AddCNameRecord(domainName, alias string, ttl uint32) {
 }
 
 func (r *Records) AddARecord(domainName string, addr net.IP, ttl uint32) {
+	domainName = normalizeName(domainName)
 	r.locker.Lock()
 	defer r.locker.Unlock()
 
@@ -65,6 +83,7 @@ func (r *Records) AddARecord(domainName string, addr net.IP, ttl uint32) {
 }
 
 func (r *Records) GetAliases(domainName string) []string {
+	domainName = normalizeName(domainName)
 	r.locker.Lock()
 	defer r.locker.Unlock()
 	r.cleanupRecords()
@@ -105,6 +124,7 @@ func (r *Records) GetAliases(domainName string) []string {
 }
 
 func (r *Records) GetARecords(domainName string) []*ARecord {
+	domainName = normalizeName(domainName)
 	r.locker.Lock()
 	defer r.locker.Unlock()
 	r.cleanupRecords()
@@ -127,6 +147,28 @@ func (r *Records) GetARecords(domainName string) []*ARecord {
 	}
 }
 
+// GetCanonicalName follows the CNAME chain and returns its last name
+func (r *Records) GetCanonicalName(domainName string) string {
+	domainName = normalizeName(domainName)
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.cleanupRecords()
+
+	loopDetect := make(map[string]struct{})
+	loopDetect[domainName] = struct{}{}
+	for {
+		cname, ok := r.records[domainName].(*CNameRecord)
+		if !ok {
+			return domainName
+		}
+		if _, ok := loopDetect[cname.Alias]; ok {
+			return domainName
+		}
+		domainName = cname.Alias
+		loopDetect[cname.Alias] = struct{}{}
+	}
+}
+
 func (r *Records) ListKnownDomains() []string {
 	r.locker.Lock()
 	defer r.locker.Unlock()
@@ -141,6 +183,21 @@ func (r *Records) ListKnownDomains() []string {
 	return domainsList
 }
 
+// ListARecordDomains returns domains holding A records, i.e. the ends of CNAME chains
+func (r *Records) ListARecordDomains() []string {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.cleanupRecords()
+
+	var domainsList []string
+	for name, records := range r.records {
+		if _, ok := records.([]*ARecord); ok {
+			domainsList = append(domainsList, name)
+		}
+	}
+	return domainsList
+}
+
 func (r *Records) cleanupRecords() {
 	now := time.Now()
 	for name, records := range r.records {
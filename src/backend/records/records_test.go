@@ -108,3 +108,48 @@ func TestAliases(t *testing.T) {
 		t.Fatal("no 5")
 	}
 }
+
+func TestCanonicalName(t *testing.T) {
+	r := New()
+	r.AddARecord("edge.example.com", []byte{1, 2, 3, 4}, 60)
+	r.AddCNameRecord("cdn.example.com", "edge.example.com", 60)
+	r.AddCNameRecord("www.example.com", "cdn.example.com", 60)
+	if name := r.GetCanonicalName("www.example.com"); name != "edge.example.com" {
+		t.Fatalf("unexpected canonical name: %s", name)
+	}
+	if name := r.GetCanonicalName("unknown.example.com"); name != "unknown.example.com" {
+		t.Fatalf("unexpected canonical name: %s", name)
+	}
+	domains := r.ListARecordDomains()
+	if len(domains) != 1 || domains[0] != "edge.example.com" {
+		t.Fatalf("unexpected A record domains: %v", domains)
+	}
+}
+
+func TestNameCase(t *testing.T) {
+	r := New()
+	r.AddARecord("Edge.Example.COM", []byte{1, 2, 3, 4}, 60)
+	r.AddCNameRecord("WWW.example.com", "edge.EXAMPLE.com", 60)
+	if records := r.GetARecords("www.EXAMPLE.com"); len(records) != 1 {
+		t.Fatalf("names should be matched case-insensitively: %v", records)
+	}
+	if name := r.GetCanonicalName("Www.Example.Com"); name != "edge.example.com" {
+		t.Fatalf("unexpected canonical name: %s", name)
+	}
+	aliases := r.GetAliases("EDGE.example.com")
+	slices.Sort(aliases)
+	if !slices.Equal(aliases, []string{"edge.example.com", "www.example.com"}) {
+		t.Fatalf("unexpected aliases: %v", aliases)
+	}
+}
+
+func TestARecordTTL(t *testing.T) {
+	now := time.Now()
+	record := ARecord{Address: []byte{1, 2, 3, 4}, Deadline: now.Add(time.Minute)}
+	if ttl := record.TTL(now); ttl != 60 {
+		t.Fatalf("remaining TTL should count down to the deadline: %d", ttl)
+	}
+	if ttl := record.TTL(now.Add(2 * time.Minute)); ttl != 1 {
+		t.Fatalf("expired record should not become permanent: %d", ttl)
+	}
+}
@@ -70,6 +70,8 @@ export const RULE_TYPES = [
   { value: "wildcard", label: "Wildcard" },
   { value: "regex", label: "Regex" },
   { value: "domain", label: "Domain" },
+  { value: "geosite", label: "GeoSite" },
+  { value: "geoip", label: "GeoIP" },
 ];
 
 export type Interfaces = {
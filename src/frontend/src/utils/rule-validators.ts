@@ -10,6 +10,11 @@ export function isValidNamespace(pattern: string): boolean {
   return isValidDomain(pattern);
 }
 
+// Same grammar as geodata.ParseReference in the backend
+export function isValidGeoReference(pattern: string): boolean {
+  return /^([a-zA-Z0-9_\-]+(\.[a-zA-Z0-9_\-]+)*\.dat:)?[a-zA-Z0-9_\-!]+(@[a-zA-Z0-9_\-!]+)?$/.test(pattern.trim());
+}
+
 export function isValidRegex(pattern: string): boolean {
   try {
     new RegExp(pattern);
@@ -27,4 +32,6 @@ export const VALIDATOP_MAP: Record<string, (pattern: string) => boolean> = {
   wildcard: isValidWildcard,
   domain: isValidDomain,
   namespace: isValidNamespace,
+  geosite: isValidGeoReference,
+  geoip: isValidGeoReference,
 };
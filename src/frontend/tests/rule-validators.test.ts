@@ -1,6 +1,7 @@
 import { strictEqual } from "node:assert";
 import {
   isValidDomain,
+  isValidGeoReference,
   isValidNamespace,
   isValidRegex,
   isValidWildcard,
@@ -102,3 +103,14 @@ Deno.test("namespace", () => {
   strictEqual(isValidNamespace("....domain.com"), false);
   strictEqual(isValidNamespace("domain.com...."), false);
 });
+
+Deno.test("geo reference", () => {
+  strictEqual(isValidGeoReference("youtube"), true);
+  strictEqual(isValidGeoReference("category-ads-all"), true);
+  strictEqual(isValidGeoReference("google@ads"), true);
+  strictEqual(isValidGeoReference("custom.dat:telegram"), true);
+  strictEqual(isValidGeoReference("../geosite.dat:google"), false);
+  strictEqual(isValidGeoReference("custom:google"), false);
+  strictEqual(isValidGeoReference(""), false);
+  strictEqual(isValidGeoReference(" youtube "), true);
+});